@@ -0,0 +1,83 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"net"
+	"sync"
+)
+
+// admissionControl counts the connections of a server in total and per ip address/subnet in order to
+// enforce CfgMaxConnections and CfgMaxConnectionsPerIP. Detached sessions are still counted.
+type admissionControl struct {
+	mutex  sync.Mutex
+	total  int
+	perKey map[string]int
+}
+
+func newAdmissionControl() *admissionControl {
+	return &admissionControl{perKey: make(map[string]int)}
+}
+
+// tryAcquire reserves a slot for the address. It returns false if one of the limits is reached.
+func (a *admissionControl) tryAcquire(addr *net.UDPAddr) (string, bool) {
+	key := subnetKey(addr.IP)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if CfgMaxConnections > 0 && a.total >= CfgMaxConnections {
+		return "", false
+	}
+
+	if CfgMaxConnectionsPerIP > 0 && a.perKey[key] >= CfgMaxConnectionsPerIP {
+		return "", false
+	}
+
+	a.total++
+	a.perKey[key]++
+	return key, true
+}
+
+// move transfers a slot to another address without checking the limits (used when sessions are resumed).
+func (a *admissionControl) move(key string, addr *net.UDPAddr) string {
+	newKey := subnetKey(addr.IP)
+	if newKey == key {
+		return key
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.releaseKey(key)
+	a.perKey[newKey]++
+	return newKey
+}
+
+func (a *admissionControl) release(key string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.total--
+	a.releaseKey(key)
+}
+
+// has to be called while holding the mutex
+func (a *admissionControl) releaseKey(key string) {
+	if a.perKey[key] <= 1 {
+		delete(a.perKey, key)
+	} else {
+		a.perKey[key]--
+	}
+}
+
+// subnetKey groups addresses by the prefix lengths defined in CfgConnectionSubnetBitsIPv4/IPv6.
+func subnetKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(CfgConnectionSubnetBitsIPv4, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(CfgConnectionSubnetBitsIPv6, 128)).String()
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmissionLimits(t *testing.T) {
+	defer func(total, perIP, bits int) {
+		CfgMaxConnections, CfgMaxConnectionsPerIP, CfgConnectionSubnetBitsIPv4 = total, perIP, bits
+	}(CfgMaxConnections, CfgMaxConnectionsPerIP, CfgConnectionSubnetBitsIPv4)
+
+	CfgMaxConnections = 3
+	CfgMaxConnectionsPerIP = 2
+	CfgConnectionSubnetBitsIPv4 = 24
+
+	a := newAdmissionControl()
+	addr := func(ip string) *net.UDPAddr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 1} }
+
+	k1, ok1 := a.tryAcquire(addr("10.0.0.1"))
+	_, ok2 := a.tryAcquire(addr("10.0.0.2"))
+	_, ok3 := a.tryAcquire(addr("10.0.0.3"))
+
+	if !ok1 || !ok2 || ok3 {
+		t.Errorf("Expected only 2 connections from the same subnet (%v, %v, %v)", ok1, ok2, ok3)
+	}
+
+	_, ok4 := a.tryAcquire(addr("10.0.1.1"))
+	_, ok5 := a.tryAcquire(addr("10.0.2.1"))
+
+	if !ok4 || ok5 {
+		t.Errorf("Expected only 3 connections in total (%v, %v)", ok4, ok5)
+	}
+
+	a.release(k1)
+
+	if _, ok := a.tryAcquire(addr("10.0.0.4")); !ok {
+		t.Error("Expected released slot to be available again")
+	}
+}
+
+func TestExecGuardLimit(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	g := newExecGuard(2, 1000)
+
+	if !g.tryExecute(1, clockTime(clock)) || g.tryExecute(1, clockTime(clock)) {
+		t.Error("Expected only one execution per id")
+	}
+
+	if !g.tryExecute(2, clockTime(clock)) || g.tryExecute(3, clockTime(clock)) {
+		t.Error("Expected only 2 pending executions")
+	}
+
+	g.finish(2)
+
+	if !g.tryExecute(3, clockTime(clock)) {
+		t.Error("Expected finished execution to free a slot")
+	}
+
+	clock.Advance(time.Second)
+
+	if !g.tryExecute(4, clockTime(clock)) || !g.tryExecute(1, clockTime(clock)) || g.len() != 2 {
+		t.Errorf("Expected timed out executions to be discarded (%v pending)", g.len())
+	}
+}
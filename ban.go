@@ -0,0 +1,280 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ban describes a banned ip address or network.
+type Ban struct {
+	// CIDR is the banned network. Single addresses use the full prefix length (e.g. 1.2.3.4/32).
+	CIDR string `json:"cidr"`
+
+	// Expires is the time the ban ends. The zero value never expires.
+	Expires time.Time `json:"expires"`
+
+	// Reason is sent to banned clients.
+	Reason string `json:"reason,omitempty"`
+}
+
+// BanStore persists the bans of a server. Save is called with the complete list whenever it changes.
+type BanStore interface {
+	Load() ([]Ban, error)
+	Save(bans []Ban) error
+}
+
+type memoryBanStore struct {
+	mutex sync.Mutex
+	bans  []Ban
+}
+
+// NewMemoryBanStore returns a BanStore that keeps the bans in memory only. It is the default of every server.
+func NewMemoryBanStore() BanStore {
+	return new(memoryBanStore)
+}
+
+func (s *memoryBanStore) Load() ([]Ban, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Ban(nil), s.bans...), nil
+}
+
+func (s *memoryBanStore) Save(bans []Ban) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bans = append([]Ban(nil), bans...)
+	return nil
+}
+
+type fileBanStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewFileBanStore returns a BanStore that saves the bans as json in the given file. A missing file is
+// treated as an empty list.
+func NewFileBanStore(path string) BanStore {
+	return &fileBanStore{path: path}
+}
+
+func (s *fileBanStore) Load() ([]Ban, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var bans []Ban
+	err = json.Unmarshal(data, &bans)
+	return bans, err
+}
+
+func (s *fileBanStore) Save(bans []Ban) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that the list is never left half written
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+type banEntry struct {
+	network *net.IPNet
+	ban     Ban
+}
+
+// banList holds all active bans. Bans of single addresses are looked up in a map, networks are checked one by one.
+type banList struct {
+	mutex     sync.RWMutex
+	addresses map[[16]byte]*banEntry
+	networks  []*banEntry
+}
+
+func newBanList() *banList {
+	return &banList{addresses: make(map[[16]byte]*banEntry)}
+}
+
+// parseBanTarget accepts an ip address or a CIDR.
+func parseBanTarget(target string) (*net.IPNet, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(target)
+	return network, err
+}
+
+func ipKey(ip net.IP) [16]byte {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	return key
+}
+
+func isSingleAddress(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	return ones == bits
+}
+
+// add replaces existing bans of the same network.
+func (l *banList) add(network *net.IPNet, ban Ban) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	e := &banEntry{network: network, ban: ban}
+
+	// single addresses replace their ban through the map key, only networks have to be searched
+	if isSingleAddress(network) {
+		l.addresses[ipKey(network.IP)] = e
+	} else {
+		l.remove(network)
+		l.networks = append(l.networks, e)
+	}
+}
+
+// has to be called while holding the mutex
+func (l *banList) remove(network *net.IPNet) bool {
+	if isSingleAddress(network) {
+		key := ipKey(network.IP)
+		_, f := l.addresses[key]
+		delete(l.addresses, key)
+		return f
+	}
+
+	cidr := network.String()
+
+	for i, e := range l.networks {
+		if e.network.String() == cidr {
+			l.networks = append(l.networks[:i], l.networks[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *banList) delete(network *net.IPNet) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.remove(network)
+}
+
+// lookup returns the ban matching the ip if there is one that is not expired.
+func (l *banList) lookup(ip net.IP, now time.Time) (Ban, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if e, f := l.addresses[ipKey(ip)]; f && !e.expired(now) {
+		return e.ban, true
+	}
+
+	for _, e := range l.networks {
+		if !e.expired(now) && e.network.Contains(ip) {
+			return e.ban, true
+		}
+	}
+
+	return Ban{}, false
+}
+
+// prune removes expired bans and returns whether any were removed.
+func (l *banList) prune(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	pruned := false
+
+	for key, e := range l.addresses {
+		if e.expired(now) {
+			delete(l.addresses, key)
+			pruned = true
+		}
+	}
+
+	networks := l.networks[:0]
+
+	for _, e := range l.networks {
+		if e.expired(now) {
+			pruned = true
+		} else {
+			networks = append(networks, e)
+		}
+	}
+
+	l.networks = networks
+	return pruned
+}
+
+func (l *banList) list() []Ban {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	bans := make([]Ban, 0, len(l.addresses)+len(l.networks))
+
+	for _, e := range l.addresses {
+		bans = append(bans, e.ban)
+	}
+
+	for _, e := range l.networks {
+		bans = append(bans, e.ban)
+	}
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].CIDR < bans[j].CIDR })
+	return bans
+}
+
+func (e *banEntry) expired(now time.Time) bool {
+	return !e.ban.Expires.IsZero() && !now.Before(e.ban.Expires)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	l := newBanList()
+	now := time.Unix(1000, 0)
+
+	single, _ := parseBanTarget("1.2.3.4")
+	network, _ := parseBanTarget("10.0.0.0/8")
+
+	l.add(single, Ban{CIDR: single.String(), Reason: "a"})
+	l.add(network, Ban{CIDR: network.String(), Expires: now.Add(time.Second)})
+
+	if ban, f := l.lookup(net.ParseIP("1.2.3.4"), now); !f || ban.Reason != "a" || ban.CIDR != "1.2.3.4/32" {
+		t.Errorf("Expected single address to be banned: %v", ban)
+	}
+
+	if _, f := l.lookup(net.ParseIP("10.20.30.40"), now); !f {
+		t.Error("Expected address in network to be banned")
+	}
+
+	if _, f := l.lookup(net.ParseIP("11.0.0.1"), now); f {
+		t.Error("Expected address outside of bans to be allowed")
+	}
+
+	if _, f := l.lookup(net.ParseIP("10.20.30.40"), now.Add(time.Second)); f {
+		t.Error("Expected expired ban to be ignored")
+	}
+
+	if !l.prune(now.Add(time.Second)) || len(l.list()) != 1 {
+		t.Errorf("Expected expired ban to be pruned: %v", l.list())
+	}
+
+	l.add(single, Ban{CIDR: single.String(), Reason: "b"})
+
+	if bans := l.list(); len(bans) != 1 || bans[0].Reason != "b" {
+		t.Errorf("Expected ban to be replaced: %v", bans)
+	}
+
+	if !l.delete(single) || len(l.list()) != 0 {
+		t.Error("Expected ban to be deleted")
+	}
+
+	l.add(network, Ban{CIDR: network.String(), Reason: "a"})
+	l.add(network, Ban{CIDR: network.String(), Reason: "b"})
+
+	if bans := l.list(); len(bans) != 1 || bans[0].Reason != "b" {
+		t.Errorf("Expected network ban to be replaced: %v", bans)
+	}
+
+	if !l.delete(network) || l.delete(network) || len(l.list()) != 0 {
+		t.Error("Expected network ban to be deleted once")
+	}
+}
+
+func BenchmarkBanListAdd(b *testing.B) {
+	l := newBanList()
+	networks := make([]*net.IPNet, b.N)
+	for i := range networks {
+		networks[i], _ = parseBanTarget(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String())
+	}
+
+	b.ResetTimer()
+	for _, network := range networks {
+		l.add(network, Ban{CIDR: network.String()})
+	}
+}
+
+func TestFileBanStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rmnp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileBanStore(filepath.Join(dir, "bans.json"))
+
+	if bans, err := store.Load(); err != nil || len(bans) != 0 {
+		t.Fatalf("Expected missing file to be empty (%v, %v)", bans, err)
+	}
+
+	expires := time.Unix(2000, 0).UTC()
+	saved := []Ban{{CIDR: "1.2.3.4/32", Reason: "cheating"}, {CIDR: "10.0.0.0/8", Expires: expires}}
+
+	if err := store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewFileBanStore(filepath.Join(dir, "bans.json")).Load()
+	if err != nil || len(loaded) != 2 {
+		t.Fatalf("Expected 2 bans to be loaded (%v, %v)", loaded, err)
+	}
+
+	if loaded[0] != saved[0] || !loaded[1].Expires.Equal(expires) || !loaded[0].Expires.IsZero() {
+		t.Errorf("Expected loaded bans to equal saved ones: %v", loaded)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"errors"
+	"net"
+)
+
+var errBatchUnsupported = errors.New("batched socket io is not supported")
+
+// enableBatching creates a batchIO for every socket if CfgSocketBatchSize is set and the
+// platform supports it. If a batchIO cannot be created the default socket io is used.
+func (impl *protocolImpl) enableBatching() {
+	if CfgSocketBatchSize <= 1 || !batchSupported {
+		return
+	}
+
+	batches := make(map[*net.UDPConn]*batchIO)
+
+	for _, socket := range impl.sockets {
+		b, err := newBatchIO(socket, CfgSocketBatchSize)
+		if err != nil {
+			return
+		}
+
+		batches[socket] = b
+	}
+
+	impl.batches = batches
+}
+
+// batch returns the batchIO of the socket or nil if batching is not used. hold and release
+// may be called on nil.
+func (impl *protocolImpl) batch(socket *net.UDPConn) *batchIO {
+	return impl.batches[socket]
+}
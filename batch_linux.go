@@ -0,0 +1,353 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+//go:build linux && (amd64 || arm64)
+
+package rmnp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const batchSupported = true
+
+// mmsghdr mirrors struct mmsghdr of the linux kernel for 64 bit architectures.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// batchIO reads and writes multiple datagrams per syscall using recvmmsg and sendmmsg.
+type batchIO struct {
+	conn      syscall.RawConn
+	family    int
+	connected bool
+
+	readMutex   sync.Mutex
+	readBuffers [][]byte
+	readNames   []syscall.RawSockaddrAny
+	readIovecs  []syscall.Iovec
+	readHeaders []mmsghdr
+	readCount   int
+	readNext    int
+
+	writeMutex   sync.Mutex
+	writeSize    int
+	holds        int
+	flushing     bool
+	sendCalls    uint64 // atomic
+	pending      []batchMessage
+	sending      []batchMessage
+	free         [][]byte
+	writeNames   []syscall.RawSockaddrAny
+	writeIovecs  []syscall.Iovec
+	writeHeaders []mmsghdr
+}
+
+type batchMessage struct {
+	addr   *net.UDPAddr
+	buffer []byte
+}
+
+func newBatchIO(socket *net.UDPConn, size int) (*batchIO, error) {
+	conn, err := socket.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &batchIO{
+		conn:         conn,
+		connected:    socket.RemoteAddr() != nil,
+		readBuffers:  make([][]byte, size),
+		readNames:    make([]syscall.RawSockaddrAny, size),
+		readIovecs:   make([]syscall.Iovec, size),
+		readHeaders:  make([]mmsghdr, size),
+		writeSize:    size,
+		writeNames:   make([]syscall.RawSockaddrAny, size),
+		writeIovecs:  make([]syscall.Iovec, size),
+		writeHeaders: make([]mmsghdr, size),
+	}
+
+	var sa syscall.Sockaddr
+	controlErr := conn.Control(func(fd uintptr) {
+		sa, err = syscall.Getsockname(int(fd))
+	})
+
+	if controlErr != nil {
+		return nil, controlErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch sa.(type) {
+	case *syscall.SockaddrInet4:
+		b.family = syscall.AF_INET
+	case *syscall.SockaddrInet6:
+		b.family = syscall.AF_INET6
+	default:
+		return nil, errBatchUnsupported
+	}
+
+	for i := range b.readBuffers {
+		b.readBuffers[i] = make([]byte, CfgMTU)
+		b.readIovecs[i].Base = &b.readBuffers[i][0]
+		b.readIovecs[i].SetLen(CfgMTU)
+		b.readHeaders[i].hdr.Iov = &b.readIovecs[i]
+		b.readHeaders[i].hdr.Iovlen = 1
+	}
+
+	return b, nil
+}
+
+// read returns the next datagram of the current batch and reads a new batch if all
+// datagrams were returned already.
+func (b *batchIO) read(buffer []byte) (int, *net.UDPAddr, bool) {
+	b.readMutex.Lock()
+	defer b.readMutex.Unlock()
+
+	if b.readNext >= b.readCount && !b.fill() {
+		return 0, nil, false
+	}
+
+	i := b.readNext
+	b.readNext++
+
+	length := copy(buffer, b.readBuffers[i][:b.readHeaders[i].len])
+	return length, sockaddrToUDPAddr(&b.readNames[i]), true
+}
+
+// has to be called while holding the read mutex
+func (b *batchIO) fill() bool {
+	for i := range b.readHeaders {
+		b.readHeaders[i].hdr.Name = (*byte)(unsafe.Pointer(&b.readNames[i]))
+		b.readHeaders[i].hdr.Namelen = syscall.SizeofSockaddrAny
+		b.readHeaders[i].len = 0
+	}
+
+	var n uintptr
+	var errno syscall.Errno
+
+	err := b.conn.Read(func(fd uintptr) bool {
+		n, _, errno = syscall.Syscall6(sysRecvmmsg, fd, uintptr(unsafe.Pointer(&b.readHeaders[0])),
+			uintptr(len(b.readHeaders)), syscall.MSG_DONTWAIT, 0, 0)
+
+		// returning false waits until the socket is readable (or the deadline exceeded)
+		return errno != syscall.EAGAIN && errno != syscall.EWOULDBLOCK
+	})
+
+	if err != nil || errno != 0 {
+		return false
+	}
+
+	b.readCount = int(n)
+	b.readNext = 0
+	return n > 0
+}
+
+// write queues the datagram. If no update pass holds the writes back and no other goroutine
+// is currently sending, the calling goroutine sends all queued datagrams in batches. Otherwise
+// the datagram is picked up by release or the sending goroutine. The buffer is copied and can
+// be reused after the call.
+func (b *batchIO) write(addr *net.UDPAddr, buffer []byte) {
+	b.writeMutex.Lock()
+
+	var data []byte
+	if n := len(b.free); n > 0 {
+		data = b.free[n-1][:0]
+		b.free = b.free[:n-1]
+	}
+
+	b.pending = append(b.pending, batchMessage{addr: addr, buffer: append(data, buffer...)})
+
+	if b.holds > 0 {
+		b.writeMutex.Unlock()
+		return
+	}
+
+	b.flush()
+}
+
+// hold makes writes wait until release is called so that all datagrams written during an
+// update pass are sent with as few syscalls as possible.
+func (b *batchIO) hold() {
+	if b == nil {
+		return
+	}
+
+	b.writeMutex.Lock()
+	b.holds++
+	b.writeMutex.Unlock()
+}
+
+// release ends a hold and sends the queued datagrams. Datagrams of other passes that are still
+// holding are sent as well, they would only wait longer otherwise.
+func (b *batchIO) release() {
+	if b == nil {
+		return
+	}
+
+	b.writeMutex.Lock()
+	b.holds--
+	b.flush()
+}
+
+// has to be called while holding the write mutex, it is unlocked afterwards
+func (b *batchIO) flush() {
+	if b.flushing || len(b.pending) == 0 {
+		b.writeMutex.Unlock()
+		return
+	}
+
+	b.flushing = true
+
+	for len(b.pending) > 0 {
+		b.pending, b.sending = b.sending[:0], b.pending
+		b.writeMutex.Unlock()
+
+		for start := 0; start < len(b.sending); start += b.writeSize {
+			end := start + b.writeSize
+			if end > len(b.sending) {
+				end = len(b.sending)
+			}
+
+			b.send(b.sending[start:end])
+		}
+
+		b.writeMutex.Lock()
+
+		for i := range b.sending {
+			b.free = append(b.free, b.sending[i].buffer)
+			b.sending[i] = batchMessage{}
+		}
+	}
+
+	b.flushing = false
+	b.writeMutex.Unlock()
+}
+
+// only called by the flushing goroutine. returns the number of syscalls used.
+func (b *batchIO) send(messages []batchMessage) int {
+	for i, m := range messages {
+		h := &b.writeHeaders[i]
+		*h = mmsghdr{}
+
+		b.writeIovecs[i].Base = &m.buffer[0]
+		b.writeIovecs[i].SetLen(len(m.buffer))
+		h.hdr.Iov = &b.writeIovecs[i]
+		h.hdr.Iovlen = 1
+
+		if !b.connected && m.addr != nil {
+			if length := udpAddrToSockaddr(m.addr, b.family, &b.writeNames[i]); length > 0 {
+				h.hdr.Name = (*byte)(unsafe.Pointer(&b.writeNames[i]))
+				h.hdr.Namelen = length
+			}
+		}
+	}
+
+	calls := 0
+
+	for sent := 0; sent < len(messages); {
+		var n uintptr
+		var errno syscall.Errno
+
+		err := b.conn.Write(func(fd uintptr) bool {
+			n, _, errno = syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&b.writeHeaders[sent])),
+				uintptr(len(messages)-sent), syscall.MSG_DONTWAIT, 0, 0)
+
+			return errno != syscall.EAGAIN && errno != syscall.EWOULDBLOCK
+		})
+
+		if err != nil {
+			return calls
+		}
+
+		calls++
+		atomic.AddUint64(&b.sendCalls, 1)
+
+		// udp is not reliable anyway so a datagram that cannot be sent (e.g. unreachable address) is dropped
+		// but the remaining ones are still sent
+		if errno != 0 || n == 0 {
+			sent++
+			continue
+		}
+
+		sent += int(n)
+	}
+
+	return calls
+}
+
+func sockaddrToUDPAddr(rsa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(ntohs(sa.Port))}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: int(ntohs(sa.Port))}
+
+		if sa.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+
+		return addr
+	}
+
+	return nil
+}
+
+// udpAddrToSockaddr writes the address into rsa and returns the used length or 0
+// if the address cannot be represented in the given family.
+func udpAddrToSockaddr(addr *net.UDPAddr, family int, rsa *syscall.RawSockaddrAny) uint32 {
+	switch family {
+	case syscall.AF_INET:
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0
+		}
+
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		*sa = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Port: ntohs(uint16(addr.Port))}
+		copy(sa.Addr[:], ip)
+		return syscall.SizeofSockaddrInet4
+	case syscall.AF_INET6:
+		ip := addr.IP.To16()
+		if ip == nil {
+			return 0
+		}
+
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Port: ntohs(uint16(addr.Port))}
+		copy(sa.Addr[:], ip)
+
+		if addr.Zone != "" {
+			if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+				sa.Scope_id = uint32(ifi.Index)
+			}
+		}
+
+		return syscall.SizeofSockaddrInet6
+	}
+
+	return 0
+}
+
+// ntohs converts between network and host byte order (both directions are the same swap).
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
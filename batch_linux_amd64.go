@@ -0,0 +1,11 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+// SYS_SENDMMSG is not exported by the syscall package for linux/amd64
+const (
+	sysRecvmmsg = 299
+	sysSendmmsg = 307
+)
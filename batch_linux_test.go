@@ -0,0 +1,172 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+//go:build linux && (amd64 || arm64)
+
+package rmnp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBatchIO(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	sender, err := net.DialUDP("udp", nil, receiver.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	in, err := newBatchIO(receiver, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := newBatchIO(sender, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		out.write(nil, []byte{byte(i), 1, 2})
+	}
+
+	buffer := make([]byte, CfgMTU)
+	receiver.SetDeadline(time.Now().Add(time.Second))
+
+	for i := 0; i < 10; i++ {
+		length, addr, next := in.read(buffer)
+
+		if !next {
+			t.Fatalf("Expected to read datagram %v", i)
+		}
+
+		if length != 3 || buffer[0] != byte(i) {
+			t.Errorf("Expected datagram %v not %v", i, buffer[:length])
+		}
+
+		if addr.String() != sender.LocalAddr().String() {
+			t.Errorf("Expected sender address %v not %v", sender.LocalAddr(), addr)
+		}
+	}
+
+	// answer using the address returned by the batched read
+	out.write(nil, []byte{42})
+	_, addr, _ := in.read(buffer)
+
+	in.write(addr, []byte{24})
+	sender.SetDeadline(time.Now().Add(time.Second))
+
+	if length, err := sender.Read(buffer); err != nil || length != 1 || buffer[0] != 24 {
+		t.Errorf("Expected answer to arrive (err: %v)", err)
+	}
+}
+
+func TestBatchIOSendMultiplePerSyscall(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	out, err := newBatchIO(sender, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+	messages := make([]batchMessage, 4)
+	for i := range messages {
+		messages[i] = batchMessage{addr: addr, buffer: []byte{byte(i)}}
+	}
+
+	if calls := out.send(messages); calls != 1 {
+		t.Errorf("Expected 4 datagrams to be sent with 1 syscall not %v", calls)
+	}
+
+	// an unconnected socket cannot send without address, the following datagrams must still be sent
+	messages[0].addr = nil
+	if calls := out.send(messages); calls != 2 {
+		t.Errorf("Expected failing datagram to be skipped with 2 syscalls not %v", calls)
+	}
+
+	buffer := make([]byte, CfgMTU)
+	receiver.SetDeadline(time.Now().Add(time.Second))
+
+	for _, expected := range []byte{0, 1, 2, 3, 1, 2, 3} {
+		if length, err := receiver.Read(buffer); err != nil || length != 1 || buffer[0] != expected {
+			t.Errorf("Expected datagram %v not %v (err: %v)", expected, buffer[:length], err)
+		}
+	}
+}
+
+func TestBatchIOHoldWrites(t *testing.T) {
+	defer func(size int) { CfgSocketBatchSize = size }(CfgSocketBatchSize)
+	CfgSocketBatchSize = 8
+
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	s := NewServer("127.0.0.1:0")
+	s.Start()
+	defer s.Stop()
+
+	b := s.batch(s.socket)
+	if b == nil {
+		t.Fatal("Expected batching to be enabled")
+	}
+
+	addr := receiver.LocalAddr().(*net.UDPAddr)
+
+	// without a pass every write is sent on its own
+	for i := 0; i < 4; i++ {
+		s.writeFunc(s.socket, addr, []byte{byte(i)})
+	}
+
+	if calls := atomic.LoadUint64(&b.sendCalls); calls != 4 {
+		t.Errorf("Expected 4 syscalls not %v", calls)
+	}
+
+	// the writes of a pass are sent together once it is released
+	b.hold()
+	for i := 4; i < 8; i++ {
+		s.writeFunc(s.socket, addr, []byte{byte(i)})
+	}
+
+	if calls := atomic.LoadUint64(&b.sendCalls); calls != 4 {
+		t.Errorf("Expected writes to be held back but %v syscalls were used", calls)
+	}
+
+	b.release()
+
+	if calls := atomic.LoadUint64(&b.sendCalls); calls != 5 {
+		t.Errorf("Expected 4 held writes to be sent with 1 syscall not %v", calls-4)
+	}
+
+	buffer := make([]byte, CfgMTU)
+	receiver.SetDeadline(time.Now().Add(time.Second))
+
+	for i := 0; i < 8; i++ {
+		if length, err := receiver.Read(buffer); err != nil || length != 1 || buffer[0] != byte(i) {
+			t.Errorf("Expected datagram %v not %v (err: %v)", i, buffer[:length], err)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+//go:build !(linux && (amd64 || arm64))
+
+package rmnp
+
+import "net"
+
+const batchSupported = false
+
+func newBatchIO(socket *net.UDPConn, size int) (*batchIO, error) {
+	return nil, errBatchUnsupported
+}
+
+type batchIO struct{}
+
+func (b *batchIO) read(buffer []byte) (int, *net.UDPAddr, bool) {
+	return 0, nil, false
+}
+
+func (b *batchIO) write(addr *net.UDPAddr, buffer []byte) {}
+func (b *batchIO) hold()                                  {}
+func (b *batchIO) release()                               {}
@@ -0,0 +1,227 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"errors"
+	"math"
+)
+
+var (
+	// ErrInvalidBitCount is returned if less than 1 or more than 64 bits should be written or read.
+	ErrInvalidBitCount = errors.New("rmnp: bit count must be between 1 and 64")
+
+	// ErrValueOutOfRange is returned if a bounded value is outside of its range when written or read.
+	ErrValueOutOfRange = errors.New("rmnp: value out of range")
+
+	// ErrInvalidPrecision is returned if a float should be quantized with a precision that is not positive.
+	ErrInvalidPrecision = errors.New("rmnp: precision must be positive")
+)
+
+// BitWriter packs values into as few bits as needed. Bits are written starting with the least significant bit
+// of every byte. Unlike Serializer it is meant for data with known small ranges like game state.
+type BitWriter struct {
+	data []byte
+	bit  uint
+}
+
+// NewBitWriter creates an empty BitWriter.
+func NewBitWriter() *BitWriter {
+	return new(BitWriter)
+}
+
+// WriteBits writes the lowest bits of the value.
+func (w *BitWriter) WriteBits(value uint64, bits uint) error {
+	if bits == 0 || bits > 64 {
+		return ErrInvalidBitCount
+	}
+
+	w.writeBits(value, bits)
+	return nil
+}
+
+// WriteBool writes the value as single bit.
+func (w *BitWriter) WriteBool(value bool) {
+	if value {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+// WriteInt writes a value between min and max (both inclusive) using only the bits needed for the range.
+func (w *BitWriter) WriteInt(value, min, max int64) error {
+	if value < min || value > max {
+		return ErrValueOutOfRange
+	}
+
+	w.writeBits(uint64(value)-uint64(min), bitsRequired(uint64(max)-uint64(min)))
+	return nil
+}
+
+// WriteFloat quantizes a value between min and max to multiples of precision and writes it with the bits
+// needed for the resulting number of steps. E.g. an angle between 0 and 360 with precision 0.5 takes 10 bits.
+func (w *BitWriter) WriteFloat(value, min, max, precision float64) error {
+	if !(precision > 0) {
+		return ErrInvalidPrecision
+	}
+
+	if !(value >= min && value <= max) {
+		return ErrValueOutOfRange
+	}
+
+	steps := quantizationSteps(min, max, precision)
+	w.writeBits(uint64(math.Min(math.Floor((value-min)/precision+0.5), float64(steps))), bitsRequired(steps))
+	return nil
+}
+
+// Align pads the data with zero bits up to the next byte boundary.
+func (w *BitWriter) Align() {
+	w.bit = 0
+}
+
+// BitsWritten returns the number of bits written so far including alignment padding.
+func (w *BitWriter) BitsWritten() int {
+	if w.bit == 0 {
+		return len(w.data) * 8
+	}
+
+	return (len(w.data)-1)*8 + int(w.bit)
+}
+
+// Bytes returns the written data. The last byte is padded with zero bits.
+func (w *BitWriter) Bytes() []byte {
+	return w.data
+}
+
+func (w *BitWriter) writeBits(value uint64, bits uint) {
+	for bits > 0 {
+		if w.bit == 0 {
+			w.data = append(w.data, 0)
+		}
+
+		n := 8 - w.bit
+		if n > bits {
+			n = bits
+		}
+
+		w.data[len(w.data)-1] |= byte(value&(1<<n-1)) << w.bit
+		value >>= n
+		bits -= n
+		w.bit = (w.bit + n) % 8
+	}
+}
+
+// BitReader reads values written by BitWriter. Reads past the end of the data fail with
+// ErrSerializerUnderflow without consuming anything so that malformed packets cannot cause panics.
+type BitReader struct {
+	data     []byte
+	position uint
+}
+
+// NewBitReader creates a BitReader for the data.
+func NewBitReader(data []byte) *BitReader {
+	return &BitReader{data: data}
+}
+
+// ReadBits reads a value written with WriteBits.
+func (r *BitReader) ReadBits(bits uint) (uint64, error) {
+	if bits == 0 || bits > 64 {
+		return 0, ErrInvalidBitCount
+	}
+
+	return r.readBits(bits)
+}
+
+// ReadBool reads a value written with WriteBool.
+func (r *BitReader) ReadBool() (bool, error) {
+	value, err := r.readBits(1)
+	return value == 1, err
+}
+
+// ReadInt reads a value written with WriteInt. The range has to match the one used for writing.
+func (r *BitReader) ReadInt(min, max int64) (int64, error) {
+	span := uint64(max) - uint64(min)
+	value, err := r.readBits(bitsRequired(span))
+	if err != nil {
+		return 0, err
+	}
+
+	if value > span {
+		return 0, ErrValueOutOfRange
+	}
+
+	return int64(uint64(min) + value), nil
+}
+
+// ReadFloat reads a value written with WriteFloat. The parameters have to match the ones used for writing.
+func (r *BitReader) ReadFloat(min, max, precision float64) (float64, error) {
+	if !(precision > 0) {
+		return 0, ErrInvalidPrecision
+	}
+
+	steps := quantizationSteps(min, max, precision)
+	value, err := r.readBits(bitsRequired(steps))
+	if err != nil {
+		return 0, err
+	}
+
+	if value > steps {
+		return 0, ErrValueOutOfRange
+	}
+
+	return math.Min(min+float64(value)*precision, max), nil
+}
+
+// Align skips the padding written by BitWriter.Align.
+func (r *BitReader) Align() error {
+	if padding := (8 - r.position%8) % 8; padding > 0 {
+		_, err := r.readBits(padding)
+		return err
+	}
+
+	return nil
+}
+
+// BitsRemaining returns the number of unread bits including the padding of the last byte.
+func (r *BitReader) BitsRemaining() int {
+	return len(r.data)*8 - int(r.position)
+}
+
+func (r *BitReader) readBits(bits uint) (uint64, error) {
+	if int(bits) > r.BitsRemaining() {
+		return 0, ErrSerializerUnderflow
+	}
+
+	var value uint64
+	for read := uint(0); read < bits; {
+		offset := r.position % 8
+		n := 8 - offset
+		if n > bits-read {
+			n = bits - read
+		}
+
+		chunk := uint64(r.data[r.position/8]>>offset) & (1<<n - 1)
+		value |= chunk << read
+		read += n
+		r.position += n
+	}
+
+	return value, nil
+}
+
+// bitsRequired returns the number of bits needed to store values from 0 to max.
+func bitsRequired(max uint64) uint {
+	bits := uint(0)
+	for ; max > 0; max >>= 1 {
+		bits++
+	}
+
+	return bits
+}
+
+func quantizationSteps(min, max, precision float64) uint64 {
+	return uint64(math.Ceil((max - min) / precision))
+}
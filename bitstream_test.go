@@ -0,0 +1,103 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBitStreamRoundTrip(t *testing.T) {
+	w := NewBitWriter()
+	w.WriteBool(true)
+	w.WriteInt(73, 0, 100)
+	w.WriteInt(-5, -10, 10)
+	w.WriteFloat(123.4, 0, 360, 0.5)
+	w.WriteBits(math.MaxUint64, 64)
+	w.WriteBool(false)
+	w.Align()
+	w.WriteBits(0xab, 8)
+
+	// 1 + 7 + 5 + 10 + 64 + 1 = 88 bits, already aligned
+	if w.BitsWritten() != 96 || len(w.Bytes()) != 12 {
+		t.Fatalf("Expected 96 bits in 12 bytes not %v in %v", w.BitsWritten(), len(w.Bytes()))
+	}
+
+	r := NewBitReader(w.Bytes())
+
+	if v, err := r.ReadBool(); !v || err != nil {
+		t.Errorf("Expected true not %v (%v)", v, err)
+	}
+
+	if v, err := r.ReadInt(0, 100); v != 73 || err != nil {
+		t.Errorf("Expected 73 not %v (%v)", v, err)
+	}
+
+	if v, err := r.ReadInt(-10, 10); v != -5 || err != nil {
+		t.Errorf("Expected -5 not %v (%v)", v, err)
+	}
+
+	if v, err := r.ReadFloat(0, 360, 0.5); v != 123.5 || err != nil {
+		t.Errorf("Expected 123.5 not %v (%v)", v, err)
+	}
+
+	if v, err := r.ReadBits(64); v != math.MaxUint64 || err != nil {
+		t.Errorf("Expected max uint64 not %v (%v)", v, err)
+	}
+
+	if v, err := r.ReadBool(); v || err != nil {
+		t.Errorf("Expected false not %v (%v)", v, err)
+	}
+
+	if err := r.Align(); err != nil {
+		t.Error(err)
+	}
+
+	if v, err := r.ReadBits(8); v != 0xab || err != nil {
+		t.Errorf("Expected 0xab not %v (%v)", v, err)
+	}
+
+	if r.BitsRemaining() != 0 {
+		t.Errorf("Expected no remaining bits not %v", r.BitsRemaining())
+	}
+}
+
+func TestBitStreamErrors(t *testing.T) {
+	w := NewBitWriter()
+
+	if err := w.WriteInt(101, 0, 100); err != ErrValueOutOfRange {
+		t.Errorf("Expected out of range not %v", err)
+	}
+
+	if err := w.WriteFloat(math.NaN(), 0, 1, 0.1); err != ErrValueOutOfRange {
+		t.Errorf("Expected out of range not %v", err)
+	}
+
+	if err := w.WriteFloat(0.5, 0, 1, 0); err != ErrInvalidPrecision {
+		t.Errorf("Expected invalid precision not %v", err)
+	}
+
+	if err := w.WriteBits(1, 65); err != ErrInvalidBitCount {
+		t.Errorf("Expected invalid bit count not %v", err)
+	}
+
+	if w.BitsWritten() != 0 {
+		t.Errorf("Expected nothing written not %v bits", w.BitsWritten())
+	}
+
+	// 7 bits can hold 127 which is outside of 0 - 100
+	r := NewBitReader([]byte{0xff})
+	if _, err := r.ReadInt(0, 100); err != ErrValueOutOfRange {
+		t.Errorf("Expected out of range not %v", err)
+	}
+
+	if _, err := r.ReadBits(2); err != ErrSerializerUnderflow {
+		t.Errorf("Expected underflow not %v", err)
+	}
+
+	if v, err := r.ReadBool(); !v || err != nil {
+		t.Errorf("Expected last bit to be readable not %v (%v)", v, err)
+	}
+}
@@ -4,7 +4,11 @@
 
 package rmnp
 
-import "net"
+import (
+	"net"
+	"sync"
+	"time"
+)
 
 // Client is used to connect to a rmnp server
 type Client struct {
@@ -16,55 +20,220 @@ type Client struct {
 	// ServerConnect is called when a connection to the server was established.
 	ServerConnect ConnectionCallback
 
-	// ServerDisconnect is called when the server disconnected the client.
-	ServerDisconnect ConnectionCallback
+	// ServerDisconnect is called when the connection to the server was closed. The reason tells why.
+	ServerDisconnect DisconnectCallback
 
-	// ServerTimeout is called when the connection to the server timed out.
+	// ServerTimeout is called when the connection to the server timed out. Failed reconnect attempts do not
+	// invoke it again.
 	ServerTimeout ConnectionCallback
 
+	// ServerReconnect is called when the session was resumed after the connection to the server was lost.
+	// Server is the same Connection as before so its values and pending reliable packets are kept.
+	ServerReconnect ConnectionCallback
+
+	// ReconnectPolicy enables automatic reconnects after the connection to the server timed out (nil = disabled).
+	// If the server issued a session (see CfgSessionGraceWindow) it is resumed. Otherwise or if the session expired
+	// a new connection is established and ServerConnect is called again. ServerDisconnect is only called after all
+	// attempts failed.
+	ReconnectPolicy *ReconnectPolicy
+
 	// PacketHandler is called when packets arrive to handle the received data.
 	PacketHandler PacketCallback
+
+	// SnapshotHandler is called with every snapshot sent by the server using Connection.SendSnapshot that is newer
+	// than the previous one.
+	SnapshotHandler ConnectionCallback
+
+	// ServerOverflow is called when a packet is pushed into one of the server connection's full queues.
+	ServerOverflow OverflowCallback
+
+	// SendInterceptors see every message sent with one of the send methods of a connection before it is
+	// queued. ReceiveInterceptors see every received message before PacketHandler is called. Both have to be
+	// set before Start.
+	SendInterceptors    []InterceptorFunc
+	ReceiveInterceptors []InterceptorFunc
+
+	// IntroductionFailed is called if ConnectThroughIntroducer failed before the handshake with the host started.
+	IntroductionFailed ErrorCallback
+
+	connectData       []byte
+	reconnectMutex    sync.Mutex
+	reconnectAttempts int
+	reconnectAt       int64
+
+	// set by ClientOptions
+	localAddress string
+	ownSocket    *net.UDPConn
+
+	// set if the socket is not connected to the server (NAT punch-through or unconnected WithSocket)
+	unconnectedSocket bool
+	introductionMutex sync.Mutex
+	introduction      *introduction
+}
+
+// ReconnectPolicy defines how often and how fast a client tries to reconnect.
+type ReconnectPolicy struct {
+	// InitialBackoff is the time to wait before the first attempt.
+	InitialBackoff time.Duration
+
+	// MaxBackoff limits the time between two attempts (0 = no limit).
+	MaxBackoff time.Duration
+
+	// Multiplier is applied to the backoff after every failed attempt. Values less than 1 are treated as 1.
+	Multiplier float64
+
+	// MaxAttempts is the amount of attempts before giving up (0 = no limit).
+	MaxAttempts int
+}
+
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff)
+
+	for i := 0; i < attempt && p.Multiplier > 1; i++ {
+		backoff *= p.Multiplier
+
+		if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+
+	return time.Duration(backoff)
+}
+
+// ClientOption configures a Client in NewClient.
+type ClientOption func(*Client)
+
+// WithLocalAddress binds the client's socket to the local address (e.g. "192.168.0.2:7000" or ":7000")
+// instead of an ephemeral port on the default interface. The address is resolved when the socket is created.
+func WithLocalAddress(address string) ClientOption {
+	return func(c *Client) {
+		c.localAddress = address
+	}
+}
+
+// WithSocket makes the client use an already created socket. If it is connected it has to be connected to the
+// server. The client takes ownership of the socket and closes it on Disconnect.
+func WithSocket(socket *net.UDPConn) ClientOption {
+	return func(c *Client) {
+		c.ownSocket = socket
+	}
 }
 
 // NewClient creates and returns a new Client instance that will try to connect
 // to the given server address. It does not connect automatically.
-func NewClient(server string) *Client {
+func NewClient(server string, options ...ClientOption) *Client {
 	c := new(Client)
 
 	c.readFunc = func(conn *net.UDPConn, buffer []byte) (int, *net.UDPAddr, bool) {
+		if b := c.batch(conn); b != nil {
+			length, addr, next := b.read(buffer)
+			if !c.unconnectedSocket {
+				addr = conn.RemoteAddr().(*net.UDPAddr)
+			}
+
+			return length, addr, next
+		}
+
+		if c.unconnectedSocket {
+			length, addr, err := conn.ReadFromUDP(buffer)
+			return length, addr, err == nil
+		}
+
 		length, err := conn.Read(buffer)
 
 		if err != nil {
 			return 0, nil, false
 		}
 
-		return length, c.Server.Addr, true
+		return length, conn.RemoteAddr().(*net.UDPAddr), true
 	}
 
 	c.writeFunc = func(conn *net.UDPConn, addr *net.UDPAddr, buffer []byte) {
+		if c.unconnectedSocket {
+			if b := c.batch(conn); b != nil {
+				b.write(addr, buffer)
+			} else {
+				conn.WriteToUDP(buffer, addr)
+			}
+
+			return
+		}
+
+		if b := c.batch(conn); b != nil {
+			b.write(nil, buffer)
+			return
+		}
+
 		conn.Write(buffer)
 	}
 
 	c.onConnect = func(connection *Connection, packet []byte) {
+		c.resetReconnect()
+
 		if c.ServerConnect != nil {
 			c.ServerConnect(connection, packet)
 		}
 	}
 
-	c.onDisconnect = func(connection *Connection, packet []byte) {
+	c.onDisconnect = func(connection *Connection, reason DisconnectReason, packet []byte) {
 		if c.ServerDisconnect != nil {
-			c.ServerDisconnect(connection, packet)
+			c.ServerDisconnect(connection, reason, packet)
 		}
 
-		go c.destroy()
+		c.async(func() { c.destroy(DisconnectReasonLocalRequest) })
 	}
 
 	c.onTimeout = func(connection *Connection, packet []byte) {
-		if c.ServerTimeout != nil {
+		c.reconnectMutex.Lock()
+		reconnecting := c.reconnectAttempts > 0
+		c.reconnectMutex.Unlock()
+
+		if c.ServerTimeout != nil && !reconnecting {
 			c.ServerTimeout(connection, packet)
 		}
 	}
 
+	c.onReconnect = func(connection *Connection, packet []byte) {
+		c.resetReconnect()
+
+		if c.ServerReconnect != nil {
+			c.ServerReconnect(connection, packet)
+		}
+	}
+
+	c.onDetach = func(connection *Connection, reason DisconnectReason) (bool, int64) {
+		c.reconnectMutex.Lock()
+		defer c.reconnectMutex.Unlock()
+
+		policy := c.ReconnectPolicy
+		if policy == nil || (policy.MaxAttempts > 0 && c.reconnectAttempts >= policy.MaxAttempts) {
+			return false, 0
+		}
+
+		c.reconnectAt = c.currentTime() + int64(policy.backoff(c.reconnectAttempts)/time.Millisecond)
+		c.reconnectAttempts++
+
+		// the client decides itself when the connection is given up
+		return true, 0
+	}
+
+	c.onTick = func(currentTime int64) {
+		c.reconnectMutex.Lock()
+		due := c.reconnectAt != 0 && currentTime >= c.reconnectAt
+		if due {
+			c.reconnectAt = 0
+		}
+		c.reconnectMutex.Unlock()
+
+		if due {
+			c.reconnect()
+		}
+
+		c.introductionTick(currentTime)
+	}
+
+	c.onIntroduction = c.handleIntroduction
+
 	c.onValidation = func(addr *net.UDPAddr, packet []byte) bool {
 		return false
 	}
@@ -75,7 +244,32 @@ func NewClient(server string) *Client {
 		}
 	}
 
+	c.onSnapshot = func(connection *Connection, snapshot []byte) {
+		if c.SnapshotHandler != nil {
+			c.SnapshotHandler(connection, snapshot)
+		}
+	}
+
+	c.onOverflow = func(connection *Connection, queue Queue) {
+		if c.ServerOverflow != nil {
+			c.ServerOverflow(connection, queue)
+		}
+	}
+
+	c.sendInterceptors = func() []InterceptorFunc {
+		return c.SendInterceptors
+	}
+
+	c.receiveInterceptors = func() []InterceptorFunc {
+		return c.ReceiveInterceptors
+	}
+
 	c.init(server)
+
+	for _, option := range options {
+		option(c)
+	}
+
 	return c
 }
 
@@ -90,15 +284,80 @@ func (c *Client) Connect() {
 // ConnectWithData does the same as Connect but also sends custom data to the server that can
 // be validated in the ClientValidation callback or during the ClientConnect callback.
 func (c *Client) ConnectWithData(data []byte) {
-	c.setSocket(net.DialUDP("udp", nil, c.address))
+	c.setSocket(c.openSocket(true))
 	c.listen()
-	c.Server = c.connectClient(c.socket.RemoteAddr().(*net.UDPAddr), data)
-	c.Server.IsServer = true
+
+	if c.unconnectedSocket {
+		c.connect(c.address, data)
+	} else {
+		c.connect(c.socket.RemoteAddr().(*net.UDPAddr), data)
+	}
 }
 
-// Disconnect immediately disconnects from the server. It invokes no callbacks.
-// This call could take some time because it waits for goroutines to exit.
+// openSocket returns the socket passed with WithSocket or creates a new one that is bound to the address
+// passed with WithLocalAddress. New sockets are only connected to the server if connected is set.
+func (c *Client) openSocket(connected bool) (*net.UDPConn, error) {
+	if c.ownSocket != nil {
+		c.unconnectedSocket = c.ownSocket.RemoteAddr() == nil
+		return c.ownSocket, nil
+	}
+
+	var local *net.UDPAddr
+	if c.localAddress != "" {
+		addr, err := net.ResolveUDPAddr("udp", c.localAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		local = addr
+	}
+
+	c.unconnectedSocket = !connected
+
+	if connected {
+		return net.DialUDP("udp", local, c.address)
+	}
+
+	return net.ListenUDP("udp", local)
+}
+
+func (c *Client) connect(addr *net.UDPAddr, data []byte) {
+	c.connectData = data
+	c.Server = c.connectClient(c.socket, addr, data, true)
+}
+
+// reconnect resumes the detached connection to the server if it has a session. Otherwise it is replaced
+// by a new connection.
+func (c *Client) reconnect() {
+	old := c.Server
+	addr := old.Addr
+
+	if old.hasSession() && c.attach(old, c.socket, addr) {
+		payload := make([]byte, 0, sessionTicketSize+len(c.connectData))
+		payload = append(append(payload, old.ticket[:]...), c.connectData...)
+		old.sendHighLevelPacket(descReliable|descConnect|descSession, payload)
+		return
+	}
+
+	c.connect(addr, c.connectData)
+	c.releaseDetached(old, old.detachReason, false)
+}
+
+func (c *Client) resetReconnect() {
+	c.reconnectMutex.Lock()
+	defer c.reconnectMutex.Unlock()
+
+	c.reconnectAttempts = 0
+	c.reconnectAt = 0
+}
+
+// Disconnect immediately disconnects from the server. The server receives DisconnectReasonRemoteRequest.
+// It invokes no callbacks. This call could take some time because it waits for goroutines to exit.
 func (c *Client) Disconnect() {
-	c.destroy()
+	c.resetReconnect()
+	c.destroy(DisconnectReasonLocalRequest)
 	c.Server = nil
+
+	// the socket was closed
+	c.ownSocket = nil
 }
@@ -0,0 +1,67 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientOptions(t *testing.T) {
+	server := NewServer("127.0.0.1:0")
+
+	connected := make(chan *net.UDPAddr, 2)
+	server.ClientConnect = func(c *Connection, data []byte) {
+		connected <- c.Addr
+	}
+	server.Start()
+	defer server.Stop()
+
+	serverAddr := server.socket.LocalAddr().String()
+
+	// reserve a free port for the client
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localAddr := free.LocalAddr().(*net.UDPAddr)
+	free.Close()
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := []*Client{
+		NewClient(serverAddr, WithLocalAddress(localAddr.String())),
+		NewClient(serverAddr, WithSocket(socket)),
+	}
+
+	expected := []int{localAddr.Port, socket.LocalAddr().(*net.UDPAddr).Port}
+
+	for i, client := range clients {
+		client.Connect()
+		defer client.Disconnect()
+
+		select {
+		case addr := <-connected:
+			if addr.Port != expected[i] {
+				t.Errorf("Expected client %v to connect from port %v not %v", i, expected[i], addr.Port)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected client %v to connect", i)
+		}
+	}
+}
+
+func TestClientInvalidLocalAddress(t *testing.T) {
+	client := NewClient("127.0.0.1:10001", WithLocalAddress("127.0.0.1:invalid"))
+
+	if _, err := client.openSocket(true); err == nil {
+		t.Error("Expected the local address to fail when the socket is opened")
+	}
+}
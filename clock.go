@@ -0,0 +1,107 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by rmnp for timeouts, resends and congestion control.
+// It can be replaced by setting CfgClock (e.g. with a ManualClock to control time in tests).
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// Sleep pauses the current goroutine for at least the duration.
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// ManualClock is a Clock that only moves forward when Advance is called.
+type ManualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []manualClockWaiter
+}
+
+type manualClockWaiter struct {
+	until   time.Time
+	channel chan time.Time
+}
+
+// NewManualClock creates a new ManualClock starting at the given time.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the current time once the clock was advanced by at least d.
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	channel := make(chan time.Time, 1)
+
+	if d <= 0 {
+		channel <- c.now
+		return channel
+	}
+
+	c.waiters = append(c.waiters, manualClockWaiter{until: c.now.Add(d), channel: channel})
+	return channel
+}
+
+// Sleep blocks until the clock was advanced by at least d.
+func (c *ManualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Advance moves the clock forward and notifies all waiters whose time has come.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+
+	sort.SliceStable(c.waiters, func(i, j int) bool {
+		return c.waiters[i].until.Before(c.waiters[j].until)
+	})
+
+	n := 0
+	for _, w := range c.waiters {
+		if w.until.After(c.now) {
+			break
+		}
+
+		w.channel <- c.now
+		n++
+	}
+
+	c.waiters = c.waiters[n:]
+}
@@ -0,0 +1,42 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	c := NewManualClock(time.Unix(0, 0))
+
+	short := c.After(10 * time.Millisecond)
+	long := c.After(30 * time.Millisecond)
+
+	c.Advance(20 * time.Millisecond)
+
+	select {
+	case now := <-short:
+		if now != time.Unix(0, 0).Add(20*time.Millisecond) {
+			t.Errorf("Expected waiter to receive the current time not %v", now)
+		}
+	default:
+		t.Error("Expected short waiter to be notified")
+	}
+
+	select {
+	case <-long:
+		t.Error("Expected long waiter to still wait")
+	default:
+	}
+
+	c.Advance(10 * time.Millisecond)
+
+	select {
+	case <-long:
+	default:
+		t.Error("Expected long waiter to be notified")
+	}
+}
@@ -4,23 +4,56 @@
 
 package rmnp
 
-import "time"
+import (
+	"net"
+	"time"
+)
 
 var (
 	// CfgMTU is the maximum byte size of a packet (header included).
 	CfgMTU = 1024
 
 	// CfgProtocolID is the identification number send with every rmnp packet to filter out unwanted traffic.
-	CfgProtocolID byte = 231
+	// It is changed whenever the wire format changes so that incompatible versions ignore each other.
+	CfgProtocolID byte = 232
 
 	// CfgParallelListenerCount is the amount of goroutines that will be spawned to listen on incoming requests.
 	CfgParallelListenerCount = 4
 
+	// CfgSchedulerWorkerCount is the amount of goroutines that drive all connections. If it is 0 every connection
+	// spawns its own goroutines instead. Using a small fixed amount of workers (e.g. the number of cores) greatly
+	// reduces the memory and scheduling overhead for servers with many connections.
+	CfgSchedulerWorkerCount = 0
+
+	// CfgSocketCount is the amount of sockets a server binds to its port using SO_REUSEPORT (linux only). The kernel
+	// distributes incoming packets across them by flow hash. Every socket gets CfgParallelListenerCount listeners.
+	// Every socket stores its connections separately so that its listeners do not contend with the others.
+	CfgSocketCount = 1
+
+	// CfgSocketBatchSize is the max amount of datagrams that are read or written with a single syscall using
+	// recvmmsg/sendmmsg (linux only). Values less than 2 disable batching. Other platforms always use one
+	// syscall per datagram.
+	CfgSocketBatchSize = 0
+
 	// CfgMaxSendReceiveQueueSize is the max size of packets that can be queued up before they are processed.
 	CfgMaxSendReceiveQueueSize = 100
 
 	// CfgMaxPacketChainLength is the max length of packets that are chained when waiting for missing sequence.
 	CfgMaxPacketChainLength byte = 255
+
+	// CfgClock is the source of time used for all timeouts. It can be replaced to control time in tests.
+	CfgClock Clock = systemClock{}
+)
+
+var (
+	// CfgSendQueueOverflowPolicy defines what happens when a packet is sent while the send queue is full.
+	CfgSendQueueOverflowPolicy = OverflowDropOldestUnreliable
+
+	// CfgReceiveQueueOverflowPolicy defines what happens when a packet is received while the receive queue is full.
+	CfgReceiveQueueOverflowPolicy = OverflowDropOldestUnreliable
+
+	// CfgQueueBlockTimeout is the max time to wait for a full queue if OverflowBlock is used.
+	CfgQueueBlockTimeout int64 = 50
 )
 
 var (
@@ -51,6 +84,123 @@ var (
 
 	// CfgMaxPing is the max ping before a connection times out.
 	CfgMaxPing int16 = 150
+
+	// CfgSessionGraceWindow is the time in milliseconds a server keeps the session of a timed out client so that the
+	// client can resume it by reconnecting (see ReconnectPolicy). ClientDisconnect is delayed until the window passed.
+	// 0 disables sessions.
+	CfgSessionGraceWindow int64 = 0
+
+	// CfgSessionMigrationTimeout is the time nothing must have been received from the current address of a session
+	// before it can be resumed from another address (e.g. after NAT rebinding). Otherwise everybody who sniffed the
+	// ticket could take over active sessions.
+	CfgSessionMigrationTimeout int64 = 1000
+)
+
+var (
+	// CfgMaxConnections is the max amount of clients a server accepts at the same time (including sessions in
+	// their grace window). Further clients are rejected with DisconnectReasonServerFull. 0 means no limit.
+	CfgMaxConnections = 0
+
+	// CfgMaxConnectionsPerIP is the max amount of clients a server accepts from the same ip address or subnet
+	// (see CfgConnectionSubnetBitsIPv4/IPv6). Further clients are rejected with DisconnectReasonServerFull.
+	// 0 means no limit.
+	CfgMaxConnectionsPerIP = 0
+
+	// CfgConnectionSubnetBitsIPv4 is the prefix length used to group IPv4 addresses for CfgMaxConnectionsPerIP.
+	CfgConnectionSubnetBitsIPv4 = 32
+
+	// CfgConnectionSubnetBitsIPv6 is the prefix length used to group IPv6 addresses for CfgMaxConnectionsPerIP.
+	CfgConnectionSubnetBitsIPv6 = 64
+
+	// CfgMaxPendingHandshakes is the max amount of connection attempts that are processed at the same time.
+	// Further attempts are dropped without answer. Attempts are discarded after CfgTimeoutThreshold milliseconds.
+	// 0 means no limit.
+	CfgMaxPendingHandshakes = 1024
+)
+
+var (
+	// CfgMaxPacketsPerSecond is the max amount of packets a connection may send per second. Up to one second
+	// worth of packets can be received as burst. 0 means no limit.
+	CfgMaxPacketsPerSecond float64 = 0
+
+	// CfgMaxBytesPerSecond is the max amount of bytes (headers included) a connection may send per second.
+	// Up to one second worth of bytes can be received as burst. 0 means no limit.
+	CfgMaxBytesPerSecond float64 = 0
+
+	// CfgRateLimitAction defines what happens with packets that exceed CfgMaxPacketsPerSecond or CfgMaxBytesPerSecond.
+	CfgRateLimitAction = RateLimitDrop
+
+	// CfgMaxUnconnectedPacketsPerSecond is the max amount of packets per second that are processed from all
+	// addresses without connection together (e.g. connection attempts). Further packets are dropped before
+	// their checksum is calculated. 0 means no limit.
+	CfgMaxUnconnectedPacketsPerSecond float64 = 0
+
+	// CfgMaxUnconnectedBytesPerSecond is the same as CfgMaxUnconnectedPacketsPerSecond but for bytes.
+	CfgMaxUnconnectedBytesPerSecond float64 = 0
+
+	// CfgMaxQueryResponseSize is the max size in bytes (headers included) of a query response datagram.
+	CfgMaxQueryResponseSize = 512
+
+	// CfgQueryAmplificationFactor limits query responses to this multiple of the request size so that
+	// servers cannot be abused to amplify traffic towards spoofed addresses. Values less than 1 are treated as 1.
+	CfgQueryAmplificationFactor = 3
+)
+
+var (
+	// CfgDiscoveryPort is the port servers with a DiscoveryHandler listen on for discovery probes.
+	CfgDiscoveryPort = 47800
+
+	// CfgDiscoveryMulticastGroup is the IPv4 multicast group probes are sent to in addition to the broadcast address.
+	CfgDiscoveryMulticastGroup = net.IPv4(239, 255, 82, 77)
+
+	// CfgDiscoveryInterval is the interval in which Discover resends its probe.
+	CfgDiscoveryInterval int64 = 1000
+)
+
+var (
+	// CfgIntroducerKeepAlive is the interval in which hosts renew their registration at an introducer. It also
+	// keeps the NAT mapping of the host alive and should therefore be shorter than the NAT's timeout.
+	CfgIntroducerKeepAlive int64 = 10 * 1000
+
+	// CfgIntroducerRegistrationTimeout is the time after which an introducer forgets hosts that did not renew
+	// their registration.
+	CfgIntroducerRegistrationTimeout int64 = 30 * 1000
+
+	// CfgIntroducerMaxHosts is the max amount of hosts an introducer keeps. Further registrations are ignored until
+	// registrations expire.
+	CfgIntroducerMaxHosts = 10000
+)
+
+var (
+	// CfgRPCTimeout is the timeout of remote calls whose context has no deadline. 0 means no timeout.
+	CfgRPCTimeout = 10 * time.Second
+
+	// CfgMaxConcurrentRPCHandlers is the amount of handlers that may run at the same time for the requests of one
+	// connection. Further requests are answered with an RPCError until one of the handlers returned.
+	CfgMaxConcurrentRPCHandlers = 16
+
+	// CfgSnapshotHistorySize is the amount of sent and received snapshots every connection keeps as possible
+	// baselines for delta encoding. Snapshots are sent in full if the last acknowledged one is older.
+	// It has to be the same on both sides and should not exceed 33 (the range of the ack bitfield). It is rounded
+	// up to a power of two.
+	CfgSnapshotHistorySize = 32
+
+	// CfgRedundantMessageCount is the amount of messages (the new one included) every packet of
+	// ChannelUnreliableRedundant carries. A message is lost only if this many packets in a row are lost.
+	CfgRedundantMessageCount = 4
+
+	// CfgFECParityCount is the amount of parity packets per FEC group of new connections (0 disables FEC). See
+	// Connection.SetFEC.
+	CfgFECParityCount = 0
+
+	// CfgFECGroupSize is the initial amount of packets per FEC group. The group size adapts to the measured loss
+	// between CfgFECMinGroupSize and CfgFECMaxGroupSize (at most 127).
+	CfgFECGroupSize    = 8
+	CfgFECMinGroupSize = 2
+	CfgFECMaxGroupSize = 32
+
+	// CfgFECFlushTimeout is the time after which the parities of an incomplete FEC group are sent.
+	CfgFECFlushTimeout int64 = 20
 )
 
 var (
@@ -4,6 +4,8 @@
 
 package rmnp
 
+import "sync"
+
 type congestionMode uint8
 
 const (
@@ -12,7 +14,11 @@ const (
 	congestionModeBad
 )
 
+// congestionHandler is updated by received acks and read when sending, therefore all access is guarded by
+// its mutex.
 type congestionHandler struct {
+	mutex sync.Mutex
+
 	mode congestionMode
 	rtt  int64
 
@@ -33,14 +39,19 @@ func newCongestionHandler() *congestionHandler {
 }
 
 func (handler *congestionHandler) reset() {
-	handler.changeMode(congestionModeNone)
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	handler.changeMode(congestionModeNone, 0)
 	handler.rtt = 0
 	handler.requiredTime = CfgDefaultCongestionRequiredTime
 	handler.unreliableCount = 0
 }
 
-func (handler *congestionHandler) check(sendTime int64) {
-	time := currentTime()
+func (handler *congestionHandler) check(sendTime, time int64) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
 	rtt := time - sendTime
 
 	if handler.rtt == 0 {
@@ -51,14 +62,14 @@ func (handler *congestionHandler) check(sendTime int64) {
 
 	switch handler.mode {
 	case congestionModeNone:
-		handler.changeMode(congestionModeGood)
+		handler.changeMode(congestionModeGood, time)
 	case congestionModeGood:
 		if rtt > CfgCongestionThreshold {
 			if time-handler.lastChangeTime <= CfgBadRTTPunishTimeout {
 				handler.requiredTime = min(CfgMaxCongestionRequiredTime, handler.requiredTime*2)
 			}
 
-			handler.changeMode(congestionModeBad)
+			handler.changeMode(congestionModeBad, time)
 		} else if time-handler.lastChangeTime >= CfgGoodRTTRewardInterval {
 			handler.requiredTime = max(1, handler.requiredTime/2)
 			handler.lastChangeTime = time
@@ -69,12 +80,28 @@ func (handler *congestionHandler) check(sendTime int64) {
 		}
 
 		if time-handler.lastChangeTime >= handler.requiredTime {
-			handler.changeMode(congestionModeGood)
+			handler.changeMode(congestionModeGood, time)
 		}
 	}
 }
 
-func (handler *congestionHandler) changeMode(mode congestionMode) {
+// timeouts returns the current resend timeout, max amount of resent packets per update and reack timeout.
+func (handler *congestionHandler) timeouts() (resend, maxResends, reack int64) {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	return handler.ResendTimeout, handler.MaxPacketResends, handler.ReackTimeout
+}
+
+func (handler *congestionHandler) getRTT() int64 {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	return handler.rtt
+}
+
+// has to be called while holding the mutex
+func (handler *congestionHandler) changeMode(mode congestionMode, time int64) {
 	switch mode {
 	case congestionModeNone:
 		fallthrough
@@ -89,11 +116,14 @@ func (handler *congestionHandler) changeMode(mode congestionMode) {
 	}
 
 	handler.mode = mode
-	handler.lastChangeTime = currentTime()
+	handler.lastChangeTime = time
 }
 
 // for unreliable packets only
 func (handler *congestionHandler) shouldDropUnreliable() bool {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
 	switch handler.mode {
 	case congestionModeGood:
 		return false
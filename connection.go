@@ -6,12 +6,16 @@ package rmnp
 
 import (
 	"context"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ErrSendQueueFull is returned when a packet could not be queued because the send queue is full.
+var ErrSendQueueFull = errors.New("rmnp: send queue is full")
+
 type connectionState uint8
 
 const (
@@ -32,6 +36,9 @@ const (
 	ChannelReliable
 	// ChannelReliableOrdered guarantees packets to arrive in order (mimics TCP)
 	ChannelReliableOrdered
+	// ChannelUnreliableRedundant repeats the last messages in every packet so that they survive packet loss
+	// without resends. Messages arrive in order and exactly once.
+	ChannelUnreliableRedundant
 )
 
 // Connection is a udp connection and handles sending of packets
@@ -46,8 +53,8 @@ type Connection struct {
 	IsServer bool
 
 	// for go routines
-	ctx          context.Context
-	stopRoutines context.CancelFunc
+	ctx            context.Context
+	cancelRoutines context.CancelFunc
 
 	// for reliable packets
 	localSequence   sequenceNumber
@@ -62,19 +69,56 @@ type Connection struct {
 
 	lastAckSendTime    int64
 	lastResendTime     int64
-	lastReceivedTime   int64
-	lastChainTime      int64
+	lastReceivedTime   int64 // atomic, also read by listeners
+	lastChainTime      int64 // atomic, also written by the receiving side
+	lastKeepAliveTime  int64
 	pingPacketInterval uint8
 	sendBuffer         *sendBuffer
 	receiveBuffer      *sequenceBuffer
 	congestionHandler  *congestionHandler
 
-	sendQueue    *dropChannel //chan *packet
-	receiveQueue *dropChannel //chan []byte
-	waitGroup    sync.WaitGroup
+	sendQueue      *dropChannel //*packet
+	receiveQueue   *dropChannel //*[]byte
+	queueOverflows uint64
+	waitGroup      sync.WaitGroup
+
+	// user callbacks are collected while the scheduler processes the connection (see scheduler.go)
+	deferCallbacks bool
+	callbacks      []func()
 
 	values      map[byte]interface{}
 	valuesMutex sync.RWMutex
+
+	// slot of the server's admission control
+	admissionKey string
+	rateLimiter  rateLimiter
+
+	// for session resumption
+	ticket         sessionTicket
+	detachReason   DisconnectReason
+	detachDeadline int64
+
+	// pending remote calls (see rpc.go)
+	rpcMutex      sync.Mutex
+	rpcCalls      map[uint32]*rpcCall
+	rpcNextID     uint32
+	rpcGeneration uint32
+	rpcHandlers   int32 // atomic, running request handlers
+
+	// delta compressed snapshots (see snapshot.go)
+	snapshotMutex    sync.Mutex
+	snapshotSender   snapshotSender
+	snapshotReceiver snapshotReceiver
+
+	// for ChannelUnreliableRedundant (see redundant.go)
+	redundantMutex    sync.Mutex
+	redundantSender   redundantSender
+	redundantReceiver redundantReceiver
+
+	// forward error correction (see fec.go)
+	fecMutex    sync.Mutex
+	fecSender   fecSender
+	fecReceiver fecReceiver
 }
 
 func newConnection() *Connection {
@@ -84,68 +128,100 @@ func newConnection() *Connection {
 		sendBuffer:        newSendBuffer(),
 		receiveBuffer:     newSequenceBuffer(CfgSequenceBufferSize),
 		congestionHandler: newCongestionHandler(),
-		sendQueue:         newDropChannel(make(chan interface{}, CfgMaxSendReceiveQueueSize)),
-		receiveQueue:      newDropChannel(make(chan interface{}, CfgMaxSendReceiveQueueSize)),
+		sendQueue:         newDropChannel(CfgMaxSendReceiveQueueSize, isUnreliablePacket),
+		receiveQueue:      newDropChannel(CfgMaxSendReceiveQueueSize, isUnreliableBuffer),
 		values:            make(map[byte]interface{}),
 	}
 }
 
-func (c *Connection) init(impl *protocolImpl, addr *net.UDPAddr) {
+func (c *Connection) init(impl *protocolImpl, socket *net.UDPConn, addr *net.UDPAddr) {
 	c.protocol = impl
-	c.Conn = impl.socket
+	c.Conn = socket
 	c.Addr = addr
 	c.state = stateConnecting
 
-	t := currentTime()
+	t := impl.currentTime()
 	c.lastAckSendTime = t
 	c.lastResendTime = t
-	c.lastReceivedTime = t
-}
+	atomic.StoreInt64(&c.lastReceivedTime, t)
+	c.lastKeepAliveTime = t
 
-func (c *Connection) reset() {
-	c.protocol = nil
-	c.state = stateDisconnected
+	c.sendQueue.policy = CfgSendQueueOverflowPolicy
+	c.receiveQueue.policy = CfgReceiveQueueOverflowPolicy
+	c.sendQueue.clock = impl.getClock()
+	c.receiveQueue.clock = impl.getClock()
 
-	c.Conn = nil
-	c.Addr = nil
-	c.IsServer = false
+	c.fecSender = newFECSender(CfgFECParityCount, 0)
+}
 
-	c.orderedChain.reset()
+// discard drops all queued and unacked packets of a released connection.
+func (c *Connection) discard() {
+	c.sendQueue.clear()
+	c.receiveQueue.clear()
 	c.sendBuffer.reset()
-	c.receiveBuffer.reset()
-	c.congestionHandler.reset()
-
-	c.localSequence = 0
-	c.remoteSequence = 0
-	c.ackBits = 0
-	c.orderedSequence = 0
+}
 
-	c.localUnreliableSequence = 0
-	c.remoteUnreliableSequence = 0
+// resume prepares a detached connection to be processed again. Sequence numbers, received packets and
+// pending reliable packets are kept so that the other side can continue where it stopped. The pending packets
+// were in flight when the connection was detached and get the full CfgSendRemoveTimeout again.
+func (c *Connection) resume(socket *net.UDPConn, addr *net.UDPAddr) {
+	c.Conn = socket
+	c.Addr = addr
+	c.setState(stateConnecting)
 
-	c.lastAckSendTime = 0
-	c.lastResendTime = 0
-	c.lastReceivedTime = 0
-	c.lastChainTime = 0
-	c.pingPacketInterval = 0
+	t := c.protocol.currentTime()
+	c.lastAckSendTime = t
+	c.lastResendTime = t
+	atomic.StoreInt64(&c.lastReceivedTime, t)
+	atomic.StoreInt64(&c.lastChainTime, t)
+	c.lastKeepAliveTime = t
 
-	c.sendQueue.clear()
-	c.receiveQueue.clear()
+	c.congestionHandler.reset()
+	c.sendBuffer.restart(t)
+	c.sendBuffer.removeAll(isConnectPacket)
+	c.sendQueue.removeAll(isQueuedConnectPacket)
+}
 
-	c.values = make(map[byte]interface{})
+func (c *Connection) hasSession() bool {
+	return c.ticket != sessionTicket{}
 }
 
 func (c *Connection) startRoutines() {
-	c.ctx, c.stopRoutines = context.WithCancel(context.Background())
+	if c.protocol.scheduler != nil {
+		c.protocol.scheduler.add(c)
+		return
+	}
+
+	c.ctx, c.cancelRoutines = context.WithCancel(context.Background())
+	c.waitGroup.Add(3)
 	go c.sendUpdate()
 	go c.receiveUpdate()
 	go c.keepAlive()
 }
 
-func (c *Connection) sendUpdate() {
-	defer antiPanic(c.sendUpdate)
+// is blocking call! returns once the connection is no longer processed by any goroutine.
+func (c *Connection) stopRoutines() {
+	if c.protocol.scheduler != nil {
+		c.protocol.scheduler.remove(c)
+		return
+	}
 
-	c.waitGroup.Add(1)
+	c.cancelRoutines()
+	c.waitGroup.Wait()
+}
+
+// wake notifies the scheduler (if used) that new packets were queued for this connection.
+func (c *Connection) wake() {
+	if c.protocol != nil && c.protocol.scheduler != nil {
+		c.protocol.scheduler.wake(c)
+	}
+}
+
+func (c *Connection) sendUpdate() {
+	defer antiPanic(func() {
+		c.waitGroup.Add(1)
+		c.sendUpdate()
+	})
 	defer c.waitGroup.Done()
 
 	atomic.AddUint64(&StatRunningGoRoutines, 1)
@@ -153,58 +229,30 @@ func (c *Connection) sendUpdate() {
 
 	for {
 		select {
-		case <-time.After(CfgUpdateLoopTimeout * time.Millisecond):
+		case <-c.protocol.getClock().After(CfgUpdateLoopTimeout * time.Millisecond):
 		case <-c.ctx.Done():
 			return
-		case p := <-c.sendQueue.channel:
-			c.processSend(p.(*packet), false)
-		}
-
-		currentTime := currentTime()
-
-		if currentTime-c.lastResendTime > c.congestionHandler.ResendTimeout {
-			c.lastResendTime = currentTime
-
-			c.sendBuffer.iterate(func(i int, data *sendPacket) sendBufferOP {
-				if int64(i) >= c.congestionHandler.MaxPacketResends {
-					return sendBufferCancel
-				}
-
-				if currentTime-data.sendTime > CfgSendRemoveTimeout {
-					return sendBufferDelete
-				}
-
-				c.processSend(data.packet, true)
-				return sendBufferContinue
-			})
+		case <-c.sendQueue.signal:
 		}
 
-		if c.getState() != stateConnected {
-			continue
-		}
+		// the datagrams of one pass are written together
+		batch := c.protocol.batch(c.Conn)
+		batch.hold()
 
-		if currentTime-c.lastChainTime > CfgChainSkipTimeout {
-			c.orderedChain.skip()
-			c.handleNextChainSequence()
+		for p, ok := c.sendQueue.pop(); ok; p, ok = c.sendQueue.pop() {
+			c.processSend(p.(*packet), false)
 		}
 
-		if currentTime-c.lastAckSendTime > c.congestionHandler.ReackTimeout {
-			c.sendAckPacket()
-
-			if c.pingPacketInterval%CfgAutoPingInterval == 0 {
-				c.sendLowLevelPacket(descReliable | descAck)
-				c.pingPacketInterval = 0
-			}
-
-			c.pingPacketInterval++
-		}
+		c.update(c.protocol.currentTime())
+		batch.release()
 	}
 }
 
 func (c *Connection) receiveUpdate() {
-	defer antiPanic(c.receiveUpdate)
-
-	c.waitGroup.Add(1)
+	defer antiPanic(func() {
+		c.waitGroup.Add(1)
+		c.receiveUpdate()
+	})
 	defer c.waitGroup.Done()
 
 	atomic.AddUint64(&StatRunningGoRoutines, 1)
@@ -214,16 +262,24 @@ func (c *Connection) receiveUpdate() {
 		select {
 		case <-c.ctx.Done():
 			return
-		case p := <-c.receiveQueue.channel:
-			c.processReceive(p.([]byte))
+		case <-c.receiveQueue.signal:
+			batch := c.protocol.batch(c.Conn)
+			batch.hold()
+
+			for p, ok := c.receiveQueue.pop(); ok; p, ok = c.receiveQueue.pop() {
+				c.processBuffer(p.(*[]byte))
+			}
+
+			batch.release()
 		}
 	}
 }
 
 func (c *Connection) keepAlive() {
-	defer antiPanic(c.keepAlive)
-
-	c.waitGroup.Add(1)
+	defer antiPanic(func() {
+		c.waitGroup.Add(1)
+		c.keepAlive()
+	})
 	defer c.waitGroup.Done()
 
 	atomic.AddUint64(&StatRunningGoRoutines, 1)
@@ -233,32 +289,150 @@ func (c *Connection) keepAlive() {
 		select {
 		case <-c.ctx.Done():
 			return
-		case <-time.After((CfgTimeoutThreshold / 2) * time.Millisecond):
+		case <-c.protocol.getClock().After((CfgTimeoutThreshold / 2) * time.Millisecond):
+		}
+
+		c.checkTimeout(c.protocol.currentTime())
+	}
+}
+
+// update resends unacked packets, skips stuck chains and sends acks/pings if necessary.
+func (c *Connection) update(currentTime int64) {
+	resendTimeout, maxPacketResends, reackTimeout := c.congestionHandler.timeouts()
+
+	if currentTime-c.lastResendTime > resendTimeout {
+		c.lastResendTime = currentTime
+
+		c.sendBuffer.iterate(func(i int, data *sendPacket) sendBufferOP {
+			if int64(i) >= maxPacketResends {
+				return sendBufferCancel
+			}
+
+			if currentTime-data.sendTime > CfgSendRemoveTimeout {
+				return sendBufferDelete
+			}
+
+			c.processSend(data.packet, true)
+			return sendBufferContinue
+		})
+	}
+
+	c.updateFEC(currentTime)
+
+	if c.getState() != stateConnected {
+		return
+	}
+
+	if currentTime-atomic.LoadInt64(&c.lastChainTime) > CfgChainSkipTimeout {
+		c.orderedChain.skip()
+		c.handleNextChainSequence()
+	}
+
+	if currentTime-c.lastAckSendTime > reackTimeout {
+		c.sendAckPacket()
+
+		if c.pingPacketInterval%CfgAutoPingInterval == 0 {
+			c.sendControlPacket(&packet{descriptor: descReliable | descAck})
+			c.pingPacketInterval = 0
 		}
 
-		if c.getState() == stateDisconnected {
-			continue
+		c.pingPacketInterval++
+	}
+}
+
+// nextUpdate returns the time at which update or checkTimeout have work to do next.
+func (c *Connection) nextUpdate() int64 {
+	resendTimeout, _, reackTimeout := c.congestionHandler.timeouts()
+	next := min(c.lastKeepAliveTime+int64(CfgTimeoutThreshold/2), c.lastResendTime+resendTimeout+1)
+
+	c.fecMutex.Lock()
+	if c.fecSender.count > 0 {
+		next = min(next, c.fecSender.started+CfgFECFlushTimeout)
+	}
+	c.fecMutex.Unlock()
+
+	if c.getState() == stateConnected {
+		next = min(next, atomic.LoadInt64(&c.lastChainTime)+CfgChainSkipTimeout+1)
+		next = min(next, c.lastAckSendTime+reackTimeout+1)
+	}
+
+	return next
+}
+
+// dispatch invokes a user callback. While the scheduler processes the connection the callback is run
+// afterwards so that it does not block the worker.
+func (c *Connection) dispatch(callback func()) {
+	if c.deferCallbacks {
+		c.callbacks = append(c.callbacks, callback)
+		return
+	}
+
+	callback()
+}
+
+// checkTimeout disconnects the connection if nothing was received for too long or the ping is too high.
+func (c *Connection) checkTimeout(currentTime int64) {
+	c.lastKeepAliveTime = currentTime
+
+	if c.getState() == stateDisconnected {
+		return
+	}
+
+	reason := DisconnectReasonTimeout
+
+	if currentTime-atomic.LoadInt64(&c.lastReceivedTime) <= int64(CfgTimeoutThreshold) {
+		if c.GetPing() <= CfgMaxPing {
+			return
 		}
 
-		currentTime := currentTime()
+		reason = DisconnectReasonPingTooHigh
+	}
+
+	// needs to be executed in goroutine; otherwise this method could not exit and therefore deadlock
+	// the connection's waitGroup
+	protocol := c.protocol
+	protocol.async(func() {
+		protocol.loseConnection(c, reason)
+	})
+}
 
-		if currentTime-c.lastReceivedTime > int64(CfgTimeoutThreshold) || c.GetPing() > CfgMaxPing {
-			// needs to be executed in goroutine; otherwise this method could not exit and therefore deadlock
-			// the connection's waitGroup
-			go func() {
-				defer antiPanic(nil)
-				c.protocol.disconnectClient(c, disconnectTypeTimeout, nil)
-			}()
+// drain waits until all queued and unacknowledged reliable packets were delivered. It returns false
+// if the context is done before.
+func (c *Connection) drain(ctx context.Context) bool {
+	// connect packets are never acked and just resent until they expire
+	isData := func(p *packet) bool {
+		return !p.flag(descConnect)
+	}
+
+	for c.sendQueue.len() > 0 || c.sendBuffer.any(isData) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-c.protocol.getClock().After(CfgUpdateLoopTimeout * time.Millisecond):
 		}
 	}
+
+	return true
 }
 
+// processBuffer processes a queued datagram and returns its buffer to the pool.
+func (c *Connection) processBuffer(buffer *[]byte) {
+	c.processReceive(*buffer)
+	c.protocol.releaseBuffer(buffer)
+}
+
+// processReceive processes a datagram. The datagram is only valid during the call, everything that is kept
+// or delivered later has to be copied.
 func (c *Connection) processReceive(buffer []byte) {
-	c.lastReceivedTime = currentTime()
+	atomic.StoreInt64(&c.lastReceivedTime, c.protocol.currentTime())
 
 	p := new(packet)
 
 	if !p.deserialize(buffer) {
+		protocol := c.protocol
+		protocol.async(func() {
+			protocol.disconnectClient(c, DisconnectReasonProtocolError, nil)
+		})
 		return
 	}
 
@@ -266,6 +440,11 @@ func (c *Connection) processReceive(buffer []byte) {
 		return
 	}
 
+	// system packets are handled right away and copy what they keep themselves
+	if len(p.data) > 0 && !p.flag(descSystem) {
+		p.data = append([]byte(nil), p.data...)
+	}
+
 	if p.flag(descAck) && !c.handleAckPacket(p) {
 		return
 	}
@@ -294,7 +473,9 @@ func (c *Connection) processReceive(buffer []byte) {
 }
 
 func (c *Connection) handleReliablePacket(packet *packet) bool {
+	// the ack of a duplicate got lost, otherwise the other side would not have resent it
 	if c.receiveBuffer.get(packet.sequence) {
+		c.sendAckPacket()
 		return false
 	}
 
@@ -304,13 +485,7 @@ func (c *Connection) handleReliablePacket(packet *packet) bool {
 		c.remoteSequence = packet.sequence
 	}
 
-	c.ackBits = 0
-	for i := sequenceNumber(1); i <= 32; i++ {
-		if c.receiveBuffer.get(c.remoteSequence - i) {
-			c.ackBits |= 1 << (i - 1)
-		}
-	}
-
+	c.ackBits = buildAckBits(c.remoteSequence, c.receiveBuffer.get)
 	c.sendAckPacket()
 
 	return true
@@ -331,29 +506,30 @@ func (c *Connection) handleOrderedPacket(packet *packet) bool {
 }
 
 func (c *Connection) handleAckPacket(packet *packet) bool {
-	for i := sequenceNumber(0); i <= 32; i++ {
-		if i == 0 || packet.ackBits&(1<<(i-1)) != 0 {
-			s := packet.ack - i
-
-			if packet, found := c.sendBuffer.retrieve(s); found {
-				if !packet.noRTT {
-					c.congestionHandler.check(packet.sendTime)
-				}
+	forEachAck(packet.ack, packet.ackBits, func(s sequenceNumber) {
+		if packet, found := c.sendBuffer.retrieve(s); found {
+			if !packet.noRTT {
+				c.congestionHandler.check(packet.sendTime, c.protocol.currentTime())
 			}
 		}
-	}
+	})
 
 	return true
 }
 
 func (c *Connection) process(packet *packet, channel Channel) {
+	if packet.flag(descSystem) {
+		c.handleSystemPacket(packet.data)
+		return
+	}
+
 	if packet.data != nil && len(packet.data) > 0 {
-		invokePacketCallback(c.protocol.onPacket, c, packet.data, channel)
+		c.receiveMessage(channel, packet.data)
 	}
 }
 
 func (c *Connection) handleNextChainSequence() {
-	c.lastChainTime = currentTime()
+	atomic.StoreInt64(&c.lastChainTime, c.protocol.currentTime())
 
 	for l := c.orderedChain.popConsecutive(); l != nil; l = l.next {
 		c.process(l.packet, ChannelReliableOrdered)
@@ -377,7 +553,7 @@ func (c *Connection) processSend(packet *packet, resend bool) {
 				c.orderedSequence++
 			}
 
-			c.sendBuffer.add(packet, c.getState() != stateConnected)
+			c.sendBuffer.add(packet, c.getState() != stateConnected, c.protocol.currentTime())
 		} else if packet.flag(descOrdered) {
 			packet.sequence = c.localUnreliableSequence
 			c.localUnreliableSequence++
@@ -385,31 +561,108 @@ func (c *Connection) processSend(packet *packet, resend bool) {
 	}
 
 	if packet.flag(descAck) {
-		c.lastAckSendTime = currentTime()
+		c.lastAckSendTime = c.protocol.currentTime()
 		packet.ack = c.remoteSequence
 		packet.ackBits = c.ackBits
 	}
 
-	packet.calculateHash()
-	buffer := packet.serialize()
-	c.protocol.writeFunc(c.Conn, c.Addr, buffer)
-	atomic.AddUint64(&StatSendBytes, uint64(len(buffer)))
+	c.writePacket(packet, true)
+}
+
+// writePacket serializes the packet and writes it to the socket. If protect is set and FEC is enabled the
+// packet is sent as part of a FEC group instead (see fec.go).
+func (c *Connection) writePacket(packet *packet, protect bool) {
+	buffer := c.protocol.bufferPool.Get().(*[]byte)
+	defer c.protocol.bufferPool.Put(buffer)
+
+	data := *buffer
+	if size := packet.size(); size > len(data) {
+		data = make([]byte, size)
+	}
+
+	length := packet.serializeTo(data)
+	packet.crc32 = writeHash(data[:length])
+
+	if protect && c.protectDatagram(packet, data[:length]) {
+		return
+	}
+
+	c.protocol.writeFunc(c.Conn, c.Addr, data[:length])
+	atomic.AddUint64(&StatSendBytes, uint64(length))
+}
+
+func (c *Connection) sendPacket(packet *packet) error {
+	overflow, err := c.sendQueue.push(packet)
+
+	if overflow {
+		c.handleOverflow(QueueSend, c.sendQueue.policy)
+	}
+
+	c.wake()
+
+	if err != nil {
+		return ErrSendQueueFull
+	}
+
+	return nil
+}
+
+func (c *Connection) receivePacket(buffer *[]byte) {
+	if overflow, _ := c.receiveQueue.push(buffer); overflow {
+		c.handleOverflow(QueueReceive, c.receiveQueue.policy)
+	}
+
+	c.wake()
 }
 
-func (c *Connection) sendPacket(packet *packet) {
-	c.sendQueue.push(packet)
+func (c *Connection) handleOverflow(queue Queue, policy OverflowPolicy) {
+	atomic.AddUint64(&c.queueOverflows, 1)
+	atomic.AddUint64(&StatQueueOverflows, 1)
+
+	protocol := c.protocol
+	if protocol == nil {
+		return
+	}
+
+	invokeOverflowCallback(protocol.onOverflow, c, queue)
+
+	if policy == OverflowDisconnect {
+		protocol.async(func() {
+			protocol.disconnectClient(c, DisconnectReasonQueueOverflow, nil)
+		})
+	}
 }
 
-func (c *Connection) sendLowLevelPacket(descriptor descriptor) {
-	c.sendPacket(&packet{descriptor: descriptor})
+func (c *Connection) sendLowLevelPacket(descriptor descriptor) error {
+	return c.sendPacket(&packet{descriptor: descriptor})
 }
 
-func (c *Connection) sendHighLevelPacket(descriptor descriptor, data []byte) {
-	c.sendPacket(&packet{descriptor: descriptor, data: data})
+func (c *Connection) sendHighLevelPacket(descriptor descriptor, data []byte) error {
+	return c.sendPacket(&packet{descriptor: descriptor, data: data})
 }
 
 func (c *Connection) sendAckPacket() {
-	c.sendLowLevelPacket(descAck)
+	c.sendControlPacket(&packet{descriptor: descAck})
+}
+
+// sendControlPacket queues an internal packet like an ack or ping. They are sent while the connection is
+// processed which is the only consumer of the send queue and therefore bypass the overflow policy instead of
+// blocking. If the queue is full of reliable packets the control packet is dropped, it is repeated anyway.
+func (c *Connection) sendControlPacket(packet *packet) {
+	if !c.sendQueue.tryPush(packet) {
+		atomic.AddUint64(&c.queueOverflows, 1)
+		atomic.AddUint64(&StatQueueOverflows, 1)
+	}
+
+	c.wake()
+}
+
+func isUnreliablePacket(i interface{}) bool {
+	return !i.(*packet).flag(descReliable)
+}
+
+func isUnreliableBuffer(i interface{}) bool {
+	return descriptor((*i.(*[]byte))[5])&descReliable == 0
 }
 
 func (c *Connection) getState() connectionState {
@@ -438,54 +691,69 @@ func (c *Connection) updateState(state connectionState) bool {
 
 // SendUnreliable sends the data with no guarantee whether it arrives or not.
 // Note that the packets or not guaranteed to arrive in order.
-func (c *Connection) SendUnreliable(data []byte) {
-	c.sendHighLevelPacket(0, data)
+// It returns ErrSendQueueFull if the packet could not be queued (see CfgSendQueueOverflowPolicy).
+func (c *Connection) SendUnreliable(data []byte) error {
+	return c.sendMessage(ChannelUnreliable, data)
 }
 
 // SendUnreliableOrdered is the same as SendUnreliable but guarantees that if packets
 // do not arrive chronologically the receiver only accepts newer packets and discards older
 // ones.
-func (c *Connection) SendUnreliableOrdered(data []byte) {
-	c.sendHighLevelPacket(descOrdered, data)
+func (c *Connection) SendUnreliableOrdered(data []byte) error {
+	return c.sendMessage(ChannelUnreliableOrdered, data)
 }
 
 // SendReliable send the data and guarantees that the data arrives.
 // Note that packets are not guaranteed to arrive in the order they were sent.
 // This method is not 100% reliable. (Read more in README)
-func (c *Connection) SendReliable(data []byte) {
-	c.sendHighLevelPacket(descReliable|descAck, data)
+func (c *Connection) SendReliable(data []byte) error {
+	return c.sendMessage(ChannelReliable, data)
 }
 
 // SendReliableOrdered is the same as SendReliable but guarantees that packets
 // will be processed in order.
 // This method is not 100% reliable. (Read more in README)
-func (c *Connection) SendReliableOrdered(data []byte) {
-	c.sendHighLevelPacket(descReliable|descAck|descOrdered, data)
+func (c *Connection) SendReliableOrdered(data []byte) error {
+	return c.sendMessage(ChannelReliableOrdered, data)
 }
 
 // SendOnChannel sends the data on the given channel using the dedicated send method
 // for each channel
-func (c *Connection) SendOnChannel(channel Channel, data []byte) {
+func (c *Connection) SendOnChannel(channel Channel, data []byte) error {
 	switch channel {
 	case ChannelUnreliable:
-		c.SendUnreliable(data)
+		return c.SendUnreliable(data)
 	case ChannelUnreliableOrdered:
-		c.SendUnreliableOrdered(data)
+		return c.SendUnreliableOrdered(data)
 	case ChannelReliable:
-		c.SendReliable(data)
+		return c.SendReliable(data)
 	case ChannelReliableOrdered:
-		c.SendReliableOrdered(data)
+		return c.SendReliableOrdered(data)
+	case ChannelUnreliableRedundant:
+		return c.SendUnreliableRedundant(data)
 	}
+
+	return ErrUnknownChannel
+}
+
+// QueueOverflows returns how often one of the connection's queues was full when a packet was pushed.
+// It is thread safe.
+func (c *Connection) QueueOverflows() uint64 {
+	return atomic.LoadUint64(&c.queueOverflows)
 }
 
 // GetPing returns the current ping to this connection's socket
 func (c *Connection) GetPing() int16 {
-	return int16(c.congestionHandler.rtt / 2)
+	return int16(c.congestionHandler.getRTT() / 2)
 }
 
-// Disconnect disconnects the connection
+// Disconnect disconnects the connection. The other side receives the packet together
+// with DisconnectReasonRemoteRequest.
 func (c *Connection) Disconnect(packet []byte) {
-	go c.protocol.disconnectClient(c, disconnectTypeDefault, packet)
+	protocol := c.protocol
+	protocol.async(func() {
+		protocol.disconnectClient(c, DisconnectReasonLocalRequest, packet)
+	})
 }
 
 // Set stores a value associated with the given key in this connection instance.
@@ -0,0 +1,152 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// connectionMap stores connections by their socket and address hash. Every socket
+// has its own shards so that the listeners of different sockets never contend on the
+// same mutex, the connections of a socket are split across multiple shards by hash.
+// Sockets are added on first use, lookups of a socket's shards are lock-free.
+type connectionMap struct {
+	// map[*net.UDPConn][]*connectionShard, replaced as a whole when a socket is added
+	sockets      atomic.Value
+	socketsMutex sync.Mutex
+	shardCount   int
+}
+
+type connectionShard struct {
+	mutex       sync.RWMutex
+	connections map[uint32]*Connection
+}
+
+func newConnectionMap(shardCount int) *connectionMap {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	m := &connectionMap{shardCount: shardCount}
+	m.sockets.Store(make(map[*net.UDPConn][]*connectionShard))
+	return m
+}
+
+func (m *connectionMap) loadSockets() map[*net.UDPConn][]*connectionShard {
+	return m.sockets.Load().(map[*net.UDPConn][]*connectionShard)
+}
+
+// shard returns the shard of the socket the hash belongs to. If create is false it may return nil.
+func (m *connectionMap) shard(socket *net.UDPConn, hash uint32, create bool) *connectionShard {
+	shards, f := m.loadSockets()[socket]
+	if !f && create {
+		shards = m.addSocket(socket)
+	}
+
+	if shards == nil {
+		return nil
+	}
+
+	return shards[hash%uint32(len(shards))]
+}
+
+func (m *connectionMap) addSocket(socket *net.UDPConn) []*connectionShard {
+	m.socketsMutex.Lock()
+	defer m.socketsMutex.Unlock()
+
+	sockets := m.loadSockets()
+	if shards, f := sockets[socket]; f {
+		return shards
+	}
+
+	shards := make([]*connectionShard, m.shardCount)
+	for i := range shards {
+		shards[i] = &connectionShard{connections: make(map[uint32]*Connection)}
+	}
+
+	copied := make(map[*net.UDPConn][]*connectionShard, len(sockets)+1)
+	for s, c := range sockets {
+		copied[s] = c
+	}
+	copied[socket] = shards
+
+	m.sockets.Store(copied)
+	return shards
+}
+
+func (m *connectionMap) get(socket *net.UDPConn, hash uint32) (*Connection, bool) {
+	shard := m.shard(socket, hash, false)
+	if shard == nil {
+		return nil, false
+	}
+
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	c, f := shard.connections[hash]
+	return c, f
+}
+
+func (m *connectionMap) set(socket *net.UDPConn, hash uint32, connection *Connection) {
+	shard := m.shard(socket, hash, true)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.connections[hash] = connection
+}
+
+// remove deletes the connection if it is still stored under its socket and address.
+func (m *connectionMap) remove(connection *Connection) {
+	if connection.Addr == nil {
+		return
+	}
+
+	hash := addrHash(connection.Addr)
+	shard := m.shard(connection.Conn, hash, false)
+	if shard == nil {
+		return
+	}
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if shard.connections[hash] == connection {
+		delete(shard.connections, hash)
+	}
+}
+
+func (m *connectionMap) len() int {
+	size := 0
+
+	for _, shards := range m.loadSockets() {
+		for _, shard := range shards {
+			shard.mutex.RLock()
+			size += len(shard.connections)
+			shard.mutex.RUnlock()
+		}
+	}
+
+	return size
+}
+
+// each calls the iterator for a snapshot of all stored connections. The shards
+// are not locked while the iterator runs so it is allowed to modify the map.
+func (m *connectionMap) each(iterator func(*Connection)) {
+	var connections []*Connection
+
+	for _, shards := range m.loadSockets() {
+		for _, shard := range shards {
+			shard.mutex.RLock()
+			for _, c := range shard.connections {
+				connections = append(connections, c)
+			}
+			shard.mutex.RUnlock()
+		}
+	}
+
+	for _, c := range connections {
+		iterator(c)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnectionMapSocketShards(t *testing.T) {
+	m := newConnectionMap(4)
+	a, b := new(net.UDPConn), new(net.UDPConn)
+	c := newConnection()
+	c.Conn, c.Addr = a, testAddr(1)
+	hash := addrHash(c.Addr)
+
+	m.set(a, hash, c)
+
+	if found, f := m.get(a, hash); !f || found != c {
+		t.Error("Expected connection to be found in the shard of its socket")
+	}
+
+	if _, f := m.get(b, hash); f {
+		t.Error("Expected connection to not be found in the shard of another socket")
+	}
+
+	m.set(b, hash, newConnection())
+	m.remove(c)
+
+	if n := m.len(); n != 1 {
+		t.Errorf("Expected 1 connection not %v", n)
+	}
+}
+
+func TestConnectionMapHashShards(t *testing.T) {
+	m := newConnectionMap(4)
+	socket := new(net.UDPConn)
+
+	for i := 0; i < 64; i++ {
+		c := newConnection()
+		c.Conn, c.Addr = socket, testAddr(i)
+		m.set(socket, addrHash(c.Addr), c)
+	}
+
+	shards := m.loadSockets()[socket]
+	if len(shards) != 4 {
+		t.Fatalf("Expected 4 shards for the socket not %v", len(shards))
+	}
+
+	for i, shard := range shards {
+		if len(shard.connections) == 0 {
+			t.Errorf("Expected shard %v to hold connections", i)
+		}
+	}
+
+	if n := m.len(); n != 64 {
+		t.Errorf("Expected 64 connections not %v", n)
+	}
+
+	for i := 0; i < 64; i++ {
+		if c, f := m.get(socket, addrHash(testAddr(i))); !f || c.Addr.Port != testAddr(i).Port {
+			t.Errorf("Expected connection %v to be found", i)
+		}
+	}
+}
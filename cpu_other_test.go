@@ -0,0 +1,14 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+//go:build !unix
+
+package rmnp
+
+import "time"
+
+// processCPUTime is not supported on this platform.
+func processCPUTime() time.Duration {
+	return 0
+}
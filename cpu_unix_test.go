@@ -0,0 +1,22 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+//go:build unix
+
+package rmnp
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime returns the user and system time consumed by the process so far.
+func processCPUTime() time.Duration {
+	var usage syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &usage) != nil {
+		return 0
+	}
+
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+// DisconnectReason describes why a connection was closed.
+type DisconnectReason byte
+
+const (
+	// DisconnectReasonRemoteRequest means the other side closed the connection.
+	DisconnectReasonRemoteRequest DisconnectReason = iota
+
+	// DisconnectReasonLocalRequest means the connection was closed by calling Connection.Disconnect.
+	DisconnectReasonLocalRequest
+
+	// DisconnectReasonTimeout means nothing was received for CfgTimeoutThreshold milliseconds.
+	DisconnectReasonTimeout
+
+	// DisconnectReasonPingTooHigh means the ping exceeded CfgMaxPing.
+	DisconnectReasonPingTooHigh
+
+	// DisconnectReasonServerShutdown means the server is shutting down.
+	DisconnectReasonServerShutdown
+
+	// DisconnectReasonRejected means the server denied the connection attempt.
+	DisconnectReasonRejected
+
+	// DisconnectReasonProtocolError means a malformed packet was received.
+	DisconnectReasonProtocolError
+
+	// DisconnectReasonQueueOverflow means a queue overflowed while OverflowDisconnect was configured.
+	DisconnectReasonQueueOverflow
+
+	// DisconnectReasonSessionExpired means the client tried to resume a session the server no longer knows.
+	DisconnectReasonSessionExpired
+
+	// DisconnectReasonServerFull means the server reached CfgMaxConnections or CfgMaxConnectionsPerIP.
+	DisconnectReasonServerFull
+
+	// DisconnectReasonBanned means the client's ip address was banned. The payload contains the ban's reason.
+	DisconnectReasonBanned
+
+	// DisconnectReasonRateLimited means the connection exceeded the rate limits while RateLimitDisconnect was configured.
+	DisconnectReasonRateLimited
+)
+
+var disconnectReasonNames = [...]string{
+	DisconnectReasonRemoteRequest:  "remote request",
+	DisconnectReasonLocalRequest:   "local request",
+	DisconnectReasonTimeout:        "timeout",
+	DisconnectReasonPingTooHigh:    "ping too high",
+	DisconnectReasonServerShutdown: "server shutdown",
+	DisconnectReasonRejected:       "rejected",
+	DisconnectReasonProtocolError:  "protocol error",
+	DisconnectReasonQueueOverflow:  "queue overflow",
+	DisconnectReasonSessionExpired: "session expired",
+	DisconnectReasonServerFull:     "server full",
+	DisconnectReasonBanned:         "banned",
+	DisconnectReasonRateLimited:    "rate limited",
+}
+
+func (r DisconnectReason) String() string {
+	if int(r) < len(disconnectReasonNames) {
+		return disconnectReasonNames[r]
+	}
+
+	return "unknown"
+}
+
+// the reason is sent as first byte of every disconnect packet's payload
+func encodeDisconnect(reason DisconnectReason, data []byte) []byte {
+	payload := make([]byte, 1+len(data))
+	payload[0] = byte(reason)
+	copy(payload[1:], data)
+	return payload
+}
+
+// decodeDisconnect returns the reason from the receiver's point of view: a local request of the
+// other side is a remote request on this side.
+func decodeDisconnect(payload []byte) (DisconnectReason, []byte) {
+	if len(payload) == 0 {
+		return DisconnectReasonRemoteRequest, nil
+	}
+
+	reason := DisconnectReason(payload[0])
+	if reason == DisconnectReasonLocalRequest {
+		reason = DisconnectReasonRemoteRequest
+	}
+
+	if len(payload) == 1 {
+		return reason, nil
+	}
+
+	return reason, append([]byte(nil), payload[1:]...)
+}
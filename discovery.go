@@ -0,0 +1,157 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DiscoveredServer is a server that answered a discovery probe.
+type DiscoveredServer struct {
+	// Addr is the address clients can connect to.
+	Addr *net.UDPAddr
+
+	// Advertisement is the response of the server's DiscoveryHandler.
+	Advertisement []byte
+
+	// Latency is the round trip time of the probe.
+	Latency time.Duration
+}
+
+// Discover sends discovery probes to the broadcast address and CfgDiscoveryMulticastGroup on CfgDiscoveryPort
+// every CfgDiscoveryInterval until the context is done. Every responding server is sent once to the returned
+// channel which is closed when the context is done.
+func Discover(ctx context.Context) (<-chan DiscoveredServer, error) {
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make(chan DiscoveredServer, 16)
+
+	go func() {
+		<-ctx.Done()
+		socket.Close()
+	}()
+
+	go func() {
+		defer antiPanic(nil)
+		defer close(servers)
+		discover(ctx, socket, servers)
+	}()
+
+	return servers, nil
+}
+
+func discover(ctx context.Context, socket *net.UDPConn, servers chan<- DiscoveredServer) {
+	targets := []*net.UDPAddr{
+		{IP: net.IPv4bcast, Port: CfgDiscoveryPort},
+		{IP: CfgDiscoveryMulticastGroup, Port: CfgDiscoveryPort},
+	}
+
+	sent := make(map[uint32]time.Time)
+	found := make(map[string]bool)
+	buffer := make([]byte, CfgMTU)
+
+	for {
+		request, nonce, err := newQueryRequest(unconnectedDiscovery, nil)
+		if err != nil {
+			return
+		}
+
+		sent[nonce] = time.Now()
+
+		// errors are ignored because not every network supports both broadcast and multicast
+		for _, target := range targets {
+			socket.WriteToUDP(request, target)
+		}
+
+		socket.SetReadDeadline(time.Now().Add(time.Duration(CfgDiscoveryInterval) * time.Millisecond))
+
+		for {
+			length, addr, err := socket.ReadFromUDP(buffer)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+
+				// socket closed because the context is done
+				return
+			}
+
+			advertisement, nonce, ok := parseQueryResponse(buffer[:length], unconnectedDiscoveryResponse)
+			if !ok || found[addr.String()] {
+				continue
+			}
+
+			sendTime, f := sent[nonce]
+			if !f {
+				continue
+			}
+
+			found[addr.String()] = true
+
+			select {
+			case servers <- DiscoveredServer{Addr: addr, Advertisement: advertisement, Latency: time.Since(sendTime)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// listenDiscovery binds the discovery port. All servers of a host can share the port because the multicast
+// socket uses SO_REUSEADDR. If the multicast group cannot be joined only broadcasts are received.
+func listenDiscovery() (*net.UDPConn, error) {
+	socket, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: CfgDiscoveryMulticastGroup, Port: CfgDiscoveryPort})
+	if err != nil {
+		socket, err = net.ListenUDP("udp4", &net.UDPAddr{Port: CfgDiscoveryPort})
+	}
+
+	return socket, err
+}
+
+// discoveryWorker answers probes received on the discovery port. The answer is sent from the server socket so
+// that clients learn the address to connect to.
+func (s *Server) discoveryWorker(socket *net.UDPConn) {
+	defer antiPanic(func() {
+		s.waitGroup.Add(1)
+		s.discoveryWorker(socket)
+	})
+	defer s.waitGroup.Done()
+
+	atomic.AddUint64(&StatRunningGoRoutines, 1)
+	defer atomic.AddUint64(&StatRunningGoRoutines, ^uint64(0))
+
+	buffer := make([]byte, CfgMTU)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		default:
+		}
+
+		socket.SetDeadline(time.Now().Add(time.Second))
+		length, addr, err := socket.ReadFromUDP(buffer)
+
+		if err != nil {
+			continue
+		}
+
+		packet := buffer[:length]
+
+		// everything except discovery probes is ignored on this port
+		if !validateHeaderSize(packet) || descriptor(packet[5])&descUnconnected == 0 ||
+			len(packet) <= headerSize(packet) || unconnectedKind(packet[headerSize(packet)]) != unconnectedDiscovery {
+			continue
+		}
+
+		s.handlePacket(s.socket, addr, packet)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscover(t *testing.T) {
+	// use a free port so that the test does not interfere with real servers
+	free, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevPort := CfgDiscoveryPort
+	CfgDiscoveryPort = free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+	defer func() { CfgDiscoveryPort = prevPort }()
+
+	server := NewServer(":0")
+	server.DiscoveryHandler = func(addr *net.UDPAddr, payload []byte) []byte {
+		return []byte("lan game")
+	}
+	server.Start()
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	servers, err := Discover(ctx)
+	if err != nil {
+		t.Fatalf("Expected discovery to start: %v", err)
+	}
+
+	select {
+	case found := <-servers:
+		if string(found.Advertisement) != "lan game" {
+			t.Errorf("Expected advertisement lan game not %q", found.Advertisement)
+		}
+
+		if port := server.socket.LocalAddr().(*net.UDPAddr).Port; found.Addr.Port != port {
+			t.Errorf("Expected server port %v not %v", port, found.Addr.Port)
+		}
+
+		if found.Latency <= 0 {
+			t.Errorf("Expected positive latency not %v", found.Latency)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected server to be discovered")
+	}
+
+	cancel()
+
+	select {
+	case _, open := <-servers:
+		for open {
+			_, open = <-servers
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected channel to be closed when the context is done")
+	}
+}
@@ -1,37 +1,242 @@
 package rmnp
 
-import "fmt"
+import (
+	"errors"
+	"sync"
+	"time"
+)
 
+var errQueueFull = errors.New("queue is full")
+
+// OverflowPolicy defines what happens if a packet is pushed into a full queue.
+type OverflowPolicy byte
+
+const (
+	// OverflowDropOldestUnreliable drops the oldest queued unreliable packet to make room.
+	// If the queue only contains reliable packets the new packet is rejected.
+	OverflowDropOldestUnreliable OverflowPolicy = iota
+	// OverflowBlock waits up to CfgQueueBlockTimeout milliseconds for the queue to make room.
+	OverflowBlock
+	// OverflowError rejects the new packet immediately.
+	OverflowError
+	// OverflowDisconnect rejects the new packet and disconnects the connection.
+	OverflowDisconnect
+)
+
+// Queue identifies one of the packet queues of a connection.
+type Queue byte
+
+const (
+	// QueueSend holds packets that are waiting to be sent.
+	QueueSend Queue = iota
+	// QueueReceive holds packets that were received but not processed yet.
+	QueueReceive
+)
+
+// dropChannel is a bounded ring buffer queue that applies an overflow policy when it is full.
 type dropChannel struct {
-	channel chan interface{}
+	mutex     sync.Mutex
+	items     []interface{}
+	head      int
+	count     int
+	policy    OverflowPolicy
+	droppable func(interface{}) bool
+	clock     Clock
+
+	// signal is notified whenever an element is pushed
+	signal chan struct{}
+	// space is notified whenever an element is popped
+	space chan struct{}
 }
 
-func newDropChannel(channel chan interface{}) *dropChannel {
+func newDropChannel(capacity int, droppable func(interface{}) bool) *dropChannel {
 	c := new(dropChannel)
-	c.channel = channel
+	c.items = make([]interface{}, capacity)
+	c.droppable = droppable
+	c.signal = make(chan struct{}, 1)
+	c.space = make(chan struct{}, 1)
 	return c
 }
 
-func (c *dropChannel) push(i interface{}) {
-	if l := len(c.channel); l > 0 && l == cap(c.channel) {
-		fmt.Println("dropping packets from dropChannel")
-		<-c.channel
+// push adds the element according to the queue's overflow policy. overflow reports whether the
+// queue was full and err whether the element could not be added.
+func (c *dropChannel) push(i interface{}) (overflow bool, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.count >= len(c.items) {
+		overflow = true
+
+		switch c.policy {
+		case OverflowDropOldestUnreliable:
+			if !c.dropOldest(c.droppable) {
+				return true, errQueueFull
+			}
+		case OverflowBlock:
+			if !c.waitForSpace(time.Duration(CfgQueueBlockTimeout) * time.Millisecond) {
+				return true, errQueueFull
+			}
+		default:
+			return true, errQueueFull
+		}
+	}
+
+	c.add(i)
+	return overflow, nil
+}
+
+// tryPush adds the element without blocking regardless of the queue's overflow policy. If the queue is full
+// the oldest droppable element is dropped, if there is none the element is rejected.
+func (c *dropChannel) tryPush(i interface{}) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.count >= len(c.items) && !c.dropOldest(c.droppable) {
+		return false
+	}
+
+	c.add(i)
+	return true
+}
+
+// forcePush adds the element and drops the oldest element if the queue is full.
+func (c *dropChannel) forcePush(i interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.count >= len(c.items) {
+		c.dropOldest(nil)
 	}
 
+	c.add(i)
+}
+
+func (c *dropChannel) pop() (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.count == 0 {
+		return nil, false
+	}
+
+	i := c.items[c.head]
+	c.items[c.head] = nil
+	c.head = (c.head + 1) % len(c.items)
+	c.count--
+
 	select {
-	case c.channel <- i:
+	case c.space <- struct{}{}:
 	default:
-		panic("drop channel is blocking")
 	}
+
+	return i, true
 }
 
 func (c *dropChannel) clear() {
-loop:
-	for {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := range c.items {
+		c.items[i] = nil
+	}
+
+	c.head = 0
+	c.count = 0
+}
+
+// removeAll removes every item the predicate returns true for while keeping the order of the others.
+func (c *dropChannel) removeAll(predicate func(interface{}) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	size := len(c.items)
+	n := 0
+
+	for k := 0; k < c.count; k++ {
+		i := c.items[(c.head+k)%size]
+
+		if !predicate(i) {
+			c.items[(c.head+n)%size] = i
+			n++
+		}
+	}
+
+	for k := n; k < c.count; k++ {
+		c.items[(c.head+k)%size] = nil
+	}
+
+	if n < c.count {
 		select {
-		case <-c.channel:
+		case c.space <- struct{}{}:
 		default:
-			break loop
 		}
 	}
+
+	c.count = n
+}
+
+func (c *dropChannel) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.count
+}
+
+// has to be called while holding the mutex
+func (c *dropChannel) add(i interface{}) {
+	c.items[(c.head+c.count)%len(c.items)] = i
+	c.count++
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// has to be called while holding the mutex
+func (c *dropChannel) dropOldest(droppable func(interface{}) bool) bool {
+	size := len(c.items)
+
+	for k := 0; k < c.count; k++ {
+		if droppable != nil && !droppable(c.items[(c.head+k)%size]) {
+			continue
+		}
+
+		for j := k; j < c.count-1; j++ {
+			c.items[(c.head+j)%size] = c.items[(c.head+j+1)%size]
+		}
+
+		c.items[(c.head+c.count-1)%size] = nil
+		c.count--
+		return true
+	}
+
+	return false
+}
+
+// has to be called while holding the mutex
+func (c *dropChannel) waitForSpace(timeout time.Duration) bool {
+	clock := c.clock
+	if clock == nil {
+		clock = CfgClock
+	}
+
+	deadline := clock.Now().Add(timeout)
+
+	for c.count >= len(c.items) {
+		remaining := deadline.Sub(clock.Now())
+		if remaining <= 0 {
+			return false
+		}
+
+		c.mutex.Unlock()
+
+		select {
+		case <-c.space:
+		case <-clock.After(remaining):
+		}
+
+		c.mutex.Lock()
+	}
+
+	return true
 }
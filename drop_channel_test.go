@@ -1,6 +1,13 @@
 package rmnp
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
+
+func isOdd(i interface{}) bool {
+	return i.(int)%2 == 1
+}
 
 func TestDropChannel(t *testing.T) {
 	defer func() {
@@ -9,21 +16,114 @@ func TestDropChannel(t *testing.T) {
 		}
 	}()
 
-	c := newDropChannel(make(chan interface{}, 2))
+	c := newDropChannel(2, nil)
 
 	c.push(10)
-	if i := <-c.channel; i != 10 {
+	if i, _ := c.pop(); i != 10 {
 		t.Error("Channel wrapping does not work")
 		return
 	}
 
 	values := []byte{2, 4, 8, 16}
 	for _, b := range values {
-		c.push(b)
+		c.forcePush(b)
 	}
 	for i := 2; i <= 3; i++ {
-		if v, r := <-c.channel, values[i]; v != r {
-			t.Errorf("Expected first value to be %v not %v", r, i)
+		if v, _ := c.pop(); v != values[i] {
+			t.Errorf("Expected first value to be %v not %v", values[i], v)
 		}
 	}
 }
+
+func TestDropChannelDropOldestUnreliable(t *testing.T) {
+	c := newDropChannel(3, isOdd)
+	c.policy = OverflowDropOldestUnreliable
+
+	c.push(2)
+	c.push(3)
+	c.push(4)
+
+	if overflow, err := c.push(6); !overflow || err != nil {
+		t.Errorf("Expected odd element to be dropped for new element (overflow: %v, err: %v)", overflow, err)
+	}
+
+	for _, e := range []int{2, 4, 6} {
+		if v, _ := c.pop(); v != e {
+			t.Errorf("Expected value to be %v not %v", e, v)
+		}
+	}
+
+	c.push(2)
+	c.push(4)
+	c.push(6)
+
+	if overflow, err := c.push(8); !overflow || err != errQueueFull {
+		t.Error("Expected queue without odd elements to reject new element")
+	}
+
+	if l := c.len(); l != 3 {
+		t.Errorf("Expected queue length to be 3 not %v", l)
+	}
+}
+
+func TestDropChannelError(t *testing.T) {
+	c := newDropChannel(1, isOdd)
+	c.policy = OverflowError
+
+	c.push(1)
+
+	if _, err := c.push(3); err != errQueueFull {
+		t.Error("Expected full queue to reject new element")
+	}
+
+	if v, _ := c.pop(); v != 1 {
+		t.Errorf("Expected value to be 1 not %v", v)
+	}
+}
+
+func TestDropChannelBlock(t *testing.T) {
+	defer func(timeout int64) { CfgQueueBlockTimeout = timeout }(CfgQueueBlockTimeout)
+	CfgQueueBlockTimeout = 1000
+
+	c := newDropChannel(1, isOdd)
+	c.policy = OverflowBlock
+	c.push(1)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.pop()
+	}()
+
+	if overflow, err := c.push(3); !overflow || err != nil {
+		t.Errorf("Expected push to wait for free space (overflow: %v, err: %v)", overflow, err)
+	}
+
+	CfgQueueBlockTimeout = 10
+
+	if _, err := c.push(5); err != errQueueFull {
+		t.Error("Expected push to time out")
+	}
+}
+
+func TestDropChannelTryPush(t *testing.T) {
+	defer func(timeout int64) { CfgQueueBlockTimeout = timeout }(CfgQueueBlockTimeout)
+	CfgQueueBlockTimeout = 1000
+
+	c := newDropChannel(2, isOdd)
+	c.policy = OverflowBlock
+	c.push(1)
+	c.push(2)
+
+	// must neither block nor apply the policy
+	if !c.tryPush(4) {
+		t.Error("Expected oldest droppable element to make room")
+	}
+
+	if c.tryPush(6) {
+		t.Error("Expected push to be rejected if nothing can be dropped")
+	}
+
+	if i, _ := c.pop(); i != 2 {
+		t.Errorf("Expected 2 not %v", i)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+var (
+	// ErrInvalidDecodeTarget is returned if Decode is not called with a non-nil pointer.
+	ErrInvalidDecodeTarget = errors.New("rmnp: decode target must be a non-nil pointer")
+
+	// ErrNilPointer is returned by Encode for nil pointers that are not tagged as optional.
+	ErrNilPointer = errors.New("rmnp: cannot encode nil pointer")
+)
+
+// UnsupportedTypeError is returned by Encode and Decode for types that cannot be serialized.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("rmnp: unsupported type %v", e.Type)
+}
+
+// fieldOptions are parsed from the rmnp struct tag of a field.
+type fieldOptions struct {
+	skip     bool
+	varint   bool
+	optional bool
+}
+
+func parseFieldOptions(tag string) (o fieldOptions) {
+	for _, option := range strings.Split(tag, ",") {
+		switch strings.TrimSpace(option) {
+		case "-":
+			o.skip = true
+		case "varint":
+			o.varint = true
+		case "optional":
+			o.optional = true
+		}
+	}
+
+	return
+}
+
+// Encode serializes the value into a new byte slice. See Serializer.Encode for the format.
+func Encode(v interface{}) ([]byte, error) {
+	s := NewSerializer()
+	if err := s.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return s.Bytes(), nil
+}
+
+// Decode deserializes data created by Encode into v which must be a non-nil pointer.
+func Decode(data []byte, v interface{}) error {
+	return NewSerializerFor(data).Decode(v)
+}
+
+// Encode writes the value into the serializer. Structs are written field by field in declaration order,
+// unexported fields are ignored. Supported are bools, sized integers, floats, strings, slices, arrays,
+// structs and pointers. Strings and slices are prefixed with their length as uvarint. int and uint are always
+// written as varint.
+//
+// The behaviour of a field can be changed with the rmnp tag:
+//
+//	Health int32    `rmnp:"varint"`   // written as varint instead of fixed size
+//	Target *Vector  `rmnp:"optional"` // a leading bool tells whether the pointer is nil
+//	Cache  []byte   `rmnp:"-"`        // not written at all
+//
+// Pointers that are not optional have to be non-nil.
+func (s *Serializer) Encode(v interface{}) error {
+	if v == nil {
+		return &UnsupportedTypeError{}
+	}
+
+	return s.encode(reflect.ValueOf(v), fieldOptions{})
+}
+
+// Decode reads a value written by Encode into v which must be a non-nil pointer.
+func (s *Serializer) Decode(v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return ErrInvalidDecodeTarget
+	}
+
+	return s.decode(value.Elem(), fieldOptions{})
+}
+
+func (s *Serializer) encode(v reflect.Value, options fieldOptions) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			s.buffer.WriteByte(1)
+		} else {
+			s.buffer.WriteByte(0)
+		}
+	case reflect.Int:
+		s.WriteVarint(v.Int())
+	case reflect.Uint:
+		s.WriteUvarint(v.Uint())
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if options.varint {
+			s.WriteVarint(v.Int())
+		} else {
+			s.writeFixed(uint64(v.Int()), v.Type().Size())
+		}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if options.varint {
+			s.WriteUvarint(v.Uint())
+		} else {
+			s.writeFixed(v.Uint(), v.Type().Size())
+		}
+	case reflect.Float32:
+		s.writeFixed(uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		s.writeFixed(math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		s.WriteString(v.String())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s.WriteBytes(v.Bytes())
+			return nil
+		}
+
+		s.WriteUvarint(uint64(v.Len()))
+		return s.encodeElements(v, options)
+	case reflect.Array:
+		return s.encodeElements(v, options)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			options := parseFieldOptions(field.Tag.Get("rmnp"))
+			if field.PkgPath != "" || options.skip {
+				continue
+			}
+
+			if err := s.encode(v.Field(i), options); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if options.optional {
+			s.encode(reflect.ValueOf(!v.IsNil()), fieldOptions{})
+			if v.IsNil() {
+				return nil
+			}
+		} else if v.IsNil() {
+			return ErrNilPointer
+		}
+
+		return s.encode(v.Elem(), fieldOptions{varint: options.varint})
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+
+	return nil
+}
+
+func (s *Serializer) encodeElements(v reflect.Value, options fieldOptions) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := s.encode(v.Index(i), fieldOptions{varint: options.varint}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Serializer) decode(v reflect.Value, options fieldOptions) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := s.buffer.ReadByte()
+		if err != nil {
+			return ErrSerializerUnderflow
+		}
+		v.SetBool(b != 0)
+	case reflect.Int:
+		value, err := s.ReadVarint()
+		if err != nil {
+			return err
+		}
+		v.SetInt(value)
+	case reflect.Uint:
+		value, err := s.ReadUvarint()
+		if err != nil {
+			return err
+		}
+		v.SetUint(value)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var value int64
+		if options.varint {
+			var err error
+			if value, err = s.ReadVarint(); err != nil {
+				return err
+			}
+		} else {
+			size := v.Type().Size()
+			raw, err := s.readFixed(size)
+			if err != nil {
+				return err
+			}
+
+			// sign extend
+			shift := 64 - 8*size
+			value = int64(raw<<shift) >> shift
+		}
+
+		if v.OverflowInt(value) {
+			return ErrVarintOverflow
+		}
+		v.SetInt(value)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var value uint64
+		var err error
+		if options.varint {
+			value, err = s.ReadUvarint()
+		} else {
+			value, err = s.readFixed(v.Type().Size())
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if v.OverflowUint(value) {
+			return ErrVarintOverflow
+		}
+		v.SetUint(value)
+	case reflect.Float32:
+		raw, err := s.readFixed(4)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(float64(math.Float32frombits(uint32(raw))))
+	case reflect.Float64:
+		raw, err := s.readFixed(8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(raw))
+	case reflect.String:
+		value, err := s.ReadString()
+		if err != nil {
+			return err
+		}
+		v.SetString(value)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data, err := s.ReadBytes()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(data)
+			return nil
+		}
+
+		// lengths are limited by the remaining data so that malicious packets cannot cause huge allocations
+		length, err := s.readLength()
+		if err != nil {
+			return err
+		}
+
+		v.Set(reflect.MakeSlice(v.Type(), length, length))
+		return s.decodeElements(v, options)
+	case reflect.Array:
+		return s.decodeElements(v, options)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			options := parseFieldOptions(field.Tag.Get("rmnp"))
+			if field.PkgPath != "" || options.skip {
+				continue
+			}
+
+			if err := s.decode(v.Field(i), options); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if options.optional {
+			var present bool
+			if err := s.decode(reflect.ValueOf(&present).Elem(), fieldOptions{}); err != nil {
+				return err
+			}
+
+			if !present {
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+		}
+
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		return s.decode(v.Elem(), fieldOptions{varint: options.varint})
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+
+	return nil
+}
+
+func (s *Serializer) decodeElements(v reflect.Value, options fieldOptions) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := s.decode(v.Index(i), fieldOptions{varint: options.varint}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFixed writes the lowest size bytes of the value in little endian.
+func (s *Serializer) writeFixed(value uint64, size uintptr) {
+	for i := uintptr(0); i < size; i++ {
+		s.buffer.WriteByte(byte(value >> (8 * i)))
+	}
+}
+
+func (s *Serializer) readFixed(size uintptr) (uint64, error) {
+	if uintptr(s.buffer.Len()) < size {
+		return 0, ErrSerializerUnderflow
+	}
+
+	var value uint64
+	for i, b := range s.buffer.Next(int(size)) {
+		value |= uint64(b) << (8 * uint(i))
+	}
+
+	return value, nil
+}
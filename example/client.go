@@ -23,8 +23,8 @@ func serverConnect(conn *rmnp.Connection, data []byte) {
 	conn.SendReliableOrdered([]byte("ping"))
 }
 
-func serverDisconnect(conn *rmnp.Connection, data []byte) {
-	fmt.Println("disconnected from server:", string(data))
+func serverDisconnect(conn *rmnp.Connection, reason rmnp.DisconnectReason, data []byte) {
+	fmt.Println("disconnected from server:", reason, string(data))
 }
 
 func serverTimeout(conn *rmnp.Connection, data []byte) {
@@ -29,8 +29,8 @@ func clientConnect(conn *rmnp.Connection, data []byte) {
 	}
 }
 
-func clientDisconnect(conn *rmnp.Connection, data []byte) {
-	fmt.Println("client disconnect")
+func clientDisconnect(conn *rmnp.Connection, reason rmnp.DisconnectReason, data []byte) {
+	fmt.Println("client disconnect:", reason)
 }
 
 func clientTimeout(conn *rmnp.Connection, data []byte) {
@@ -2,27 +2,42 @@ package rmnp
 
 import "sync"
 
+// execGuard makes sure that only one execution per id runs at the same time. Executions that were
+// not finished after the timeout (in ms) are discarded and at most limit executions can be pending
+// (0 = no limit).
 type execGuard struct {
 	mutex      sync.Mutex
-	executions map[uint32]bool
+	executions map[uint32]int64
+	limit      int
+	timeout    int64
 }
 
-func newExecGuard() *execGuard {
+func newExecGuard(limit int, timeout int64) *execGuard {
 	guard := new(execGuard)
-	guard.executions = make(map[uint32]bool)
+	guard.executions = make(map[uint32]int64)
+	guard.limit = limit
+	guard.timeout = timeout
 	return guard
 }
 
-func (g *execGuard) tryExecute(id uint32) bool {
+func (g *execGuard) tryExecute(id uint32, now int64) bool {
 	g.mutex.Lock()
 	defer g.mutex.Unlock()
 
-	if _, f := g.executions[id]; !f {
-		g.executions[id] = true
-		return true
+	if start, f := g.executions[id]; f && now-start < g.timeout {
+		return false
 	}
 
-	return false
+	if g.limit > 0 && len(g.executions) >= g.limit {
+		g.prune(now)
+
+		if len(g.executions) >= g.limit {
+			return false
+		}
+	}
+
+	g.executions[id] = now
+	return true
 }
 
 func (g *execGuard) finish(id uint32) {
@@ -30,3 +45,18 @@ func (g *execGuard) finish(id uint32) {
 	defer g.mutex.Unlock()
 	delete(g.executions, id)
 }
+
+func (g *execGuard) len() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.executions)
+}
+
+// has to be called while holding the mutex
+func (g *execGuard) prune(now int64) {
+	for id, start := range g.executions {
+		if now-start >= g.timeout {
+			delete(g.executions, id)
+		}
+	}
+}
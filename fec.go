@@ -0,0 +1,531 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Forward error correction groups up to CfgFECMaxGroupSize outgoing datagrams. Every datagram is wrapped in a
+// fec data packet. After the group is full (or CfgFECFlushTimeout passed) the sender emits parity packets that
+// are computed with a Reed-Solomon code (Cauchy matrix over GF(2^8)). The receiver can restore as many lost
+// datagrams of a group as parity packets arrived without waiting for resends. It reports the measured loss
+// so that the sender can adjust the group size.
+//
+// fec data: kind (1) + group (2) + index (1) + datagram
+// fec parity: kind (1) + group (2) + parity index (1) + data packet count (1) + parity shard
+// fec report: kind (1) + lost datagrams per 255
+//
+// A shard is the length of a datagram (2) followed by the datagram. Parity shards are as long as the longest
+// shard of their group.
+const (
+	fecDataHeaderSize   = 4
+	fecParityHeaderSize = 5
+	fecReportSize       = 2
+
+	// indices of data and parity shards have to be distinct elements of the field
+	fecMaxShards = 128
+
+	// amount of groups a receiver keeps and amount of data packets after which it reports the loss
+	fecGroupHistory  = 8
+	fecReportPackets = 32
+
+	// weight of a new loss report in the sender's estimate
+	fecLossSmoothFactor = 0.25
+)
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c * src to dst.
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+
+	l := int(gfLog[c])
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= gfExp[l+int(gfLog[b])]
+		}
+	}
+}
+
+// fecCoefficient returns the element of the Cauchy matrix for the parity and data shard. Every square
+// sub-matrix of it is invertible which allows any lost shards to be restored from the same amount of parities.
+func fecCoefficient(parity, index int) byte {
+	return gfInv(byte(fecMaxShards+parity) ^ byte(index))
+}
+
+// fecEncode adds the data shard with the index to the parity shards.
+func fecEncode(parities [][]byte, index int, shard []byte) {
+	for j := range parities {
+		if len(parities[j]) < len(shard) {
+			parities[j] = append(parities[j], make([]byte, len(shard)-len(parities[j]))...)
+		}
+
+		gfMulAdd(parities[j], shard, fecCoefficient(j, index))
+	}
+}
+
+type fecParity struct {
+	index int
+	shard []byte
+}
+
+// fecRecover restores the missing (nil) shards of the first count shards. It fails if more shards are missing
+// than parities are given or the shards do not fit the parities.
+func fecRecover(count int, shards [][]byte, parities []fecParity) ([]int, bool) {
+	var missing []int
+	for i := 0; i < count; i++ {
+		if shards[i] == nil {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil, true
+	}
+
+	if len(missing) > len(parities) {
+		return nil, false
+	}
+
+	parities = parities[:len(missing)]
+	size := len(parities[0].shard)
+
+	// subtract the known shards from the parities which leaves the sum of the missing shards
+	sums := make([][]byte, len(parities))
+	matrix := make([][]byte, len(parities))
+	for p, parity := range parities {
+		if len(parity.shard) != size {
+			return nil, false
+		}
+
+		sums[p] = append([]byte(nil), parity.shard...)
+		for i := 0; i < count; i++ {
+			if shards[i] != nil {
+				if len(shards[i]) > size {
+					return nil, false
+				}
+
+				gfMulAdd(sums[p], shards[i], fecCoefficient(parity.index, i))
+			}
+		}
+
+		matrix[p] = make([]byte, len(missing))
+		for m, i := range missing {
+			matrix[p][m] = fecCoefficient(parity.index, i)
+		}
+	}
+
+	inverse, ok := gfInvert(matrix)
+	if !ok {
+		return nil, false
+	}
+
+	for m, i := range missing {
+		shard := make([]byte, size)
+		for p := range sums {
+			gfMulAdd(shard, sums[p], inverse[m][p])
+		}
+
+		shards[i] = shard
+	}
+
+	return missing, true
+}
+
+// gfInvert inverts the square matrix using Gauss-Jordan elimination.
+func gfInvert(matrix [][]byte) ([][]byte, bool) {
+	n := len(matrix)
+	inverse := make([][]byte, n)
+	for i := range inverse {
+		inverse[i] = make([]byte, n)
+		inverse[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && matrix[pivot][col] == 0 {
+			pivot++
+		}
+
+		if pivot == n {
+			return nil, false
+		}
+
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		scale := gfInv(matrix[col][col])
+		for k := 0; k < n; k++ {
+			matrix[col][k] = gfMul(matrix[col][k], scale)
+			inverse[col][k] = gfMul(inverse[col][k], scale)
+		}
+
+		for row := 0; row < n; row++ {
+			if factor := matrix[row][col]; row != col && factor != 0 {
+				gfMulAdd(matrix[row], matrix[col], factor)
+				gfMulAdd(inverse[row], inverse[col], factor)
+			}
+		}
+	}
+
+	return inverse, true
+}
+
+// fecSender builds the parities of the current group.
+type fecSender struct {
+	parityCount int
+	groupSize   int
+	group       sequenceNumber
+	count       int
+	parities    [][]byte
+	started     int64
+	loss        float64
+	hasLoss     bool
+}
+
+// fecGroup is a group of received fec packets.
+type fecGroup struct {
+	id        sequenceNumber
+	count     int
+	shards    [][]byte
+	originals int
+	parities  []fecParity
+	done      bool
+}
+
+// fecReceiver keeps the last fecGroupHistory groups and measures the loss.
+type fecReceiver struct {
+	groups    [fecGroupHistory]*fecGroup
+	latest    sequenceNumber
+	hasLatest bool
+	expected  int
+	lost      int
+}
+
+// SetFEC enables forward error correction for all packets sent on this connection with the given amount of
+// parity packets per group (0 disables it). Up to that many lost packets per group are restored by the
+// receiver without resend. The group size starts at CfgFECGroupSize and adapts to the loss reported by the
+// receiver. Connections start with CfgFECParityCount. FEC adds 13 bytes to the largest packet of a group which
+// has to stay below CfgMTU, larger packets are sent without protection.
+func (c *Connection) SetFEC(parityCount int) {
+	c.fecMutex.Lock()
+	defer c.fecMutex.Unlock()
+
+	// the receiver might already know packets of the current group
+	c.fecSender = newFECSender(parityCount, c.fecSender.group+1)
+}
+
+// FECGroupSize returns the current amount of packets per FEC group or 0 if FEC is disabled.
+func (c *Connection) FECGroupSize() int {
+	c.fecMutex.Lock()
+	defer c.fecMutex.Unlock()
+
+	if c.fecSender.parityCount == 0 {
+		return 0
+	}
+
+	return c.fecSender.groupSize
+}
+
+func newFECSender(parityCount int, group sequenceNumber) fecSender {
+	if parityCount < 0 {
+		parityCount = 0
+	} else if parityCount > fecMaxShards-1 {
+		parityCount = fecMaxShards - 1
+	}
+
+	return fecSender{
+		parityCount: parityCount,
+		groupSize:   clampFECGroupSize(CfgFECGroupSize),
+		group:       group,
+		parities:    make([][]byte, parityCount),
+	}
+}
+
+func clampFECGroupSize(size int) int {
+	if size > CfgFECMaxGroupSize {
+		size = CfgFECMaxGroupSize
+	}
+
+	if size < CfgFECMinGroupSize {
+		size = CfgFECMinGroupSize
+	}
+
+	if size > fecMaxShards-1 {
+		size = fecMaxShards - 1
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	return size
+}
+
+// protectDatagram sends the datagram as part of the current group if FEC is enabled. Connection and
+// disconnection packets are never protected because they are handled before a connection exists.
+func (c *Connection) protectDatagram(p *packet, datagram []byte) bool {
+	if p.flag(descConnect) || p.flag(descDisconnect) {
+		return false
+	}
+
+	c.fecMutex.Lock()
+	defer c.fecMutex.Unlock()
+
+	// parity packets are the largest packets of a group
+	s := &c.fecSender
+	if s.parityCount == 0 || systemPacketHeaderSize()+fecParityHeaderSize+2+len(datagram) > CfgMTU {
+		return false
+	}
+
+	if s.count == 0 {
+		s.started = c.protocol.currentTime()
+	}
+
+	data := make([]byte, fecDataHeaderSize+len(datagram))
+	data[0] = byte(systemFECData)
+	binary.LittleEndian.PutUint16(data[1:3], uint16(s.group))
+	data[3] = byte(s.count)
+	copy(data[fecDataHeaderSize:], datagram)
+	c.writePacket(&packet{protocolID: CfgProtocolID, descriptor: descSystem, data: data}, false)
+
+	shard := make([]byte, 2+len(datagram))
+	binary.LittleEndian.PutUint16(shard, uint16(len(datagram)))
+	copy(shard[2:], datagram)
+	fecEncode(s.parities, s.count, shard)
+
+	s.count++
+	if s.count >= s.groupSize {
+		c.flushFECGroup()
+	}
+
+	return true
+}
+
+// flushFECGroup sends the parities of the current group and starts the next one.
+func (c *Connection) flushFECGroup() {
+	s := &c.fecSender
+
+	for j, parity := range s.parities {
+		data := make([]byte, fecParityHeaderSize+len(parity))
+		data[0] = byte(systemFECParity)
+		binary.LittleEndian.PutUint16(data[1:3], uint16(s.group))
+		data[3] = byte(j)
+		data[4] = byte(s.count)
+		copy(data[fecParityHeaderSize:], parity)
+		c.writePacket(&packet{protocolID: CfgProtocolID, descriptor: descSystem, data: data}, false)
+
+		s.parities[j] = parity[:0]
+	}
+
+	s.group++
+	s.count = 0
+}
+
+// updateFEC sends the parities of an incomplete group after CfgFECFlushTimeout so that the last packets of a
+// burst are protected as well.
+func (c *Connection) updateFEC(currentTime int64) {
+	c.fecMutex.Lock()
+	defer c.fecMutex.Unlock()
+
+	if c.fecSender.count > 0 && currentTime-c.fecSender.started >= CfgFECFlushTimeout {
+		c.flushFECGroup()
+	}
+}
+
+// group returns the group with the id or nil if it is too old.
+func (r *fecReceiver) group(id sequenceNumber) *fecGroup {
+	if r.hasLatest && !greaterThanSequence(id, r.latest) && differenceSequence(r.latest, id) >= fecGroupHistory {
+		return nil
+	}
+
+	if !r.hasLatest || greaterThanSequence(id, r.latest) {
+		r.latest, r.hasLatest = id, true
+	}
+
+	slot := &r.groups[id%fecGroupHistory]
+	if *slot != nil && (*slot).id == id {
+		return *slot
+	}
+
+	if g := *slot; g != nil && g.count > 0 && g.originals <= g.count {
+		r.expected += g.count
+		r.lost += g.count - g.originals
+	}
+
+	*slot = &fecGroup{id: id, shards: make([][]byte, fecMaxShards)}
+	return *slot
+}
+
+// report returns the loss report if enough packets were measured.
+func (r *fecReceiver) report() []byte {
+	if r.expected < fecReportPackets {
+		return nil
+	}
+
+	data := []byte{byte(systemFECReport), byte(r.lost * 255 / r.expected)}
+	r.expected, r.lost = 0, 0
+	return data
+}
+
+// restore restores missing datagrams of the group if possible and returns them.
+func (g *fecGroup) restore() [][]byte {
+	if g.done || g.count == 0 {
+		return nil
+	}
+
+	restored, ok := fecRecover(g.count, g.shards, g.parities)
+	if !ok {
+		return nil
+	}
+
+	g.done = true
+
+	var datagrams [][]byte
+	for _, i := range restored {
+		shard := g.shards[i]
+		if length := int(binary.LittleEndian.Uint16(shard)); length <= len(shard)-2 {
+			datagrams = append(datagrams, shard[2:2+length])
+		}
+	}
+
+	atomic.AddUint64(&StatFECRecoveredPackets, uint64(len(datagrams)))
+	return datagrams
+}
+
+func (c *Connection) handleFECData(data []byte) {
+	index := int(data[3])
+	datagram := data[fecDataHeaderSize:]
+	if index >= fecMaxShards {
+		return
+	}
+
+	c.fecMutex.Lock()
+	r := &c.fecReceiver
+	g := r.group(sequenceNumber(binary.LittleEndian.Uint16(data[1:3])))
+
+	// duplicates, datagrams that were already restored and datagrams of old groups are dropped
+	if g == nil || g.shards[index] != nil {
+		c.fecMutex.Unlock()
+		return
+	}
+
+	shard := make([]byte, 2+len(datagram))
+	binary.LittleEndian.PutUint16(shard, uint16(len(datagram)))
+	copy(shard[2:], datagram)
+	g.shards[index] = shard
+	g.originals++
+
+	restored := g.restore()
+	report := r.report()
+	c.fecMutex.Unlock()
+
+	c.processFEC(append([][]byte{datagram}, restored...), report)
+}
+
+func (c *Connection) handleFECParity(data []byte) {
+	index, count := int(data[3]), int(data[4])
+	if index >= fecMaxShards || count == 0 || count >= fecMaxShards {
+		return
+	}
+
+	c.fecMutex.Lock()
+	r := &c.fecReceiver
+	g := r.group(sequenceNumber(binary.LittleEndian.Uint16(data[1:3])))
+
+	if g == nil || g.done || (g.count != 0 && g.count != count) {
+		c.fecMutex.Unlock()
+		return
+	}
+
+	for _, parity := range g.parities {
+		if parity.index == index {
+			c.fecMutex.Unlock()
+			return
+		}
+	}
+
+	g.count = count
+	g.parities = append(g.parities, fecParity{index, append([]byte(nil), data[fecParityHeaderSize:]...)})
+
+	restored := g.restore()
+	report := r.report()
+	c.fecMutex.Unlock()
+
+	c.processFEC(restored, report)
+}
+
+func (c *Connection) handleFECReport(data []byte) {
+	c.fecMutex.Lock()
+	defer c.fecMutex.Unlock()
+
+	s := &c.fecSender
+	if s.parityCount == 0 {
+		return
+	}
+
+	loss := float64(data[1]) / 255
+	if s.hasLoss {
+		loss = s.loss + (loss-s.loss)*fecLossSmoothFactor
+	}
+	s.loss, s.hasLoss = loss, true
+
+	// the group size is chosen so that on average half of the parities are needed
+	if loss > 0 {
+		s.groupSize = clampFECGroupSize(int(float64(s.parityCount)/(2*loss)) - s.parityCount)
+	} else {
+		s.groupSize = clampFECGroupSize(CfgFECMaxGroupSize)
+	}
+}
+
+// processFEC processes the unwrapped datagrams like received ones and sends the loss report. The checksum of
+// every datagram is validated again which also detects shards that were restored incorrectly.
+func (c *Connection) processFEC(datagrams [][]byte, report []byte) {
+	for _, datagram := range datagrams {
+		if validateHeader(datagram) {
+			c.processReceive(datagram)
+		}
+	}
+
+	if report != nil {
+		c.writePacket(&packet{protocolID: CfgProtocolID, descriptor: descSystem, data: report}, false)
+	}
+}
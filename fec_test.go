@@ -0,0 +1,95 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestFECRecover(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	shards := make([][]byte, 10)
+	for i := range shards {
+		shards[i] = make([]byte, 1+random.Intn(50))
+		random.Read(shards[i])
+	}
+
+	parities := make([][]byte, 3)
+	for i, shard := range shards {
+		fecEncode(parities, i, shard)
+	}
+
+	tests := [][]int{{}, {0}, {9}, {2, 5}, {0, 1, 2}, {3, 7, 9}}
+	for _, lost := range tests {
+		received := make([][]byte, len(shards))
+		copy(received, shards)
+		for _, i := range lost {
+			received[i] = nil
+		}
+
+		var given []fecParity
+		for j := len(parities) - 1; j >= 0; j-- {
+			given = append(given, fecParity{j, parities[j]})
+		}
+
+		restored, ok := fecRecover(len(shards), received, given)
+		if !ok || len(restored) != len(lost) {
+			t.Errorf("Expected %v to be restored not %v (%v)", lost, restored, ok)
+			continue
+		}
+
+		// restored shards are padded to the parity size
+		for _, i := range lost {
+			if !bytes.Equal(received[i][:len(shards[i])], shards[i]) {
+				t.Errorf("Expected shard %v to be restored correctly", i)
+			}
+		}
+	}
+
+	received := make([][]byte, len(shards))
+	copy(received, shards)
+	received[1], received[2], received[3] = nil, nil, nil
+
+	if _, ok := fecRecover(len(shards), received, []fecParity{{0, parities[0]}, {2, parities[2]}}); ok {
+		t.Error("Expected 3 lost shards not to be restored with 2 parities")
+	}
+}
+
+func TestFECGroupSize(t *testing.T) {
+	c := newConnection()
+	c.SetFEC(2)
+
+	if c.FECGroupSize() != CfgFECGroupSize {
+		t.Errorf("Expected initial group size %v not %v", CfgFECGroupSize, c.FECGroupSize())
+	}
+
+	// 20% loss: 2 parities should be enough for 3 packets
+	c.handleFECReport([]byte{byte(systemFECReport), 51})
+	if c.FECGroupSize() != 3 {
+		t.Errorf("Expected group size 3 not %v", c.FECGroupSize())
+	}
+
+	// the estimate is smoothed and reaches the max size after a few reports without loss
+	c.handleFECReport([]byte{byte(systemFECReport), 0})
+	if c.FECGroupSize() != 4 {
+		t.Errorf("Expected group size 4 not %v", c.FECGroupSize())
+	}
+
+	for i := 0; i < 20; i++ {
+		c.handleFECReport([]byte{byte(systemFECReport), 0})
+	}
+
+	if c.FECGroupSize() != CfgFECMaxGroupSize {
+		t.Errorf("Expected max group size not %v", c.FECGroupSize())
+	}
+
+	c.SetFEC(0)
+	if c.FECGroupSize() != 0 {
+		t.Errorf("Expected disabled FEC not group size %v", c.FECGroupSize())
+	}
+}
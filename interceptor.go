@@ -0,0 +1,98 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import "errors"
+
+var (
+	// ErrMessageDropped is returned by the send methods of Connection if a send interceptor dropped the message.
+	ErrMessageDropped = errors.New("rmnp: message dropped by interceptor")
+
+	// ErrUnknownChannel is returned if a message should be sent on a channel that does not exist.
+	ErrUnknownChannel = errors.New("rmnp: unknown channel")
+)
+
+// Message is a packet passing through an interceptor chain. Interceptors may replace Data and Channel.
+type Message struct {
+	Connection *Connection
+	Channel    Channel
+	Data       []byte
+}
+
+// InterceptorFunc is called for every message sent or received by the application. It returns false to drop
+// the message. Following interceptors are not called for dropped messages.
+type InterceptorFunc func(*Message) bool
+
+func runInterceptors(chain []InterceptorFunc, message *Message) bool {
+	for _, interceptor := range chain {
+		if !interceptor(message) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func channelDescriptor(channel Channel) (descriptor, error) {
+	switch channel {
+	case ChannelUnreliable:
+		return 0, nil
+	case ChannelUnreliableOrdered:
+		return descOrdered, nil
+	case ChannelReliable:
+		return descReliable | descAck, nil
+	case ChannelReliableOrdered:
+		return descReliable | descAck | descOrdered, nil
+	}
+
+	return 0, ErrUnknownChannel
+}
+
+// sendMessage passes the data through the send interceptors before it is queued.
+func (c *Connection) sendMessage(channel Channel, data []byte) error {
+	if protocol := c.protocol; protocol != nil && protocol.sendInterceptors != nil {
+		if chain := protocol.sendInterceptors(); len(chain) > 0 {
+			message := &Message{Connection: c, Channel: channel, Data: data}
+			if !runInterceptors(chain, message) {
+				return ErrMessageDropped
+			}
+
+			channel, data = message.Channel, message.Data
+		}
+	}
+
+	if channel == ChannelUnreliableRedundant {
+		return c.sendRedundant(data)
+	}
+
+	desc, err := channelDescriptor(channel)
+	if err != nil {
+		return err
+	}
+
+	return c.sendHighLevelPacket(desc, data)
+}
+
+// receiveMessage passes the data through the receive interceptors before the packet callback is invoked.
+func (c *Connection) receiveMessage(channel Channel, data []byte) {
+	c.dispatch(func() {
+		c.deliverMessage(channel, data)
+	})
+}
+
+func (c *Connection) deliverMessage(channel Channel, data []byte) {
+	if c.protocol.receiveInterceptors != nil {
+		if chain := c.protocol.receiveInterceptors(); len(chain) > 0 {
+			message := &Message{Connection: c, Channel: channel, Data: data}
+			if !runInterceptors(chain, message) {
+				return
+			}
+
+			channel, data = message.Channel, message.Data
+		}
+	}
+
+	invokePacketCallback(c.protocol.onPacket, c, data, channel)
+}
@@ -0,0 +1,380 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// NAT punch-through works as follows:
+//  1. A host (a server behind NAT) registers itself with an id at the introducer and renews the registration
+//     every CfgIntroducerKeepAlive. The introducer learns the public address of the host.
+//  2. A client asks the introducer for the host's id. The introducer tells the host the public address of
+//     the client and the client the public address of the host.
+//  3. The host sends punch packets to the client so that its NAT accepts packets from the client while the
+//     client starts the normal connect handshake with the host. Connect packets that are dropped by the NAT
+//     before the host punched the hole are resent like every other reliable packet.
+
+var (
+	// ErrInvalidHostID is returned if a host id is empty, longer than 255 bytes or contains zero bytes.
+	ErrInvalidHostID = errors.New("rmnp: invalid host id")
+
+	// ErrHostNotFound is reported if no host is registered with the id at the introducer.
+	ErrHostNotFound = errors.New("rmnp: host is not registered at the introducer")
+
+	// ErrIntroductionTimeout is reported if the introducer did not answer within CfgTimeoutThreshold.
+	ErrIntroductionTimeout = errors.New("rmnp: introducer did not answer")
+
+	// ErrConnectedSocket is returned if a socket passed with WithSocket is connected but has to talk to
+	// multiple addresses.
+	ErrConnectedSocket = errors.New("rmnp: socket must not be connected")
+)
+
+const (
+	maxHostIDLength = 255
+
+	// ip (16) + port (2)
+	encodedAddrSize = 18
+
+	// milliseconds between two introduction requests of a client
+	introductionRetryInterval = 500
+
+	// amount of punch packets a host sends to a client
+	punchCount = 3
+
+	// nonce (4) + host address
+	introResponseSize = 4 + encodedAddrSize
+)
+
+func encodeAddr(addr *net.UDPAddr) []byte {
+	data := make([]byte, encodedAddrSize)
+	copy(data, addr.IP.To16())
+	binary.LittleEndian.PutUint16(data[16:], uint16(addr.Port))
+	return data
+}
+
+func decodeAddr(data []byte) *net.UDPAddr {
+	ip := make(net.IP, 16)
+	copy(ip, data[:16])
+
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	return &net.UDPAddr{IP: ip, Port: int(binary.LittleEndian.Uint16(data[16:]))}
+}
+
+// zero bytes are not allowed because introduction requests are padded with them
+func validHostID(id string) bool {
+	return len(id) > 0 && len(id) <= maxHostIDLength && strings.IndexByte(id, 0) < 0
+}
+
+// hostRegistry keeps the public addresses of all hosts registered at an introducer. An id belongs to the
+// address that registered it first until the registration expires so that others cannot take it over.
+type hostRegistry struct {
+	mutex sync.Mutex
+	hosts map[string]*registeredHost
+}
+
+type registeredHost struct {
+	addr     *net.UDPAddr
+	lastSeen int64
+}
+
+func newHostRegistry() *hostRegistry {
+	return &hostRegistry{hosts: make(map[string]*registeredHost)}
+}
+
+// register adds or renews the registration. It returns false if the id belongs to another address or if
+// CfgIntroducerMaxHosts are registered already.
+func (r *hostRegistry) register(id string, addr *net.UDPAddr, currentTime int64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if host, f := r.hosts[id]; f && !host.expired(currentTime) {
+		if !host.addr.IP.Equal(addr.IP) || host.addr.Port != addr.Port {
+			return false
+		}
+
+		host.lastSeen = currentTime
+		return true
+	}
+
+	if len(r.hosts) >= CfgIntroducerMaxHosts {
+		r.removeExpired(currentTime)
+
+		if len(r.hosts) >= CfgIntroducerMaxHosts {
+			return false
+		}
+	}
+
+	a := *addr
+	r.hosts[id] = &registeredHost{addr: &a, lastSeen: currentTime}
+	return true
+}
+
+func (r *hostRegistry) lookup(id string, currentTime int64) (*net.UDPAddr, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	host, f := r.hosts[id]
+	if !f || host.expired(currentTime) {
+		return nil, false
+	}
+
+	return host.addr, true
+}
+
+func (r *hostRegistry) prune(currentTime int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.removeExpired(currentTime)
+}
+
+// has to be called while holding the mutex
+func (r *hostRegistry) removeExpired(currentTime int64) {
+	for id, host := range r.hosts {
+		if host.expired(currentTime) {
+			delete(r.hosts, id)
+		}
+	}
+}
+
+func (h *registeredHost) expired(currentTime int64) bool {
+	return currentTime-h.lastSeen >= CfgIntroducerRegistrationTimeout
+}
+
+// hostRegistration is a registration of a server at an introducer.
+type hostRegistration struct {
+	introducer *net.UDPAddr
+	id         string
+	lastSent   int64
+}
+
+// RegisterHost registers the server with the id at the introducer so that clients behind NAT can connect to
+// it with Client.ConnectThroughIntroducer. The registration is renewed every CfgIntroducerKeepAlive until the
+// server stops. It has to be called after Start.
+func (s *Server) RegisterHost(introducer string, hostID string) error {
+	if !validHostID(hostID) {
+		return ErrInvalidHostID
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", introducer)
+	if err != nil {
+		return err
+	}
+
+	s.registrationMutex.Lock()
+	s.registrations = append(s.registrations, &hostRegistration{introducer: addr, id: hostID, lastSent: s.currentTime()})
+	s.registrationMutex.Unlock()
+
+	s.sendUnconnected(s.socket, addr, unconnectedIntroRegister, []byte(hostID))
+	return nil
+}
+
+// renewRegistrations is called periodically during housekeeping.
+func (s *Server) renewRegistrations(currentTime int64) {
+	s.registrationMutex.Lock()
+	defer s.registrationMutex.Unlock()
+
+	for _, r := range s.registrations {
+		if currentTime-r.lastSent >= CfgIntroducerKeepAlive {
+			r.lastSent = currentTime
+			s.sendUnconnected(s.socket, r.introducer, unconnectedIntroRegister, []byte(r.id))
+		}
+	}
+}
+
+func (s *Server) isIntroducer(addr *net.UDPAddr) bool {
+	s.registrationMutex.Lock()
+	defer s.registrationMutex.Unlock()
+
+	for _, r := range s.registrations {
+		if r.introducer.IP.Equal(addr.IP) && r.introducer.Port == addr.Port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleIntroduction answers requests of clients and punches holes for the clients it is introduced to. The
+// sources of all messages are unverified, therefore every answer is subject to the same amplification limit as
+// query responses.
+func (s *Server) handleIntroduction(socket *net.UDPConn, addr *net.UDPAddr, kind unconnectedKind, payload []byte,
+	requestSize int) {
+	switch kind {
+	case unconnectedIntroRegister:
+		if s.Introducer && validHostID(string(payload)) {
+			s.hosts.register(string(payload), addr, s.currentTime())
+		}
+	case unconnectedIntroRequest:
+		if !s.Introducer || len(payload) < 4 {
+			return
+		}
+
+		hostID := strings.TrimRight(string(payload[4:]), "\x00")
+		if !validHostID(hostID) {
+			return
+		}
+
+		if !allowResponse(unconnectedSize(introResponseSize), requestSize) {
+			atomic.AddUint64(&StatDroppedQueryResponses, 1)
+			return
+		}
+
+		response := make([]byte, 4, introResponseSize)
+		copy(response, payload[:4])
+
+		if host, f := s.hosts.lookup(hostID, s.currentTime()); f {
+			// the host is told first so that its punch packets are on their way as early as possible
+			s.sendUnconnected(socket, host, unconnectedIntroduce, padRequest(encodeAddr(addr), punchSize()))
+			response = append(response, encodeAddr(host)...)
+		}
+
+		s.sendUnconnected(socket, addr, unconnectedIntroResponse, response)
+	case unconnectedIntroduce:
+		// only introducers the server registered at are allowed to trigger punch packets
+		if len(payload) < encodedAddrSize || !s.isIntroducer(addr) {
+			return
+		}
+
+		client := decodeAddr(payload)
+
+		for i := 0; i < punchCount; i++ {
+			if !allowResponse((i+1)*unconnectedSize(0), requestSize) {
+				atomic.AddUint64(&StatDroppedQueryResponses, 1)
+				break
+			}
+
+			s.sendUnconnected(socket, client, unconnectedPunch, nil)
+		}
+	}
+}
+
+// introduction is the pending request of a client at an introducer.
+type introduction struct {
+	introducer *net.UDPAddr
+	hostID     string
+	data       []byte
+	nonce      [4]byte
+	started    int64
+	lastSent   int64
+}
+
+// ConnectThroughIntroducer connects to a host that registered with the id at the introducer (see
+// Server.RegisterHost) using NAT punch-through. This call is async. After the introducer answered the normal
+// connect handshake is started and ServerConnect or ServerTimeout are invoked as usual. If the host is not
+// registered or the introducer does not answer IntroductionFailed is called.
+func (c *Client) ConnectThroughIntroducer(introducer string, hostID string, data []byte) error {
+	if !validHostID(hostID) {
+		return ErrInvalidHostID
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", introducer)
+	if err != nil {
+		return err
+	}
+
+	// the socket has to talk to the introducer and the host, therefore it is not connected
+	socket, err := c.openSocket(false)
+	if err == nil && !c.unconnectedSocket {
+		err = ErrConnectedSocket
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.setSocket(socket, nil)
+	c.listen()
+	return c.introduce(addr, hostID, data)
+}
+
+func (c *Client) introduce(introducer *net.UDPAddr, hostID string, data []byte) error {
+	now := c.currentTime()
+	i := &introduction{introducer: introducer, hostID: hostID, data: data, started: now, lastSent: now}
+	if _, err := rand.Read(i.nonce[:]); err != nil {
+		return err
+	}
+
+	c.introductionMutex.Lock()
+	c.introduction = i
+	c.introductionMutex.Unlock()
+
+	c.sendIntroductionRequest(i)
+	return nil
+}
+
+// sendIntroductionRequest sends the request padded so that the introducer is allowed to answer it.
+func (c *Client) sendIntroductionRequest(i *introduction) {
+	payload := make([]byte, 0, 4+len(i.hostID))
+	payload = append(append(payload, i.nonce[:]...), i.hostID...)
+	c.sendUnconnected(c.socket, i.introducer, unconnectedIntroRequest,
+		padRequest(payload, unconnectedSize(introResponseSize)))
+}
+
+// punchSize is the size of all punch packets a host sends to a client.
+func punchSize() int {
+	return punchCount * unconnectedSize(0)
+}
+
+func (c *Client) handleIntroduction(socket *net.UDPConn, addr *net.UDPAddr, kind unconnectedKind, payload []byte,
+	requestSize int) {
+	if kind != unconnectedIntroResponse || len(payload) < 4 {
+		return
+	}
+
+	c.introductionMutex.Lock()
+	i := c.introduction
+	valid := i != nil && i.introducer.IP.Equal(addr.IP) && i.introducer.Port == addr.Port &&
+		string(i.nonce[:]) == string(payload[:4])
+	if valid {
+		c.introduction = nil
+	}
+	c.introductionMutex.Unlock()
+
+	if !valid {
+		return
+	}
+
+	if len(payload) != 4+encodedAddrSize {
+		c.failIntroduction(ErrHostNotFound)
+		return
+	}
+
+	c.connect(decodeAddr(payload[4:]), i.data)
+}
+
+// introductionTick resends the request of a pending introduction or gives up after CfgTimeoutThreshold.
+func (c *Client) introductionTick(currentTime int64) {
+	c.introductionMutex.Lock()
+	i := c.introduction
+	timeout := i != nil && currentTime-i.started >= int64(CfgTimeoutThreshold)
+	resend := i != nil && !timeout && currentTime-i.lastSent >= introductionRetryInterval
+	if timeout {
+		c.introduction = nil
+	} else if resend {
+		i.lastSent = currentTime
+	}
+	c.introductionMutex.Unlock()
+
+	if timeout {
+		c.failIntroduction(ErrIntroductionTimeout)
+	} else if resend {
+		c.sendIntroductionRequest(i)
+	}
+}
+
+func (c *Client) failIntroduction(err error) {
+	invokeErrorCallback(c.IntroductionFailed, err)
+	c.async(func() { c.destroy(DisconnectReasonLocalRequest) })
+}
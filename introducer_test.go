@@ -0,0 +1,98 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestHostRegistry(t *testing.T) {
+	defer func(max int) { CfgIntroducerMaxHosts = max }(CfgIntroducerMaxHosts)
+	CfgIntroducerMaxHosts = 2
+
+	r := newHostRegistry()
+	host := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+	other := &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1000}
+
+	if !r.register("a", host, 0) || !r.register("a", host, 100) {
+		t.Error("Expected host to register and renew its id")
+	}
+
+	if r.register("a", other, 200) {
+		t.Error("Expected id to belong to its first registrant")
+	}
+
+	if addr, f := r.lookup("a", 200); !f || addr.String() != host.String() {
+		t.Errorf("Expected id to still point to the host not %v", addr)
+	}
+
+	if !r.register("b", other, 200) || r.register("c", other, 200) {
+		t.Error("Expected registry to be limited to 2 hosts")
+	}
+
+	// after the registration expired the id can be taken by others and frees its slot
+	expired := 100 + CfgIntroducerRegistrationTimeout
+	if !r.register("a", other, expired) || !r.register("c", other, expired+100) {
+		t.Error("Expected expired registrations to be replaced")
+	}
+}
+
+func TestIntroductionAmplification(t *testing.T) {
+	defer func(factor int) { CfgQueryAmplificationFactor = factor }(CfgQueryAmplificationFactor)
+	CfgQueryAmplificationFactor = 1
+
+	var mutex sync.Mutex
+	var sizes []int
+
+	s := NewServer("127.0.0.1:0")
+	s.Introducer = true
+	s.writeFunc = func(conn *net.UDPConn, addr *net.UDPAddr, buffer []byte) {
+		mutex.Lock()
+		sizes = append(sizes, len(buffer))
+		mutex.Unlock()
+	}
+	s.Start()
+	defer s.Stop()
+
+	host := testAddr(1)
+	client := testAddr(2)
+	s.hosts.register("host", host, s.currentTime())
+
+	request := append([]byte{1, 2, 3, 4}, "host"...)
+	written := func() []int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		result := sizes
+		sizes = nil
+		return result
+	}
+
+	// an unpadded request is smaller than the response and gets no answer
+	s.handleIntroduction(s.socket, client, unconnectedIntroRequest, request, unconnectedSize(len(request)))
+	if w := written(); len(w) != 0 {
+		t.Errorf("Expected unpadded request to be dropped but %v datagrams were sent", len(w))
+	}
+
+	padded := padRequest(request, unconnectedSize(introResponseSize))
+	s.handleIntroduction(s.socket, client, unconnectedIntroRequest, padded, unconnectedSize(len(padded)))
+	w := written()
+	if len(w) != 2 {
+		t.Fatalf("Expected the host to be introduced and the client to be answered but got %v datagrams", len(w))
+	}
+
+	for _, size := range w {
+		if size > unconnectedSize(len(padded)) {
+			t.Errorf("Expected no datagram to exceed the request size of %v but got %v",
+				unconnectedSize(len(padded)), size)
+		}
+	}
+
+	// the introduce message is padded to allow all punch packets of the host
+	if w[0] < punchSize() {
+		t.Errorf("Expected introduce message to be at least %v bytes not %v", punchSize(), w[0])
+	}
+}
@@ -20,8 +20,14 @@ const (
 
 	descConnect
 	descDisconnect
+	descSession
+	descUnconnected
+	descSystem
 )
 
+// protocolId (1) + crc (4) + descriptor (1) + sequence (2) + order (1) + ack (2) + ackBits (4)
+const maxHeaderSize = 15
+
 type packet struct {
 	protocolID byte
 	crc32      uint32
@@ -41,75 +47,120 @@ type packet struct {
 	data []byte
 }
 
-func (p *packet) serialize() []byte {
-	s := NewSerializer()
+// size returns the amount of bytes needed to serialize the packet.
+func (p *packet) size() int {
+	return p.headerSize() + len(p.data)
+}
 
-	s.Write(p.protocolID)
-	s.Write(p.crc32)
-	s.Write(p.descriptor)
+func (p *packet) headerSize() int {
+	// protocolId (1) + crc (4) + descriptor (1)
+	size := 6
 
 	if p.flag(descReliable) || p.flag(descOrdered) {
-		s.Write(p.sequence)
+		// sequence (2)
+		size += 2
 	}
 
 	if p.flag(descReliable) && p.flag(descOrdered) {
-		s.Write(p.order)
+		// order (1)
+		size++
 	}
 
 	if p.flag(descAck) {
-		s.Write(p.ack)
-		s.Write(p.ackBits)
+		// ack (2) + ackBits (4)
+		size += 6
+	}
+
+	return size
+}
+
+func (p *packet) serialize() []byte {
+	buffer := make([]byte, p.size())
+	p.serializeTo(buffer)
+	return buffer
+}
+
+// serializeTo writes the packet into the buffer and returns the amount of written bytes.
+// The buffer has to be at least packet.size() bytes long.
+func (p *packet) serializeTo(buffer []byte) int {
+	n := p.serializeHeaderTo(buffer)
+	n += copy(buffer[n:], p.data)
+	return n
+}
+
+func (p *packet) serializeHeaderTo(buffer []byte) int {
+	buffer[0] = p.protocolID
+	binary.LittleEndian.PutUint32(buffer[1:5], p.crc32)
+	buffer[5] = byte(p.descriptor)
+	n := 6
+
+	if p.flag(descReliable) || p.flag(descOrdered) {
+		binary.LittleEndian.PutUint16(buffer[n:], uint16(p.sequence))
+		n += 2
 	}
 
-	if p.data != nil && len(p.data) > 0 {
-		s.Write(p.data)
+	if p.flag(descReliable) && p.flag(descOrdered) {
+		buffer[n] = byte(p.order)
+		n++
 	}
 
-	return s.Bytes()
+	if p.flag(descAck) {
+		binary.LittleEndian.PutUint16(buffer[n:], uint16(p.ack))
+		binary.LittleEndian.PutUint32(buffer[n+2:], p.ackBits)
+		n += 6
+	}
+
+	return n
 }
 
+// deserialize reads the packet from the buffer. The packet's data references the
+// buffer instead of copying it so the buffer must not be reused afterwards.
 func (p *packet) deserialize(packet []byte) bool {
-	s := NewSerializerFor(packet)
-
 	// head is valid (validated before data processing)
-	s.Read(&p.protocolID)
-	s.Read(&p.crc32)
-	s.Read(&p.descriptor)
+	if len(packet) < 6 {
+		return false
+	}
+
+	p.protocolID = packet[0]
+	p.crc32 = binary.LittleEndian.Uint32(packet[1:5])
+	p.descriptor = descriptor(packet[5])
+
+	n := p.headerSize()
+	if len(packet) < n {
+		return false
+	}
+
+	n = 6
 
 	if p.flag(descReliable) || p.flag(descOrdered) {
-		if s.Read(&p.sequence) != nil {
-			return false
-		}
+		p.sequence = sequenceNumber(binary.LittleEndian.Uint16(packet[n:]))
+		n += 2
 	}
 
 	if p.flag(descReliable) && p.flag(descOrdered) {
-		if s.Read(&p.order) != nil {
-			return false
-		}
+		p.order = orderNumber(packet[n])
+		n++
 	}
 
 	if p.flag(descAck) {
-		if s.Read(&p.ack) != nil {
-			return false
-		}
-
-		if s.Read(&p.ackBits) != nil {
-			return false
-		}
+		p.ack = sequenceNumber(binary.LittleEndian.Uint16(packet[n:]))
+		p.ackBits = binary.LittleEndian.Uint32(packet[n+2:])
+		n += 6
 	}
 
-	if size := s.RemainingSize(); size > 0 {
-		p.data = make([]byte, size)
-		s.Read(&p.data)
+	if len(packet) > n {
+		p.data = packet[n:]
 	}
 
 	return true
 }
 
 func (p *packet) calculateHash() {
+	var header [maxHeaderSize]byte
+
 	p.crc32 = 0
-	buffer := p.serialize()
-	p.crc32 = crc32.ChecksumIEEE(buffer)
+	n := p.serializeHeaderTo(header[:])
+	p.crc32 = crc32.Update(crc32.ChecksumIEEE(header[:n]), crc32.IEEETable, p.data)
 }
 
 func (p *packet) flag(flag descriptor) bool {
@@ -117,6 +168,11 @@ func (p *packet) flag(flag descriptor) bool {
 }
 
 func validateHeader(packet []byte) bool {
+	return validateHeaderSize(packet) && validateHash(packet)
+}
+
+// validateHeaderSize only does the cheap checks of validateHeader.
+func validateHeaderSize(packet []byte) bool {
 	// 1b protocolId + 4b crc32 + 1b descriptor
 	if len(packet) < 6 {
 		return false
@@ -126,13 +182,27 @@ func validateHeader(packet []byte) bool {
 		return false
 	}
 
-	if len(packet) < headerSize(packet) {
-		return false
-	}
+	return len(packet) >= headerSize(packet)
+}
+
+func validateHash(packet []byte) bool {
+	return binary.LittleEndian.Uint32(packet[1:5]) == packetHash(packet)
+}
+
+var emptyHash [4]byte
+
+// packetHash calculates the hash of a serialized packet as if its crc field was zero.
+func packetHash(packet []byte) uint32 {
+	hash := crc32.Update(0, crc32.IEEETable, packet[:1])
+	hash = crc32.Update(hash, crc32.IEEETable, emptyHash[:])
+	return crc32.Update(hash, crc32.IEEETable, packet[5:])
+}
 
-	hash1 := binary.LittleEndian.Uint32(packet[1:5])
-	hash2 := crc32.ChecksumIEEE(append([]byte{packet[0], 0, 0, 0, 0}, packet[5:]...))
-	return hash1 == hash2
+// writeHash calculates the hash of a serialized packet and stores it in its crc field.
+func writeHash(packet []byte) uint32 {
+	hash := packetHash(packet)
+	binary.LittleEndian.PutUint32(packet[1:5], hash)
+	return hash
 }
 
 func headerSize(packet []byte) int {
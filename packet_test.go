@@ -4,7 +4,10 @@
 
 package rmnp
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
 
 var testPacketDescriptors = map[descriptor]int{
 	0:                          6,
@@ -145,3 +148,61 @@ func TestPacketHeaderSize(t *testing.T) {
 		}
 	}
 }
+
+func BenchmarkPacketSerialize(b *testing.B) {
+	p := newTestPacket()
+	p.data = make([]byte, 256)
+	buffer := make([]byte, CfgMTU)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		length := p.serializeTo(buffer)
+		p.crc32 = writeHash(buffer[:length])
+	}
+}
+
+func BenchmarkPacketDeserialize(b *testing.B) {
+	p := newTestPacket()
+	p.data = make([]byte, 256)
+	buffer := p.serialize()
+	writeHash(buffer)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var d packet
+
+		if !validateHeader(buffer) || !d.deserialize(buffer) {
+			b.Fatal("Expected packet to be valid")
+		}
+	}
+}
+
+func BenchmarkPacketHandle(b *testing.B) {
+	s := NewServer("127.0.0.1:0")
+	s.writeFunc = func(*net.UDPConn, *net.UDPAddr, []byte) {}
+	s.scheduler = newManualScheduler(1, CfgClock)
+	s.Start()
+	defer s.Stop()
+
+	addr := testAddr(1)
+	s.connectClient(s.socket, addr, nil, false).setState(stateConnected)
+
+	// an ack without payload and a message whose payload is copied for the callback
+	ack := &packet{protocolID: CfgProtocolID, descriptor: descAck}
+	ack.calculateHash()
+	message := &packet{protocolID: CfgProtocolID, data: make([]byte, 256)}
+	message.calculateHash()
+	datagrams := [][]byte{ack.serialize(), message.serialize()}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s.handlePacket(s.socket, addr, datagrams[i%2])
+		s.scheduler.tick()
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	// ErrPeerNotStarted is returned if a peer connects before it was started.
+	ErrPeerNotStarted = errors.New("rmnp: peer is not started")
+
+	// ErrConnectPending is returned if a peer connects to an address that is connecting to it at the same time
+	// or if too many handshakes are pending. The inbound connection is reported by PeerConnect.
+	ErrConnectPending = errors.New("rmnp: connection attempt is pending")
+)
+
+// Peer is a rmnp endpoint that listens for inbound connections and connects to other peers using a single
+// socket. Inbound and outbound connections behave the same and share all callbacks.
+type Peer struct {
+	protocolImpl
+
+	// PeerConnect is called when a connection to another peer was established (inbound or outbound).
+	PeerConnect ConnectionCallback
+
+	// PeerDisconnect is called when a connection to another peer was closed. The reason tells why.
+	PeerDisconnect DisconnectCallback
+
+	// PeerTimeout is called when a connection to another peer timed out.
+	PeerTimeout ConnectionCallback
+
+	// PeerValidation is called when another peer connects to validate its connection.
+	// True means the connection is valid.
+	PeerValidation ValidationCallback
+
+	// PacketHandler is called when packets arrive to handle the received data.
+	PacketHandler PacketCallback
+
+	// SnapshotHandler is called with every snapshot sent by another peer using Connection.SendSnapshot that is newer
+	// than the previous one.
+	SnapshotHandler ConnectionCallback
+
+	// PeerOverflow is called when a packet is pushed into one of a connection's full queues.
+	PeerOverflow OverflowCallback
+
+	// SendInterceptors see every message sent with one of the send methods of a connection before it is
+	// queued. ReceiveInterceptors see every received message before PacketHandler is called. Both have to be
+	// set before Start.
+	SendInterceptors    []InterceptorFunc
+	ReceiveInterceptors []InterceptorFunc
+}
+
+// NewPeer creates and returns a new Peer instance that will listen on the
+// specified address and port. It does not start automatically.
+func NewPeer(address string) *Peer {
+	p := new(Peer)
+
+	p.readFunc = func(conn *net.UDPConn, buffer []byte) (int, *net.UDPAddr, bool) {
+		if b := p.batch(conn); b != nil {
+			return b.read(buffer)
+		}
+
+		length, addr, err := conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			return 0, nil, false
+		}
+
+		return length, addr, true
+	}
+
+	p.writeFunc = func(conn *net.UDPConn, addr *net.UDPAddr, buffer []byte) {
+		if b := p.batch(conn); b != nil {
+			b.write(addr, buffer)
+			return
+		}
+
+		conn.WriteToUDP(buffer, addr)
+	}
+
+	p.onConnect = func(connection *Connection, packet []byte) {
+		if p.PeerConnect != nil {
+			p.PeerConnect(connection, packet)
+		}
+	}
+
+	p.onDisconnect = func(connection *Connection, reason DisconnectReason, packet []byte) {
+		if p.PeerDisconnect != nil {
+			p.PeerDisconnect(connection, reason, packet)
+		}
+	}
+
+	p.onTimeout = func(connection *Connection, packet []byte) {
+		if p.PeerTimeout != nil {
+			p.PeerTimeout(connection, packet)
+		}
+	}
+
+	p.onValidation = func(addr *net.UDPAddr, packet []byte) bool {
+		if p.PeerValidation != nil {
+			return p.PeerValidation(addr, packet)
+		}
+
+		return true
+	}
+
+	p.onPacket = func(connection *Connection, packet []byte, channel Channel) {
+		if p.PacketHandler != nil {
+			p.PacketHandler(connection, packet, channel)
+		}
+	}
+
+	p.onSnapshot = func(connection *Connection, snapshot []byte) {
+		if p.SnapshotHandler != nil {
+			p.SnapshotHandler(connection, snapshot)
+		}
+	}
+
+	p.onOverflow = func(connection *Connection, queue Queue) {
+		if p.PeerOverflow != nil {
+			p.PeerOverflow(connection, queue)
+		}
+	}
+
+	p.sendInterceptors = func() []InterceptorFunc {
+		return p.SendInterceptors
+	}
+
+	p.receiveInterceptors = func() []InterceptorFunc {
+		return p.ReceiveInterceptors
+	}
+
+	p.init(address)
+	return p
+}
+
+// Start starts the peer asynchronously. It invokes no callbacks but
+// the peer is guaranteed to be running after this call.
+func (p *Peer) Start() {
+	p.setSocket(net.ListenUDP("udp", p.address))
+	p.listen()
+}
+
+// Connect connects to another peer. This call is async. The returned Connection can already be used to send
+// packets which are delivered as soon as the connection is established. On successful connection
+// Peer.PeerConnect is invoked. If there already is a connection to the address it is returned instead.
+func (p *Peer) Connect(address string) (*Connection, error) {
+	return p.ConnectWithData(address, nil)
+}
+
+// ConnectWithData does the same as Connect but also sends custom data to the other peer that can
+// be validated in its PeerValidation callback or during the PeerConnect callback.
+func (p *Peer) ConnectWithData(address string, data []byte) (*Connection, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.ctx == nil {
+		return nil, ErrPeerNotStarted
+	}
+
+	hash := addrHash(addr)
+
+	// guards against an inbound connection from the address that is created concurrently
+	if !p.connectGuard.tryExecute(hash, p.currentTime()) {
+		if connection, exists := p.connections.get(p.socket, hash); exists {
+			return connection, nil
+		}
+
+		return nil, ErrConnectPending
+	}
+
+	defer p.connectGuard.finish(hash)
+
+	if connection, exists := p.connections.get(p.socket, hash); exists {
+		return connection, nil
+	}
+
+	// the other peer acts as server of this connection
+	return p.connectClient(p.socket, addr, data, true), nil
+}
+
+// Stop stops the peer and disconnects all connections. The other peers receive DisconnectReasonRemoteRequest.
+// It invokes no callbacks. This call could take some time because it waits for goroutines to exit.
+func (p *Peer) Stop() {
+	p.destroy(DisconnectReasonLocalRequest)
+}
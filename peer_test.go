@@ -0,0 +1,76 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeerSharedSocket(t *testing.T) {
+	a := NewPeer("127.0.0.1:0")
+	a.Start()
+	defer a.Stop()
+
+	received := make(chan string, 2)
+	peers := make([]*Peer, 2)
+
+	for i := range peers {
+		peers[i] = NewPeer("127.0.0.1:0")
+		peers[i].PacketHandler = func(c *Connection, data []byte, channel Channel) {
+			received <- string(data)
+		}
+		peers[i].Start()
+		defer peers[i].Stop()
+
+		c, err := a.Connect(peers[i].socket.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.SendReliableOrdered([]byte("hello"))
+	}
+
+	for i := 0; i < len(peers); i++ {
+		select {
+		case data := <-received:
+			if data != "hello" {
+				t.Errorf("Expected hello not %q", data)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected both peers to receive the packet")
+		}
+	}
+
+	if n := a.connections.len(); n != 2 {
+		t.Errorf("Expected 2 outbound connections on one socket not %v", n)
+	}
+}
+
+func TestPeerConnectGuard(t *testing.T) {
+	a := NewPeer("127.0.0.1:0")
+	a.Start()
+	defer a.Stop()
+
+	addr := testAddr(1)
+
+	// an inbound handshake from the address is in progress
+	a.connectGuard.tryExecute(addrHash(addr), a.currentTime())
+
+	if _, err := a.Connect(addr.String()); err != ErrConnectPending {
+		t.Errorf("Expected pending connect not %v", err)
+	}
+
+	a.connectGuard.finish(addrHash(addr))
+
+	c, err := a.Connect(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := a.Connect(addr.String()); again != c || a.connectGuard.len() != 0 {
+		t.Error("Expected existing connection to be returned and the guard to be released")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RateLimitAction defines what happens when a connection exceeds CfgMaxPacketsPerSecond or CfgMaxBytesPerSecond.
+type RateLimitAction byte
+
+const (
+	// RateLimitDrop drops the packets that exceed the limits.
+	RateLimitDrop RateLimitAction = iota
+
+	// RateLimitWarn only invokes the rate limit callback (at most once per second per connection).
+	// The packets are still processed.
+	RateLimitWarn
+
+	// RateLimitDisconnect drops the packet and disconnects the connection with DisconnectReasonRateLimited.
+	RateLimitDisconnect
+)
+
+// tokenBucket allows rate tokens per second with a burst of one second worth of tokens.
+type tokenBucket struct {
+	tokens float64
+	last   int64
+}
+
+// take has to be synchronized by the caller. A rate of 0 or less never limits.
+func (b *tokenBucket) take(amount, rate float64, currentTime int64) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	b.tokens += rate * float64(currentTime-b.last) / 1000
+	b.last = currentTime
+
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+
+	if b.tokens < amount {
+		return false
+	}
+
+	b.tokens -= amount
+	return true
+}
+
+// rateLimiter limits the inbound traffic of one connection or of all unconnected addresses.
+type rateLimiter struct {
+	mutex    sync.Mutex
+	packets  tokenBucket
+	bytes    tokenBucket
+	lastWarn int64
+}
+
+func (l *rateLimiter) allow(size int, packetsPerSecond, bytesPerSecond float64, currentTime int64) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// both buckets are always updated so that one does not refill while the other one is empty
+	packets := l.packets.take(1, packetsPerSecond, currentTime)
+	bytes := l.bytes.take(float64(size), bytesPerSecond, currentTime)
+
+	return packets && bytes
+}
+
+// shouldWarn returns true at most once per second.
+func (l *rateLimiter) shouldWarn(currentTime int64) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.lastWarn != 0 && currentTime-l.lastWarn < 1000 {
+		return false
+	}
+
+	l.lastWarn = currentTime
+	return true
+}
+
+func (l *rateLimiter) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.packets = tokenBucket{}
+	l.bytes = tokenBucket{}
+	l.lastWarn = 0
+}
+
+// checkRateLimit applies the per-connection limits. It returns false if the packet has to be dropped.
+func (impl *protocolImpl) checkRateLimit(connection *Connection, packet []byte) bool {
+	if CfgMaxPacketsPerSecond <= 0 && CfgMaxBytesPerSecond <= 0 {
+		return true
+	}
+
+	now := impl.currentTime()
+
+	if connection.rateLimiter.allow(len(packet), CfgMaxPacketsPerSecond, CfgMaxBytesPerSecond, now) {
+		return true
+	}
+
+	atomic.AddUint64(&StatRateLimitedPackets, 1)
+
+	switch CfgRateLimitAction {
+	case RateLimitWarn:
+		if connection.rateLimiter.shouldWarn(now) {
+			invokeConnectionCallback(impl.onRateLimit, connection, nil)
+		}
+
+		return true
+	case RateLimitDisconnect:
+		// limits the amount of goroutines during a flood
+		if connection.rateLimiter.shouldWarn(now) {
+			impl.async(func() {
+				impl.disconnectClient(connection, DisconnectReasonRateLimited, nil)
+			})
+		}
+	}
+
+	return false
+}
+
+// checkUnconnectedRateLimit applies the global limits for addresses without connection.
+func (impl *protocolImpl) checkUnconnectedRateLimit(packet []byte) bool {
+	if CfgMaxUnconnectedPacketsPerSecond <= 0 && CfgMaxUnconnectedBytesPerSecond <= 0 {
+		return true
+	}
+
+	if impl.unconnectedLimiter.allow(len(packet), CfgMaxUnconnectedPacketsPerSecond, CfgMaxUnconnectedBytesPerSecond, impl.currentTime()) {
+		return true
+	}
+
+	atomic.AddUint64(&StatRateLimitedPackets, 1)
+	return false
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import "testing"
+
+func TestRateLimitTokenBucket(t *testing.T) {
+	var b tokenBucket
+
+	for i := 0; i < 10; i++ {
+		if !b.take(1, 10, 1000) {
+			t.Fatalf("Expected burst of 10 tokens but failed at %v", i)
+		}
+	}
+
+	if b.take(1, 10, 1000) {
+		t.Error("Expected bucket to be empty")
+	}
+
+	if !b.take(1, 10, 1100) || b.take(1, 10, 1100) {
+		t.Error("Expected exactly one token after 100ms")
+	}
+
+	if !b.take(10, 10, 5000) || b.take(1, 10, 5000) {
+		t.Error("Expected refill to be capped at one second worth of tokens")
+	}
+
+	if !b.take(1000, 0, 5000) {
+		t.Error("Expected rate 0 not to limit")
+	}
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	var l rateLimiter
+
+	if !l.allow(600, 100, 1000, 1000) || l.allow(600, 100, 1000, 1000) {
+		t.Error("Expected byte limit to be enforced")
+	}
+
+	if !l.shouldWarn(1000) || l.shouldWarn(1500) || !l.shouldWarn(2000) {
+		t.Error("Expected warnings at most once per second")
+	}
+}
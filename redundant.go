@@ -0,0 +1,118 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import "encoding/binary"
+
+// redundant: kind (1) + sequence of the newest message (2) + message count (1) + messages from oldest to
+// newest, each prefixed with its length as uvarint
+const redundantHeaderSize = 4
+
+// redundantMessage is a message that is repeated in the following datagrams of ChannelUnreliableRedundant.
+type redundantMessage struct {
+	sequence sequenceNumber
+	data     []byte
+}
+
+// redundantSender keeps the last CfgRedundantMessageCount messages.
+type redundantSender struct {
+	messages     []redundantMessage
+	nextSequence sequenceNumber
+}
+
+// redundantReceiver remembers the newest delivered message.
+type redundantReceiver struct {
+	last    sequenceNumber
+	hasLast bool
+}
+
+// SendUnreliableRedundant sends the data unreliably together with the previous CfgRedundantMessageCount - 1
+// messages of this channel. The receiver gets every message exactly once and in order as soon as one datagram
+// containing it arrives. Messages are only lost if all datagrams containing them are lost. Older messages are
+// left out if the datagram would exceed CfgMTU.
+func (c *Connection) SendUnreliableRedundant(data []byte) error {
+	return c.sendMessage(ChannelUnreliableRedundant, data)
+}
+
+func (c *Connection) sendRedundant(data []byte) error {
+	c.redundantMutex.Lock()
+	defer c.redundantMutex.Unlock()
+
+	s := &c.redundantSender
+	s.messages = append(s.messages, redundantMessage{s.nextSequence, append([]byte(nil), data...)})
+	s.nextSequence++
+
+	count := CfgRedundantMessageCount
+	if count < 1 {
+		count = 1
+	}
+
+	if len(s.messages) > count {
+		s.messages = append(s.messages[:0], s.messages[len(s.messages)-count:]...)
+	}
+
+	// always include the newest message, older ones only as long as they fit
+	header := systemPacketHeaderSize()
+	first, size := len(s.messages)-1, redundantHeaderSize+redundantMessageSize(data)
+	for first > 0 && len(s.messages)-first < 255 {
+		next := size + redundantMessageSize(s.messages[first-1].data)
+		if header+next > CfgMTU {
+			break
+		}
+
+		first, size = first-1, next
+	}
+
+	messages := s.messages[first:]
+	serializer := NewSerializer()
+	serializer.Write(byte(systemRedundant))
+	serializer.Write(uint16(messages[len(messages)-1].sequence))
+	serializer.Write(byte(len(messages)))
+
+	for _, message := range messages {
+		serializer.WriteBytes(message.data)
+	}
+
+	return c.sendHighLevelPacket(descSystem, serializer.Bytes())
+}
+
+func redundantMessageSize(data []byte) int {
+	var buffer [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buffer[:], uint64(len(data))) + len(data)
+}
+
+func (c *Connection) handleRedundant(data []byte) {
+	newest := sequenceNumber(binary.LittleEndian.Uint16(data[1:3]))
+	serializer := NewSerializerFor(data[redundantHeaderSize:])
+
+	messages := make([][]byte, data[3])
+	for i := range messages {
+		message, err := serializer.ReadBytes()
+		if err != nil {
+			return
+		}
+
+		messages[i] = message
+	}
+
+	var deliver [][]byte
+
+	c.redundantMutex.Lock()
+	r := &c.redundantReceiver
+	for i, message := range messages {
+		sequence := newest - sequenceNumber(len(messages)-1-i)
+		if !r.hasLast || greaterThanSequence(sequence, r.last) {
+			r.last, r.hasLast = sequence, true
+			deliver = append(deliver, message)
+		}
+	}
+	c.redundantMutex.Unlock()
+
+	for _, message := range deliver {
+		if len(message) > 0 {
+			c.receiveMessage(ChannelUnreliableRedundant, message)
+		}
+	}
+}
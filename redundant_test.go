@@ -0,0 +1,103 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func encodeRedundant(newest sequenceNumber, messages ...[]byte) []byte {
+	serializer := NewSerializer()
+	serializer.Write(byte(systemRedundant))
+	serializer.Write(uint16(newest))
+	serializer.Write(byte(len(messages)))
+
+	for _, message := range messages {
+		serializer.WriteBytes(message)
+	}
+
+	return serializer.Bytes()
+}
+
+func newRedundantConnection(received *[][]byte) *Connection {
+	impl := new(protocolImpl)
+	impl.onPacket = func(connection *Connection, packet []byte, channel Channel) {
+		*received = append(*received, packet)
+	}
+
+	c := newConnection()
+	c.init(impl, nil, testAddr(1))
+	return c
+}
+
+func TestRedundantWrap(t *testing.T) {
+	var received [][]byte
+	c := newRedundantConnection(&received)
+
+	tests := []struct {
+		data     []byte
+		expected []string
+	}{
+		{encodeRedundant(65534, []byte("a"), []byte("b")), []string{"a", "b"}},
+		// 65534 was delivered already, 65535 and 0 are new although 0 is numerically smaller
+		{encodeRedundant(0, []byte("b"), []byte("c"), []byte("d")), []string{"c", "d"}},
+		{encodeRedundant(1, []byte("d"), []byte("e")), []string{"e"}},
+		// a delayed datagram from before the wrap contains nothing new
+		{encodeRedundant(65535, []byte("b"), []byte("c")), nil},
+	}
+
+	for i, test := range tests {
+		received = nil
+		c.handleRedundant(test.data)
+
+		if len(received) != len(test.expected) {
+			t.Errorf("Datagram %v: expected %q not %q", i, test.expected, received)
+			continue
+		}
+
+		for j, message := range received {
+			if !bytes.Equal(message, []byte(test.expected[j])) {
+				t.Errorf("Datagram %v: expected %q not %q", i, test.expected, received)
+				break
+			}
+		}
+	}
+}
+
+func TestRedundantMalformed(t *testing.T) {
+	var received [][]byte
+	c := newRedundantConnection(&received)
+
+	malformed := [][]byte{
+		// count of 2 but only one message
+		{byte(systemRedundant), 5, 0, 2, 1, 'a'},
+		// length exceeds the datagram
+		{byte(systemRedundant), 5, 0, 1, 5, 'a'},
+		// unterminated uvarint length
+		{byte(systemRedundant), 5, 0, 1, 0x80},
+		// zero messages
+		{byte(systemRedundant), 5, 0, 0},
+		{byte(systemRedundant), 5, 0, 0, 1, 'a'},
+	}
+
+	for _, data := range malformed {
+		c.handleRedundant(data)
+	}
+
+	if len(received) != 0 {
+		t.Errorf("Expected no messages to be delivered not %q", received)
+	}
+
+	// rejected datagrams must not advance the newest sequence
+	if c.redundantReceiver.hasLast {
+		t.Errorf("Expected no sequence to be recorded not %v", c.redundantReceiver.last)
+	}
+
+	c.handleRedundant(encodeRedundant(3, []byte("a")))
+	if len(received) != 1 {
+		t.Errorf("Expected valid message to be delivered after malformed ones not %q", received)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package rmnp
+
+import "syscall"
+
+// SO_REUSEPORT is not exported by the syscall package for all linux architectures
+const soReusePort = 0xf
+
+const reusePortSupported = true
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+
+	controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+
+	if controlErr != nil {
+		return controlErr
+	}
+
+	return err
+}
@@ -0,0 +1,39 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || ppc64 || ppc64le || riscv64 || s390x)
+
+package rmnp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	sockets, err := listenReusePort(addr, 4)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		for _, socket := range sockets {
+			socket.Close()
+		}
+	}()
+
+	if len(sockets) != 4 {
+		t.Fatalf("Expected 4 sockets not %v", len(sockets))
+	}
+
+	port := sockets[0].LocalAddr().(*net.UDPAddr).Port
+
+	for _, socket := range sockets {
+		if p := socket.LocalAddr().(*net.UDPAddr).Port; p != port {
+			t.Errorf("Expected all sockets to be bound to port %v not %v", port, p)
+		}
+	}
+}
@@ -21,12 +21,27 @@ type ValidationCallback func(*net.UDPAddr, []byte) bool
 // PacketCallback is the function called when a packet is received
 type PacketCallback func(*Connection, []byte, Channel)
 
+// DisconnectCallback is the function called when a connection is closed
+type DisconnectCallback func(*Connection, DisconnectReason, []byte)
+
+// OverflowCallback is the function called when one of a connection's queues overflows
+type OverflowCallback func(*Connection, Queue)
+
+// ErrorCallback is the function called when an asynchronous operation failed
+type ErrorCallback func(error)
+
 func invokeConnectionCallback(callback ConnectionCallback, connection *Connection, packet []byte) {
 	if callback != nil {
 		callback(connection, packet)
 	}
 }
 
+func invokeDisconnectCallback(callback DisconnectCallback, connection *Connection, reason DisconnectReason, packet []byte) {
+	if callback != nil {
+		callback(connection, reason, packet)
+	}
+}
+
 func invokeValidationCallback(callback ValidationCallback, addr *net.UDPAddr, packet []byte) bool {
 	if callback != nil {
 		return callback(addr, packet)
@@ -41,44 +56,83 @@ func invokePacketCallback(callback PacketCallback, connection *Connection, packe
 	}
 }
 
+func invokeOverflowCallback(callback OverflowCallback, connection *Connection, queue Queue) {
+	if callback != nil {
+		callback(connection, queue)
+	}
+}
+
+func invokeErrorCallback(callback ErrorCallback, err error) {
+	if callback != nil {
+		callback(err)
+	}
+}
+
 // ReadFunc is the function called to write information to a udp connection
 type ReadFunc func(*net.UDPConn, []byte) (int, *net.UDPAddr, bool)
 
 // WriteFunc is the function called to read information from a udp connection
 type WriteFunc func(*net.UDPConn, *net.UDPAddr, []byte)
 
-type disconnectType byte
-
-const (
-	disconnectTypeDefault  disconnectType = iota
-	disconnectTypeShutdown
-	disconnectTypeTimeout
-)
-
 type protocolImpl struct {
 	address *net.UDPAddr
 	socket  *net.UDPConn
+	sockets []*net.UDPConn
 
 	ctx       context.Context
 	cancel    context.CancelFunc
 	waitGroup sync.WaitGroup
 
-	connectGuard     *execGuard
-	connectionsMutex sync.RWMutex
-	connections      map[uint32]*Connection
-	readFunc         ReadFunc
-	writeFunc        WriteFunc
+	connectGuard *execGuard
+	connections  *connectionMap
+	scheduler    *scheduler
+	readFunc     ReadFunc
+	writeFunc    WriteFunc
+	batches      map[*net.UDPConn]*batchIO
+	simulation   *Simulation
+	clock        Clock
+	closing      int32
+
+	// sessions are only issued if acceptSessions is set (servers)
+	sessions       *sessionStore
+	acceptSessions bool
+
+	// limits the traffic of all addresses without connection
+	unconnectedLimiter rateLimiter
+
+	// only set for servers
+	admission   *admissionControl
+	onFilter    func(*net.UDPConn, *net.UDPAddr, []byte) bool
+	onQuery     QueryCallback
+	onDiscovery QueryCallback
+
+	// handles all unconnected messages of the NAT punch-through (see introducer.go)
+	onIntroduction func(*net.UDPConn, *net.UDPAddr, unconnectedKind, []byte, int)
+
+	rpc rpcRegistry
+
+	// return the interceptor chains of servers, clients and peers
+	sendInterceptors    func() []InterceptorFunc
+	receiveInterceptors func() []InterceptorFunc
 
-	bufferPool     sync.Pool
-	connectionPool sync.Pool
+	bufferPool sync.Pool
 
 	// callbacks
 	// for clients: only executed if client is still connected. if client disconnects callback will not be executed.
 	onConnect    ConnectionCallback
-	onDisconnect ConnectionCallback
+	onDisconnect DisconnectCallback
 	onTimeout    ConnectionCallback
 	onValidation ValidationCallback
 	onPacket     PacketCallback
+	onOverflow   OverflowCallback
+	onReconnect  ConnectionCallback
+	onRateLimit  ConnectionCallback
+	onSnapshot   ConnectionCallback
+
+	// onDetach decides whether a lost connection is detached instead of disconnected and until when
+	// it is kept (0 = forever). onTick is called periodically during housekeeping.
+	onDetach func(*Connection, DisconnectReason) (bool, int64)
+	onTick   func(int64)
 }
 
 func (impl *protocolImpl) init(address string) {
@@ -86,62 +140,137 @@ func (impl *protocolImpl) init(address string) {
 	checkError("Failed to resolve udp address", err)
 
 	impl.address = addr
-	impl.connectGuard = newExecGuard()
-	impl.connections = make(map[uint32]*Connection)
+	impl.connectGuard = newExecGuard(CfgMaxPendingHandshakes, int64(CfgTimeoutThreshold))
+	impl.sessions = newSessionStore()
 
-	impl.bufferPool = sync.Pool{
-		New: func() interface{} { return make([]byte, CfgMTU) },
+	// lookups are done by the listeners and the scheduler workers of every socket
+	shardCount := CfgParallelListenerCount
+	if CfgSchedulerWorkerCount > shardCount {
+		shardCount = CfgSchedulerWorkerCount
 	}
+	impl.connections = newConnectionMap(shardCount)
 
-	impl.connectionPool = sync.Pool{
-		New: func() interface{} { return newConnection() },
+	impl.bufferPool = sync.Pool{
+		New: func() interface{} {
+			buffer := make([]byte, CfgMTU)
+			return &buffer
+		},
 	}
+
 }
 
-// is blocking call!
-func (impl *protocolImpl) destroy() {
+// is blocking call! the reason is sent to all remaining connections but no callbacks are invoked.
+func (impl *protocolImpl) destroy(reason DisconnectReason) {
 	if impl.address == nil {
 		return
 	}
 
-	impl.connectionsMutex.Lock()
-	for _, conn := range impl.connections {
-		impl.disconnectClient(conn, disconnectTypeShutdown, nil)
-	}
-	impl.connectionsMutex.Unlock()
-
+	// the listeners are stopped first, otherwise they could still create connections
 	impl.cancel()
 	impl.waitGroup.Wait()
-	impl.socket.Close()
+
+	impl.connections.each(func(conn *Connection) {
+		impl.closeConnection(conn, reason, nil, false)
+	})
+
+	for _, conn := range impl.sessions.all() {
+		impl.releaseDetached(conn, reason, false)
+	}
+
+	for _, socket := range impl.sockets {
+		socket.Close()
+	}
+
+	if impl.scheduler != nil {
+		impl.scheduler.stop()
+		impl.scheduler = nil
+	}
 
 	impl.address = nil
 	impl.socket = nil
+	impl.sockets = nil
+	impl.batches = nil
 	impl.ctx = nil
 	impl.cancel = nil
+	impl.simulation = nil
+	impl.clock = nil
 
 	impl.connectGuard = nil
 	impl.connections = nil
+	impl.sessions = nil
 }
 
 func (impl *protocolImpl) setSocket(socket *net.UDPConn, err error) {
 	checkError("Error creating socket", err)
-	impl.socket = socket
-	impl.socket.SetReadBuffer(CfgMTU)
-	impl.socket.SetWriteBuffer(CfgMTU)
+	impl.setSockets([]*net.UDPConn{socket}, nil)
+}
+
+func (impl *protocolImpl) setSockets(sockets []*net.UDPConn, err error) {
+	checkError("Error creating sockets", err)
+	impl.socket = sockets[0]
+	impl.sockets = sockets
+
+	for _, socket := range sockets {
+		socket.SetReadBuffer(CfgMTU)
+		socket.SetWriteBuffer(CfgMTU)
+	}
 }
 
 func (impl *protocolImpl) listen() {
 	impl.ctx, impl.cancel = context.WithCancel(context.Background())
+	impl.enableBatching()
+
+	// simulations set their own manual scheduler
+	if impl.scheduler == nil && CfgSchedulerWorkerCount > 0 {
+		impl.scheduler = newScheduler(CfgSchedulerWorkerCount, impl.getClock())
+	}
+
+	for _, socket := range impl.sockets {
+		for i := 0; i < CfgParallelListenerCount; i++ {
+			impl.waitGroup.Add(1)
+			go impl.listeningWorker(socket)
+		}
+	}
+
+	// simulations call housekeeping on every step
+	if impl.simulation == nil {
+		impl.waitGroup.Add(1)
+		go impl.housekeepingWorker()
+	}
+}
 
-	for i := 0; i < CfgParallelListenerCount; i++ {
-		go impl.listeningWorker()
+// getClock returns the clock of the simulation or CfgClock.
+func (impl *protocolImpl) getClock() Clock {
+	if impl.clock != nil {
+		return impl.clock
 	}
+
+	return CfgClock
+}
+
+func (impl *protocolImpl) currentTime() int64 {
+	return clockTime(impl.getClock())
 }
 
-func (impl *protocolImpl) listeningWorker() {
-	defer antiPanic(impl.listeningWorker)
+// async executes the function in a new goroutine. In simulations it is executed at the end of
+// the current step instead to keep the simulation deterministic.
+func (impl *protocolImpl) async(f func()) {
+	if impl.simulation != nil {
+		impl.simulation.schedule(f)
+		return
+	}
 
-	impl.waitGroup.Add(1)
+	go func() {
+		defer antiPanic(nil)
+		f()
+	}()
+}
+
+func (impl *protocolImpl) listeningWorker(socket *net.UDPConn) {
+	defer antiPanic(func() {
+		impl.waitGroup.Add(1)
+		impl.listeningWorker(socket)
+	})
 	defer impl.waitGroup.Done()
 
 	atomic.AddUint64(&StatRunningGoRoutines, 1)
@@ -157,97 +286,211 @@ func (impl *protocolImpl) listeningWorker() {
 		func() {
 			defer antiPanic(nil)
 
-			buffer := impl.bufferPool.Get().([]byte)
-			defer impl.bufferPool.Put(buffer)
+			buffer := impl.bufferPool.Get().(*[]byte)
 
-			impl.socket.SetDeadline(time.Now().Add(time.Second))
-			length, addr, next := impl.readFunc(impl.socket, buffer)
+			socket.SetDeadline(time.Now().Add(time.Second))
+			length, addr, next := impl.readFunc(socket, *buffer)
 
 			if !next {
+				impl.releaseBuffer(buffer)
 				return
 			}
 
-			sizedBuffer := buffer[:length]
-
-			if !validateHeader(sizedBuffer) {
-				return
-			}
-
-			packet := make([]byte, length)
-			copy(packet, sizedBuffer)
 			atomic.AddUint64(&StatReceivedBytes, uint64(length))
 
-			impl.handlePacket(addr, packet)
+			*buffer = (*buffer)[:length]
+			impl.handleBuffer(socket, addr, buffer)
 		}()
 	}
 }
 
-func (impl *protocolImpl) handlePacket(addr *net.UDPAddr, packet []byte) {
+// releaseBuffer puts a receive buffer back into the pool. Nothing may reference it afterwards.
+func (impl *protocolImpl) releaseBuffer(buffer *[]byte) {
+	*buffer = (*buffer)[:cap(*buffer)]
+	impl.bufferPool.Put(buffer)
+}
+
+// handlePacket processes a datagram the caller keeps ownership of. It is copied into a pooled buffer first.
+func (impl *protocolImpl) handlePacket(socket *net.UDPConn, addr *net.UDPAddr, packet []byte) {
+	buffer := impl.bufferPool.Get().(*[]byte)
+	*buffer = append((*buffer)[:0], packet...)
+	impl.handleBuffer(socket, addr, buffer)
+}
+
+// handleBuffer processes a datagram stored in a pooled buffer. The buffer is handed over to the connection
+// instead of being copied and goes back into the pool once the connection processed it. Callbacks only get
+// copies of the bytes they may keep.
+func (impl *protocolImpl) handleBuffer(socket *net.UDPConn, addr *net.UDPAddr, buffer *[]byte) {
+	if !impl.dispatchPacket(socket, addr, buffer) {
+		impl.releaseBuffer(buffer)
+	}
+}
+
+// dispatchPacket returns true if the buffer was handed over to a connection and therefore must not be reused.
+func (impl *protocolImpl) dispatchPacket(socket *net.UDPConn, addr *net.UDPAddr, buffer *[]byte) bool {
+	packet := *buffer
+	if !validateHeaderSize(packet) {
+		return false
+	}
+
+	if impl.onFilter != nil && !impl.onFilter(socket, addr, packet) {
+		return false
+	}
+
+	// unconnected messages are answered directly by the listener without looking up or creating a connection
+	if descriptor(packet[5])&descUnconnected != 0 {
+		if impl.checkUnconnectedRateLimit(packet) && validateHash(packet) {
+			impl.handleUnconnected(socket, addr, packet)
+		}
+
+		return false
+	}
+
 	hash := addrHash(addr)
 
-	impl.connectionsMutex.RLock()
-	connection, exists := impl.connections[hash]
-	impl.connectionsMutex.RUnlock()
+	connection, exists := impl.connections.get(socket, hash)
+
+	// the limit for addresses without connection is checked first so that dropped packets are not even hashed.
+	// limits of connections are only charged for valid packets, otherwise spoofed packets could get them dropped
+	// or disconnected.
+	if !exists && !impl.checkUnconnectedRateLimit(packet) {
+		return false
+	}
+
+	if !validateHash(packet) {
+		return false
+	}
+
+	if exists && !impl.checkRateLimit(connection, packet) {
+		return false
+	}
+
+	// resume requests can also target existing connections, e.g. if only the client noticed a timeout
+	if descriptor(packet[5])&(descConnect|descSession) == descConnect|descSession && impl.acceptSessions &&
+		(!exists || !connection.IsServer) {
+		impl.resumeSession(socket, addr, packet)
+		return false
+	}
 
 	if !exists {
 		if descriptor(packet[5])&descConnect == 0 {
-			return
+			return false
 		}
 
-		if !impl.connectGuard.tryExecute(hash) {
-			return
+		if atomic.LoadInt32(&impl.closing) != 0 {
+			impl.sendRejection(socket, addr, DisconnectReasonServerShutdown, nil)
+			return false
+		}
+
+		if !impl.connectGuard.tryExecute(hash, impl.currentTime()) {
+			atomic.AddUint64(&StatDroppedHandshakes, 1)
+			return false
+		}
+
+		var admissionKey string
+		if impl.admission != nil {
+			key, ok := impl.admission.tryAcquire(addr)
+			if !ok {
+				atomic.AddUint64(&StatFullRejections, 1)
+				impl.sendRejection(socket, addr, DisconnectReasonServerFull, nil)
+				impl.connectGuard.finish(hash)
+				return false
+			}
+
+			admissionKey = key
 		}
 
 		header := headerSize(packet)
-		if !invokeValidationCallback(impl.onValidation, addr, packet[header:]) {
+		if !invokeValidationCallback(impl.onValidation, addr, append([]byte(nil), packet[header:]...)) {
 			atomic.AddUint64(&StatDeniedConnects, 1)
-			return
+			impl.sendRejection(socket, addr, DisconnectReasonRejected, nil)
+			impl.connectGuard.finish(hash)
+
+			if impl.admission != nil {
+				impl.admission.release(admissionKey)
+			}
+
+			return false
 		}
 
-		connection = impl.connectClient(addr, nil)
+		connection = impl.connectClient(socket, addr, nil, false)
+		connection.admissionKey = admissionKey
 	}
 
 	// done this way to ensure that connect callback is executed on client-side
 	if descriptor(packet[5])&descConnect != 0 {
 		if connection.updateState(stateConnected) {
 			header := headerSize(packet)
+			data := append([]byte(nil), packet[header:]...)
+			resumed := false
 
-			// clear buffers so all remaining connection packets are deleted
+			// the server's answer carries the session ticket
+			if descriptor(packet[5])&descSession != 0 && len(data) >= sessionTicketSize {
+				var ticket sessionTicket
+				copy(ticket[:], data)
+
+				resumed = connection.ticket == ticket
+				connection.ticket = ticket
+				data = data[sessionTicketSize:]
+			}
+
+			// remove all remaining connection packets
 			if connection.IsServer {
-				connection.sendBuffer.reset()
-				connection.sendQueue.clear()
+				connection.sendBuffer.removeAll(isConnectPacket)
+				connection.sendQueue.removeAll(isQueuedConnectPacket)
+			}
+
+			if resumed {
+				invokeConnectionCallback(impl.onReconnect, connection, data)
+			} else {
+				invokeConnectionCallback(impl.onConnect, connection, data)
 			}
 
-			invokeConnectionCallback(impl.onConnect, connection, packet[header:])
 			impl.connectGuard.finish(hash)
 		}
 
-		return
+		return false
 	}
 
 	if descriptor(packet[5])&descDisconnect != 0 {
 		header := headerSize(packet)
-		impl.disconnectClient(connection, disconnectTypeDefault, packet[header:])
-		return
+		reason, data := decodeDisconnect(packet[header:])
+
+		if reason == DisconnectReasonSessionExpired {
+			connection.ticket = sessionTicket{}
+			impl.loseConnection(connection, reason)
+			return false
+		}
+
+		impl.disconnectClient(connection, reason, data)
+		return false
 	}
 
 	atomic.AddUint64(&StatProcessedBytes, uint64(len(packet)))
-	connection.receiveQueue.push(packet)
+	connection.receivePacket(buffer)
+	return true
 }
 
-func (impl *protocolImpl) connectClient(addr *net.UDPAddr, data []byte) *Connection {
+// connectClient creates a connection and starts the handshake. isServer is set if the other side accepts the
+// connection.
+func (impl *protocolImpl) connectClient(socket *net.UDPConn, addr *net.UDPAddr, data []byte, isServer bool) *Connection {
 	atomic.AddUint64(&StatConnects, 1)
 
 	hash := addrHash(addr)
 
-	connection := impl.connectionPool.Get().(*Connection)
-	connection.init(impl, addr)
+	connection := newConnection()
+	connection.init(impl, socket, addr)
+	connection.IsServer = isServer
 
-	impl.connectionsMutex.Lock()
-	impl.connections[hash] = connection
-	impl.connectionsMutex.Unlock()
+	impl.connections.set(socket, hash, connection)
 
-	if data != nil {
+	if impl.acceptSessions && CfgSessionGraceWindow > 0 {
+		impl.sessions.register(connection)
+
+		payload := make([]byte, 0, sessionTicketSize+len(data))
+		payload = append(append(payload, connection.ticket[:]...), data...)
+		connection.sendHighLevelPacket(descReliable|descConnect|descSession, payload)
+	} else if data != nil {
 		connection.sendHighLevelPacket(descReliable|descConnect, data)
 	} else {
 		connection.sendLowLevelPacket(descReliable | descConnect)
@@ -258,41 +501,63 @@ func (impl *protocolImpl) connectClient(addr *net.UDPAddr, data []byte) *Connect
 	return connection
 }
 
-func (impl *protocolImpl) disconnectClient(connection *Connection, disconnectType disconnectType, packet []byte) {
+// sendRejection answers a connection attempt with a disconnect packet without creating a connection.
+func (impl *protocolImpl) sendRejection(socket *net.UDPConn, addr *net.UDPAddr, reason DisconnectReason, data []byte) {
+	impl.sendRaw(socket, addr, descDisconnect, encodeDisconnect(reason, data))
+}
+
+func (impl *protocolImpl) disconnectClient(connection *Connection, reason DisconnectReason, data []byte) {
+	impl.closeConnection(connection, reason, data, true)
+}
+
+// closeConnection notifies the other side about the reason and releases the connection. If notify is
+// false no callbacks are invoked (used when the whole protocol is destroyed).
+func (impl *protocolImpl) closeConnection(connection *Connection, reason DisconnectReason, data []byte, notify bool) {
 	if !connection.updateState(stateDisconnected) {
 		return
 	}
 
-	if disconnectType == disconnectTypeTimeout {
-		atomic.AddUint64(&StatTimeouts, 1)
-		invokeConnectionCallback(impl.onTimeout, connection, nil)
-	}
+	impl.release(connection, reason, data, notify)
+}
 
+// release has to be called after the connection's state was set to disconnected.
+func (impl *protocolImpl) release(connection *Connection, reason DisconnectReason, data []byte, notify bool) {
 	atomic.AddUint64(&StatDisconnects, 1)
+	impl.sessions.forget(connection)
+
+	// no packets are routed to the connection anymore
+	impl.connections.remove(connection)
 
 	// send more than necessary so that the packet hopefully arrives
+	// the packets are forced into the queue because they must not be rejected by an overflow policy
+	payload := encodeDisconnect(reason, data)
 	for i := 0; i < 10; i++ {
-		connection.sendHighLevelPacket(descDisconnect, packet)
+		connection.sendQueue.forcePush(&packet{descriptor: descDisconnect, data: payload})
 	}
 
-	// give the channel some time to process the packets
-	time.Sleep(20 * time.Millisecond)
-
+	connection.wake()
 	connection.stopRoutines()
-	connection.waitGroup.Wait()
 
-	if disconnectType != disconnectTypeShutdown {
-		if connection.Addr != nil {
-			hash := addrHash(connection.Addr)
+	// send all packets that were not processed before the routines stopped
+	for p, ok := connection.sendQueue.pop(); ok; p, ok = connection.sendQueue.pop() {
+		connection.processSend(p.(*packet), false)
+	}
 
-			impl.connectionsMutex.Lock()
-			delete(impl.connections, hash)
-			impl.connectionsMutex.Unlock()
-		}
+	if notify {
+		invokeDisconnectCallback(impl.onDisconnect, connection, reason, data)
+	}
+
+	impl.retire(connection)
+}
+
+// retire fails all pending calls, frees the connection's admission slot and drops its packets. The connection
+// is not reused because callbacks and the user may still hold references to it.
+func (impl *protocolImpl) retire(connection *Connection) {
+	connection.cancelCalls()
 
-		invokeConnectionCallback(impl.onDisconnect, connection, packet)
+	if impl.admission != nil && connection.admissionKey != "" {
+		impl.admission.release(connection.admissionKey)
 	}
 
-	connection.reset()
-	impl.connectionPool.Put(connection)
+	connection.discard()
 }
@@ -0,0 +1,81 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import "sync"
+
+// Router dispatches packets to handlers by their message type which is the first byte of every packet
+// sent with Connection.SendMessage. Its Dispatch method can be used as PacketHandler of servers, clients
+// and peers.
+type Router struct {
+	// Unknown is called with the whole packet (type included) if no handler is registered for its type,
+	// the packet arrived on another channel than required or it is empty.
+	Unknown PacketCallback
+
+	mutex  sync.RWMutex
+	routes map[byte]route
+}
+
+type route struct {
+	handler    PacketCallback
+	channel    Channel
+	anyChannel bool
+}
+
+// NewRouter creates and returns a new Router without any handlers.
+func NewRouter() *Router {
+	return &Router{routes: make(map[byte]route)}
+}
+
+// Handle registers the handler for the message type. The handler receives the packet without the type.
+// A nil handler removes the registration. It is thread safe.
+func (r *Router) Handle(messageType byte, handler PacketCallback) {
+	r.set(messageType, route{handler: handler, anyChannel: true})
+}
+
+// HandleOn is the same as Handle but packets of the type that arrive on any other channel are passed to
+// Unknown instead.
+func (r *Router) HandleOn(messageType byte, channel Channel, handler PacketCallback) {
+	r.set(messageType, route{handler: handler, channel: channel})
+}
+
+func (r *Router) set(messageType byte, route route) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if route.handler == nil {
+		delete(r.routes, messageType)
+	} else {
+		r.routes[messageType] = route
+	}
+}
+
+// Dispatch strips the message type from the packet and invokes the registered handler.
+func (r *Router) Dispatch(connection *Connection, packet []byte, channel Channel) {
+	if len(packet) == 0 {
+		invokePacketCallback(r.Unknown, connection, packet, channel)
+		return
+	}
+
+	r.mutex.RLock()
+	route, f := r.routes[packet[0]]
+	r.mutex.RUnlock()
+
+	if !f || (!route.anyChannel && route.channel != channel) {
+		invokePacketCallback(r.Unknown, connection, packet, channel)
+		return
+	}
+
+	route.handler(connection, packet[1:], channel)
+}
+
+// SendMessage prefixes the data with the message type and sends it on the channel so that the receiver's
+// Router can dispatch it.
+func (c *Connection) SendMessage(channel Channel, messageType byte, data []byte) error {
+	packet := make([]byte, 1+len(data))
+	packet[0] = messageType
+	copy(packet[1:], data)
+	return c.SendOnChannel(channel, packet)
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRouterDispatch(t *testing.T) {
+	var events []string
+
+	router := NewRouter()
+	router.Unknown = func(c *Connection, data []byte, channel Channel) {
+		events = append(events, fmt.Sprintf("unknown %v %v", data, channel))
+	}
+	router.Handle(1, func(c *Connection, data []byte, channel Channel) {
+		events = append(events, fmt.Sprintf("chat %s %v", data, channel))
+	})
+	router.HandleOn(2, ChannelReliableOrdered, func(c *Connection, data []byte, channel Channel) {
+		events = append(events, fmt.Sprintf("move %v", data))
+	})
+
+	router.Dispatch(nil, []byte{1, 'h', 'i'}, ChannelReliable)
+	router.Dispatch(nil, []byte{2, 5}, ChannelReliableOrdered)
+	router.Dispatch(nil, []byte{2, 6}, ChannelUnreliable)
+	router.Dispatch(nil, []byte{3}, ChannelReliable)
+	router.Dispatch(nil, []byte{}, ChannelReliable)
+
+	router.Handle(1, nil)
+	router.Dispatch(nil, []byte{1}, ChannelReliable)
+
+	expected := []string{
+		fmt.Sprintf("chat hi %v", ChannelReliable),
+		"move [5]",
+		fmt.Sprintf("unknown [2 6] %v", ChannelUnreliable),
+		fmt.Sprintf("unknown [3] %v", ChannelReliable),
+		fmt.Sprintf("unknown [] %v", ChannelReliable),
+		fmt.Sprintf("unknown [1] %v", ChannelReliable),
+	}
+
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v not %v", expected, events)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrRPCDisconnected is returned by pending calls when the connection is closed.
+var ErrRPCDisconnected = errors.New("rmnp: connection closed during call")
+
+// RPCHandler is the function called to answer a remote call. A returned error is sent to the caller as RPCError.
+type RPCHandler func(*Connection, []byte) ([]byte, error)
+
+// RPCError is returned by Call if the remote handler failed or the method is unknown.
+type RPCError struct {
+	Method  uint16
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rmnp: rpc method %v failed: %v", e.Method, e.Message)
+}
+
+// System packets (descSystem) are handled by rmnp itself instead of being passed to the packet callback. Their payload starts with the kind of the message.
+type systemKind byte
+
+const (
+	systemRPCRequest systemKind = iota
+	systemRPCResponse
+	systemSnapshot
+	systemSnapshotAck
+	systemRedundant
+	systemFECData
+	systemFECParity
+	systemFECReport
+)
+
+// systemPacketHeaderSize returns the header size of unreliable system packets.
+func systemPacketHeaderSize() int {
+	return (&packet{descriptor: descSystem}).headerSize()
+}
+
+// rpc request: kind (1) + call id (4) + method (2) + payload
+// rpc response: kind (1) + call id (4) + status (1) + payload or error message
+const (
+	rpcRequestHeaderSize  = 7
+	rpcResponseHeaderSize = 6
+)
+
+const (
+	rpcStatusOK byte = iota
+	rpcStatusError
+	rpcStatusUnknownMethod
+)
+
+type rpcResult struct {
+	data []byte
+	err  error
+}
+
+// rpcCall is a pending call of a connection.
+type rpcCall struct {
+	method uint16
+	result chan rpcResult
+}
+
+// rpcRegistry holds the handlers of a server, client or peer.
+type rpcRegistry struct {
+	mutex    sync.RWMutex
+	handlers map[uint16]RPCHandler
+}
+
+func (r *rpcRegistry) set(method uint16, handler RPCHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.handlers == nil {
+		r.handlers = make(map[uint16]RPCHandler)
+	}
+
+	if handler == nil {
+		delete(r.handlers, method)
+	} else {
+		r.handlers[method] = handler
+	}
+}
+
+func (r *rpcRegistry) get(method uint16) (RPCHandler, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	handler, f := r.handlers[method]
+	return handler, f
+}
+
+// HandleRPC registers the handler for the method. A nil handler removes it. It is thread safe.
+func (s *Server) HandleRPC(method uint16, handler RPCHandler) {
+	s.rpc.set(method, handler)
+}
+
+// HandleRPC registers the handler for the method. A nil handler removes it. It is thread safe.
+func (c *Client) HandleRPC(method uint16, handler RPCHandler) {
+	c.rpc.set(method, handler)
+}
+
+// HandleRPC registers the handler for the method. A nil handler removes it. It is thread safe.
+func (p *Peer) HandleRPC(method uint16, handler RPCHandler) {
+	p.rpc.set(method, handler)
+}
+
+// Call invokes the method on the other side of the connection and waits for its response. The request is sent
+// reliably. It returns an RPCError if the remote handler failed, the context's error if it is done before the
+// response arrived and ErrRPCDisconnected if the connection is closed. Calls without deadline time out after
+// CfgRPCTimeout.
+func (c *Connection) Call(ctx context.Context, method uint16, payload []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && CfgRPCTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CfgRPCTimeout)
+		defer cancel()
+	}
+
+	id, call, err := c.startCall(method, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r := <-call.result:
+		return r.data, r.err
+	case <-ctx.Done():
+		c.removeCall(id)
+		return nil, ctx.Err()
+	}
+}
+
+// startCall registers and sends the call. The mutex is held while sending so that the connection cannot be
+// recycled in the meantime (see cancelCalls).
+func (c *Connection) startCall(method uint16, payload []byte) (uint32, *rpcCall, error) {
+	c.rpcMutex.Lock()
+	defer c.rpcMutex.Unlock()
+
+	if c.getState() == stateDisconnected {
+		return 0, nil, ErrRPCDisconnected
+	}
+
+	c.rpcNextID++
+	id := c.rpcNextID
+
+	data := make([]byte, rpcRequestHeaderSize+len(payload))
+	data[0] = byte(systemRPCRequest)
+	binary.LittleEndian.PutUint32(data[1:5], id)
+	binary.LittleEndian.PutUint16(data[5:7], method)
+	copy(data[7:], payload)
+
+	if err := c.sendHighLevelPacket(descReliable|descAck|descSystem, data); err != nil {
+		return 0, nil, err
+	}
+
+	if c.rpcCalls == nil {
+		c.rpcCalls = make(map[uint32]*rpcCall)
+	}
+
+	call := &rpcCall{method: method, result: make(chan rpcResult, 1)}
+	c.rpcCalls[id] = call
+	return id, call, nil
+}
+
+func (c *Connection) removeCall(id uint32) *rpcCall {
+	c.rpcMutex.Lock()
+	defer c.rpcMutex.Unlock()
+
+	call, f := c.rpcCalls[id]
+	if f {
+		delete(c.rpcCalls, id)
+	}
+
+	return call
+}
+
+// cancelCalls fails all pending calls with ErrRPCDisconnected.
+func (c *Connection) cancelCalls() {
+	c.rpcMutex.Lock()
+	defer c.rpcMutex.Unlock()
+
+	for id, call := range c.rpcCalls {
+		call.result <- rpcResult{err: ErrRPCDisconnected}
+		delete(c.rpcCalls, id)
+	}
+
+	c.rpcGeneration++
+}
+
+func (c *Connection) handleSystemPacket(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	switch systemKind(data[0]) {
+	case systemRPCRequest:
+		if len(data) >= rpcRequestHeaderSize {
+			c.handleRPCRequest(binary.LittleEndian.Uint32(data[1:5]), binary.LittleEndian.Uint16(data[5:7]),
+				data[rpcRequestHeaderSize:])
+		}
+	case systemRPCResponse:
+		if len(data) >= rpcResponseHeaderSize {
+			c.handleRPCResponse(binary.LittleEndian.Uint32(data[1:5]), data[5], data[rpcResponseHeaderSize:])
+		}
+	case systemSnapshot:
+		if len(data) >= snapshotHeaderSize {
+			c.handleSnapshot(data)
+		}
+	case systemSnapshotAck:
+		if len(data) >= snapshotAckSize {
+			c.handleSnapshotAck(data)
+		}
+	case systemRedundant:
+		if len(data) >= redundantHeaderSize {
+			c.handleRedundant(data)
+		}
+	case systemFECData:
+		if len(data) >= fecDataHeaderSize {
+			c.handleFECData(data)
+		}
+	case systemFECParity:
+		if len(data) >= fecParityHeaderSize {
+			c.handleFECParity(data)
+		}
+	case systemFECReport:
+		if len(data) >= fecReportSize {
+			c.handleFECReport(data)
+		}
+	}
+}
+
+// handleRPCRequest executes the handler asynchronously so that slow handlers do not block the connection. At most
+// CfgMaxConcurrentRPCHandlers handlers run at the same time per connection, further requests are rejected.
+func (c *Connection) handleRPCRequest(id uint32, method uint16, payload []byte) {
+	protocol := c.protocol
+	handler, f := protocol.rpc.get(method)
+	payload = append([]byte(nil), payload...)
+
+	c.rpcMutex.Lock()
+	generation := c.rpcGeneration
+	c.rpcMutex.Unlock()
+
+	if atomic.AddInt32(&c.rpcHandlers, 1) > int32(CfgMaxConcurrentRPCHandlers) {
+		atomic.AddInt32(&c.rpcHandlers, -1)
+		atomic.AddUint64(&StatRejectedRPCRequests, 1)
+		c.sendRPCResponse(id, generation, rpcStatusError, []byte("too many concurrent calls"))
+		return
+	}
+
+	protocol.async(func() {
+		defer atomic.AddInt32(&c.rpcHandlers, -1)
+
+		status, response := rpcStatusUnknownMethod, []byte(nil)
+
+		if f {
+			var err error
+			if response, err = handler(c, payload); err != nil {
+				status, response = rpcStatusError, []byte(err.Error())
+			} else {
+				status = rpcStatusOK
+			}
+		}
+
+		c.sendRPCResponse(id, generation, status, response)
+	})
+}
+
+func (c *Connection) sendRPCResponse(id uint32, generation uint32, status byte, response []byte) {
+	data := make([]byte, rpcResponseHeaderSize+len(response))
+	data[0] = byte(systemRPCResponse)
+	binary.LittleEndian.PutUint32(data[1:5], id)
+	data[5] = status
+	copy(data[6:], response)
+
+	// the connection could have been closed in the meantime
+	c.rpcMutex.Lock()
+	defer c.rpcMutex.Unlock()
+
+	if c.rpcGeneration == generation {
+		c.sendHighLevelPacket(descReliable|descAck|descSystem, data)
+	}
+}
+
+func (c *Connection) handleRPCResponse(id uint32, status byte, payload []byte) {
+	call := c.removeCall(id)
+	if call == nil {
+		// the call was cancelled or timed out before
+		atomic.AddUint64(&StatDroppedRPCResponses, 1)
+		return
+	}
+
+	switch status {
+	case rpcStatusOK:
+		call.result <- rpcResult{data: append([]byte(nil), payload...)}
+	case rpcStatusUnknownMethod:
+		call.result <- rpcResult{err: &RPCError{Method: call.method, Message: "unknown method"}}
+	default:
+		call.result <- rpcResult{err: &RPCError{Method: call.method, Message: string(payload)}}
+	}
+}
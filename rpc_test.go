@@ -0,0 +1,79 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// popRPCResponse returns the call id and status of the next response in the send queue.
+func popRPCResponse(t *testing.T, c *Connection) (uint32, byte) {
+	deadline := time.Now().Add(time.Second)
+
+	for time.Now().Before(deadline) {
+		if p, ok := c.sendQueue.pop(); ok {
+			data := p.(*packet).data
+			if len(data) < rpcResponseHeaderSize || systemKind(data[0]) != systemRPCResponse {
+				t.Fatalf("Expected rpc response not %v", data)
+			}
+
+			return binary.LittleEndian.Uint32(data[1:5]), data[5]
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("Expected rpc response")
+	return 0, 0
+}
+
+func TestRPCHandlerLimit(t *testing.T) {
+	defer func(limit int) { CfgMaxConcurrentRPCHandlers = limit }(CfgMaxConcurrentRPCHandlers)
+	CfgMaxConcurrentRPCHandlers = 2
+
+	release := make(chan struct{})
+	impl := new(protocolImpl)
+	impl.rpc.set(1, func(c *Connection, data []byte) ([]byte, error) {
+		<-release
+		return data, nil
+	})
+
+	c := newConnection()
+	c.init(impl, nil, testAddr(1))
+
+	for id := uint32(1); id <= 3; id++ {
+		c.handleRPCRequest(id, 1, nil)
+	}
+
+	// both handlers are blocked, the third request is answered right away
+	if id, status := popRPCResponse(t, c); id != 3 || status != rpcStatusError {
+		t.Errorf("Expected call 3 to be rejected not call %v with status %v", id, status)
+	}
+
+	if n := atomic.LoadInt32(&c.rpcHandlers); n != 2 {
+		t.Errorf("Expected 2 running handlers not %v", n)
+	}
+
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if id, status := popRPCResponse(t, c); id > 2 || status != rpcStatusOK {
+			t.Errorf("Expected call %v to succeed not status %v", id, status)
+		}
+	}
+
+	// responses are sent before the handler slot is freed
+	for atomic.LoadInt32(&c.rpcHandlers) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.handleRPCRequest(4, 1, nil)
+	if id, status := popRPCResponse(t, c); id != 4 || status != rpcStatusOK {
+		t.Errorf("Expected call 4 to succeed not call %v with status %v", id, status)
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// size of the ready queue of every worker. if it is full connections are still
+// processed once their next deadline is reached so nothing gets lost.
+const schedulerReadyQueueSize = 4096
+
+// scheduler drives the updates of all connections using a fixed amount of workers
+// instead of spawning multiple goroutines per connection. Every connection is
+// assigned to exactly one worker based on its address hash. Workers keep their
+// connections ordered by the time of the next necessary update and on every tick
+// only process the ones that are due. Additionally connections are processed
+// whenever they are marked ready because new packets were queued. User callbacks
+// are collected during processing and run afterwards so that slow callbacks do not
+// stall the worker. A manual scheduler has no goroutines and is driven by calling
+// tick (used by simulations).
+type scheduler struct {
+	workers []*schedulerWorker
+	manual  bool
+	clock   Clock
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	waitGroup sync.WaitGroup
+}
+
+type schedulerWorker struct {
+	scheduler *scheduler
+
+	// the mutex only guards the bookkeeping, connections are processed without holding it
+	mutex        sync.Mutex
+	entries      map[*Connection]*schedulerEntry
+	queue        schedulerQueue
+	nextSequence uint64
+	ready        chan *Connection
+}
+
+// schedulerEntry is a connection assigned to a worker.
+type schedulerEntry struct {
+	connection *Connection
+
+	// guarded by the worker's mutex
+	deadline int64
+	sequence uint64
+	index    int
+	woken    bool
+	removed  bool
+
+	// held while the connection is processed
+	processing sync.Mutex
+
+	// callbacks are run in order by a single goroutine at a time
+	callbackMutex   sync.Mutex
+	callbacks       []func()
+	callbackRunning bool
+	callbackGroup   sync.WaitGroup
+}
+
+// schedulerQueue is a min heap of entries ordered by deadline. Entries with the same
+// deadline are ordered by the time they were added so that simulations stay deterministic.
+type schedulerQueue []*schedulerEntry
+
+func (q schedulerQueue) Len() int {
+	return len(q)
+}
+
+func (q schedulerQueue) Less(i, j int) bool {
+	if q[i].deadline != q[j].deadline {
+		return q[i].deadline < q[j].deadline
+	}
+
+	return q[i].sequence < q[j].sequence
+}
+
+func (q schedulerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *schedulerQueue) Push(x interface{}) {
+	e := x.(*schedulerEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *schedulerQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+func newScheduler(workerCount int, clock Clock) *scheduler {
+	s := newManualScheduler(workerCount, clock)
+	s.manual = false
+
+	for _, w := range s.workers {
+		s.waitGroup.Add(1)
+		go w.run()
+	}
+
+	return s
+}
+
+func newManualScheduler(workerCount int, clock Clock) *scheduler {
+	s := new(scheduler)
+	s.manual = true
+	s.clock = clock
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.workers = make([]*schedulerWorker, workerCount)
+
+	for i := range s.workers {
+		s.workers[i] = &schedulerWorker{
+			scheduler: s,
+			entries:   make(map[*Connection]*schedulerEntry),
+			ready:     make(chan *Connection, schedulerReadyQueueSize),
+		}
+	}
+
+	return s
+}
+
+// is blocking call!
+func (s *scheduler) stop() {
+	s.cancel()
+	s.waitGroup.Wait()
+}
+
+func (s *scheduler) worker(c *Connection) *schedulerWorker {
+	return s.workers[addrHash(c.Addr)%uint32(len(s.workers))]
+}
+
+func (s *scheduler) add(c *Connection) {
+	w := s.worker(c)
+	w.mutex.Lock()
+
+	if _, f := w.entries[c]; !f {
+		w.nextSequence++
+		e := &schedulerEntry{connection: c, sequence: w.nextSequence}
+		w.entries[c] = e
+		heap.Push(&w.queue, e)
+	}
+
+	w.mutex.Unlock()
+	s.wake(c)
+}
+
+// is blocking call! returns after the connection's current processing and all of its
+// pending callbacks (if any) finished.
+func (s *scheduler) remove(c *Connection) {
+	w := s.worker(c)
+	w.mutex.Lock()
+
+	e, f := w.entries[c]
+	if f {
+		delete(w.entries, c)
+		e.removed = true
+
+		if e.index >= 0 {
+			heap.Remove(&w.queue, e.index)
+		}
+	}
+
+	w.mutex.Unlock()
+
+	if !f {
+		return
+	}
+
+	e.processing.Lock()
+	e.processing.Unlock()
+	e.callbackGroup.Wait()
+}
+
+// tick processes all due connections of all workers once.
+func (s *scheduler) tick() {
+	for _, w := range s.workers {
+		w.tick()
+	}
+}
+
+func (s *scheduler) wake(c *Connection) {
+	w := s.worker(c)
+
+	if s.manual {
+		w.mutex.Lock()
+		if e, f := w.entries[c]; f {
+			w.markDue(e)
+		}
+		w.mutex.Unlock()
+		return
+	}
+
+	select {
+	case w.ready <- c:
+	default:
+		// the connection is processed on the next tick instead
+		w.mutex.Lock()
+		if e, f := w.entries[c]; f {
+			w.markDue(e)
+		}
+		w.mutex.Unlock()
+	}
+}
+
+// markDue makes sure the connection is processed on the next tick. Has to be called
+// while holding the worker's mutex.
+func (w *schedulerWorker) markDue(e *schedulerEntry) {
+	if e.index < 0 {
+		// currently processed, the deadline is set afterwards
+		e.woken = true
+		return
+	}
+
+	e.deadline = 0
+	heap.Fix(&w.queue, e.index)
+}
+
+func (w *schedulerWorker) run() {
+	defer antiPanic(func() {
+		w.scheduler.waitGroup.Add(1)
+		w.run()
+	})
+	defer w.scheduler.waitGroup.Done()
+
+	atomic.AddUint64(&StatRunningGoRoutines, 1)
+	defer atomic.AddUint64(&StatRunningGoRoutines, ^uint64(0))
+
+	next := w.scheduler.clock.After(CfgUpdateLoopTimeout * time.Millisecond)
+
+	for {
+		select {
+		case <-w.scheduler.ctx.Done():
+			return
+		case c := <-w.ready:
+			w.processReady(c)
+		case <-next:
+			next = w.scheduler.clock.After(CfgUpdateLoopTimeout * time.Millisecond)
+			w.tick()
+		}
+	}
+}
+
+func (w *schedulerWorker) processReady(c *Connection) {
+	w.mutex.Lock()
+
+	// connection could have been removed after it was marked ready
+	e, f := w.entries[c]
+	if f && e.index >= 0 {
+		heap.Remove(&w.queue, e.index)
+	}
+
+	w.mutex.Unlock()
+
+	if f {
+		w.process(e, clockTime(w.scheduler.clock))
+	}
+}
+
+func (w *schedulerWorker) tick() {
+	currentTime := clockTime(w.scheduler.clock)
+
+	w.mutex.Lock()
+
+	var due []*schedulerEntry
+	for len(w.queue) > 0 && w.queue[0].deadline <= currentTime {
+		due = append(due, heap.Pop(&w.queue).(*schedulerEntry))
+	}
+
+	w.mutex.Unlock()
+
+	for _, e := range due {
+		w.process(e, currentTime)
+	}
+}
+
+// process does the same work as the sendUpdate, receiveUpdate and keepAlive goroutines
+// but without blocking. The entry must have been taken out of the queue before and is
+// put back with its next deadline afterwards.
+func (w *schedulerWorker) process(e *schedulerEntry, currentTime int64) {
+	e.processing.Lock()
+
+	w.mutex.Lock()
+	removed := e.removed
+	w.mutex.Unlock()
+
+	if removed {
+		e.processing.Unlock()
+		return
+	}
+
+	c := e.connection
+	batch := c.protocol.batch(c.Conn)
+	batch.hold()
+	c.deferCallbacks = true
+	w.update(c, currentTime)
+	c.deferCallbacks = false
+	batch.release()
+
+	callbacks := c.callbacks
+	c.callbacks = nil
+
+	deadline := c.nextUpdate()
+	if c.receiveQueue.len() > 0 || c.sendQueue.len() > 0 {
+		deadline = currentTime
+	}
+
+	e.processing.Unlock()
+
+	w.dispatch(e, callbacks)
+
+	w.mutex.Lock()
+	if !e.removed && e.index < 0 {
+		if e.woken {
+			deadline, e.woken = currentTime, false
+		}
+
+		e.deadline = deadline
+		heap.Push(&w.queue, e)
+	}
+	w.mutex.Unlock()
+}
+
+func (w *schedulerWorker) update(c *Connection, currentTime int64) {
+	defer antiPanic(nil)
+
+	for i := 0; i < CfgMaxSendReceiveQueueSize; i++ {
+		p, ok := c.receiveQueue.pop()
+		if !ok {
+			break
+		}
+
+		c.processBuffer(p.(*[]byte))
+	}
+
+	for i := 0; i < CfgMaxSendReceiveQueueSize; i++ {
+		p, ok := c.sendQueue.pop()
+		if !ok {
+			break
+		}
+
+		c.processSend(p.(*packet), false)
+	}
+
+	c.update(currentTime)
+
+	if currentTime-c.lastKeepAliveTime >= int64(CfgTimeoutThreshold/2) {
+		c.checkTimeout(currentTime)
+	}
+}
+
+// dispatch runs the callbacks collected during processing. A manual scheduler runs them
+// directly, otherwise they are handed to a goroutine that keeps their order.
+func (w *schedulerWorker) dispatch(e *schedulerEntry, callbacks []func()) {
+	if len(callbacks) == 0 {
+		return
+	}
+
+	if w.scheduler.manual {
+		for _, callback := range callbacks {
+			runCallback(callback)
+		}
+		return
+	}
+
+	e.callbackMutex.Lock()
+	defer e.callbackMutex.Unlock()
+
+	e.callbacks = append(e.callbacks, callbacks...)
+
+	if !e.callbackRunning {
+		e.callbackRunning = true
+		e.callbackGroup.Add(1)
+		go e.runCallbacks()
+	}
+}
+
+func (e *schedulerEntry) runCallbacks() {
+	defer e.callbackGroup.Done()
+
+	for {
+		e.callbackMutex.Lock()
+		callbacks := e.callbacks
+		e.callbacks = nil
+
+		if len(callbacks) == 0 {
+			e.callbackRunning = false
+			e.callbackMutex.Unlock()
+			return
+		}
+
+		e.callbackMutex.Unlock()
+
+		for _, callback := range callbacks {
+			runCallback(callback)
+		}
+	}
+}
+
+func runCallback(callback func()) {
+	defer antiPanic(nil)
+	callback()
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+const benchmarkConnectionCount = 1000
+
+func newTestServer(workers int) *Server {
+	CfgSchedulerWorkerCount = workers
+
+	s := NewServer("127.0.0.1:0")
+	s.writeFunc = func(*net.UDPConn, *net.UDPAddr, []byte) {}
+	s.Start()
+	return s
+}
+
+// stops the server without sending disconnect packets to all connections
+func stopTestServer(s *Server) {
+	s.connections.each(func(c *Connection) {
+		c.stopRoutines()
+	})
+
+	s.cancel()
+	s.waitGroup.Wait()
+
+	for _, socket := range s.sockets {
+		socket.Close()
+	}
+
+	if s.scheduler != nil {
+		s.scheduler.stop()
+	}
+}
+
+func testAddr(i int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 10000 + i}
+}
+
+func TestSchedulerProcessesQueues(t *testing.T) {
+	defer func(workers int) { CfgSchedulerWorkerCount = workers }(CfgSchedulerWorkerCount)
+
+	s := newTestServer(2)
+	defer stopTestServer(s)
+
+	received := make(chan []byte, 1)
+	s.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		received <- data
+	}
+
+	c := s.connectClient(s.socket, testAddr(1), nil, false)
+	c.setState(stateConnected)
+
+	p := &packet{protocolID: CfgProtocolID, data: []byte{1, 2, 3}}
+	p.calculateHash()
+	s.handlePacket(s.socket, c.Addr, p.serialize())
+
+	select {
+	case data := <-received:
+		if len(data) != 3 || data[2] != 3 {
+			t.Errorf("Expected to receive [1 2 3] not %v", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected scheduler to process the received packet")
+	}
+
+	if n := len(s.scheduler.workers); n != 2 {
+		t.Errorf("Expected 2 workers not %v", n)
+	}
+}
+
+func TestSchedulerCallbacksDoNotBlockWorker(t *testing.T) {
+	defer func(workers int) { CfgSchedulerWorkerCount = workers }(CfgSchedulerWorkerCount)
+
+	s := newTestServer(1)
+	defer stopTestServer(s)
+
+	first, second := testAddr(1), testAddr(2)
+	release := make(chan struct{})
+	received := make(chan struct{}, 1)
+
+	s.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		if c.Addr == first {
+			<-release
+			return
+		}
+
+		received <- struct{}{}
+	}
+
+	p := &packet{protocolID: CfgProtocolID, data: []byte{1}}
+	p.calculateHash()
+
+	for _, addr := range []*net.UDPAddr{first, second} {
+		c := s.connectClient(s.socket, addr, nil, false)
+		c.setState(stateConnected)
+		s.handlePacket(s.socket, addr, p.serialize())
+	}
+
+	// the handler of the first connection blocks but the worker keeps processing the second one
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Error("Expected blocked callback to not stall the worker")
+	}
+
+	close(release)
+}
+
+func benchmarkConnections(b *testing.B, workers int) {
+	defer func(workers int) { CfgSchedulerWorkerCount = workers }(CfgSchedulerWorkerCount)
+
+	b.ReportAllocs()
+
+	var goroutines, heap, cpu float64
+
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		cpuBefore := processCPUTime()
+
+		s := newTestServer(workers)
+
+		for j := 0; j < benchmarkConnectionCount; j++ {
+			c := s.connectClient(s.socket, testAddr(j), nil, false)
+			c.setState(stateConnected)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+
+		goroutines += float64(runtime.NumGoroutine())
+		runtime.ReadMemStats(&after)
+		heap += float64(after.HeapInuse+after.StackInuse) - float64(before.HeapInuse+before.StackInuse)
+		cpu += float64(processCPUTime()-cpuBefore) / float64(time.Millisecond)
+
+		stopTestServer(s)
+	}
+
+	b.ReportMetric(goroutines/float64(b.N), "goroutines/op")
+	b.ReportMetric(heap/float64(b.N)/benchmarkConnectionCount, "B/conn")
+	b.ReportMetric(cpu/float64(b.N), "cpu-ms/op")
+}
+
+func BenchmarkConnectionsGoroutines(b *testing.B) {
+	benchmarkConnections(b, 0)
+}
+
+func BenchmarkConnectionsScheduler(b *testing.B) {
+	benchmarkConnections(b, runtime.NumCPU())
+}
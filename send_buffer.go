@@ -44,13 +44,38 @@ func (buffer *sendBuffer) reset() {
 	buffer.tail = nil
 }
 
-func (buffer *sendBuffer) add(packet *packet, noRTT bool) {
+func (buffer *sendBuffer) any(predicate func(*packet) bool) bool {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	for e := buffer.head; e != nil; e = e.next {
+		if predicate(e.data.packet) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeAll removes every packet the predicate returns true for.
+func (buffer *sendBuffer) removeAll(predicate func(*packet) bool) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	for e := buffer.head; e != nil; e = e.next {
+		if predicate(e.data.packet) {
+			buffer.remove(e)
+		}
+	}
+}
+
+func (buffer *sendBuffer) add(packet *packet, noRTT bool, time int64) {
 	buffer.mutex.Lock()
 	defer buffer.mutex.Unlock()
 
 	e := &sendBufferElement{data: sendPacket{
 		packet:   packet,
-		sendTime: currentTime(),
+		sendTime: time,
 		noRTT:    noRTT,
 	}}
 
@@ -78,6 +103,17 @@ func (buffer *sendBuffer) remove(e *sendBufferElement) {
 	}
 }
 
+// restart sets the send time of all packets. Their round trip time is not measured anymore.
+func (buffer *sendBuffer) restart(time int64) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	for e := buffer.head; e != nil; e = e.next {
+		e.data.sendTime = time
+		e.data.noRTT = true
+	}
+}
+
 func (buffer *sendBuffer) retrieve(sequence sequenceNumber) (sendPacket, bool) {
 	buffer.mutex.Lock()
 	defer buffer.mutex.Unlock()
@@ -11,7 +11,7 @@ import (
 func TestSendBufferAddRemove(t *testing.T) {
 	b := newSendBuffer()
 
-	b.add(&packet{sequence: 0}, false)
+	b.add(&packet{sequence: 0}, false, 0)
 
 	if b.head == nil || b.head != b.tail {
 		t.Error("Expected head to be the same as tail")
@@ -21,13 +21,13 @@ func TestSendBufferAddRemove(t *testing.T) {
 		t.Errorf("Expected first element to contain sequence number 0 not %v", s)
 	}
 
-	b.add(&packet{sequence: 1}, false)
+	b.add(&packet{sequence: 1}, false, 0)
 
 	if s := b.tail.data.packet.sequence; s != 1 {
 		t.Errorf("Expected last element to contain sequence number 1 not %v", s)
 	}
 
-	b.add(&packet{sequence: 2}, false)
+	b.add(&packet{sequence: 2}, false, 0)
 
 	if s := b.tail.data.packet.sequence; s != 2 {
 		t.Errorf("Expected last element to contain sequence number 2 not %v", s)
@@ -60,7 +60,7 @@ func TestSendBufferRetrieve(t *testing.T) {
 	b := newSendBuffer()
 
 	for i := 0; i < 10; i++ {
-		b.add(&packet{sequence: sequenceNumber(i)}, false)
+		b.add(&packet{sequence: sequenceNumber(i)}, false, 0)
 	}
 
 	for i := 9; i >= 0; i-- {
@@ -82,3 +82,19 @@ func TestSendBufferRetrieve(t *testing.T) {
 		}
 	}
 }
+
+func TestSendBufferRestart(t *testing.T) {
+	b := newSendBuffer()
+	b.add(&packet{sequence: 0}, false, 10)
+	b.add(&packet{sequence: 1}, false, 20)
+
+	b.restart(100)
+
+	b.iterate(func(i int, p *sendPacket) sendBufferOP {
+		if p.sendTime != 100 || !p.noRTT {
+			t.Errorf("Expected packet %v to be restarted at 100 without rtt not %v (%v)", i, p.sendTime, p.noRTT)
+		}
+
+		return sendBufferContinue
+	})
+}
@@ -7,6 +7,15 @@ package rmnp
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrSerializerUnderflow is returned if the serializer contains less data than needed for a value.
+	ErrSerializerUnderflow = errors.New("rmnp: not enough data to read")
+
+	// ErrVarintOverflow is returned if a varint does not fit into 64 bits or the type it is decoded into.
+	ErrVarintOverflow = errors.New("rmnp: varint overflows its type")
 )
 
 // Serializer reads and writes binary data
@@ -29,10 +38,10 @@ func (s *Serializer) Read(data interface{}) error {
 	return binary.Read(s.buffer, binary.LittleEndian, data)
 }
 
-// ReadPanic reads from the serializer and panics if no data is read
+// ReadPanic reads from the serializer and panics with the error if no data is read
 func (s *Serializer) ReadPanic(data interface{}) {
-	if s.Read(data) != nil {
-		panic(0)
+	if err := s.Read(data); err != nil {
+		panic(err)
 	}
 }
 
@@ -50,3 +59,100 @@ func (s *Serializer) Bytes() []byte {
 func (s *Serializer) RemainingSize() int {
 	return s.buffer.Len()
 }
+
+// WriteUvarint writes the value using 1 to 10 bytes depending on its size
+func (s *Serializer) WriteUvarint(value uint64) {
+	var buffer [binary.MaxVarintLen64]byte
+	s.buffer.Write(buffer[:binary.PutUvarint(buffer[:], value)])
+}
+
+// ReadUvarint reads a value written with WriteUvarint
+func (s *Serializer) ReadUvarint() (uint64, error) {
+	var value uint64
+	for i := uint(0); ; i++ {
+		b, err := s.buffer.ReadByte()
+		if err != nil {
+			return 0, ErrSerializerUnderflow
+		}
+
+		// the last of the 10 possible bytes only holds the highest bit
+		if i == binary.MaxVarintLen64-1 && b > 1 {
+			return 0, ErrVarintOverflow
+		}
+
+		value |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			return value, nil
+		}
+	}
+}
+
+// WriteVarint writes the value zig-zag encoded so that small negative values use few bytes as well
+func (s *Serializer) WriteVarint(value int64) {
+	var buffer [binary.MaxVarintLen64]byte
+	s.buffer.Write(buffer[:binary.PutVarint(buffer[:], value)])
+}
+
+// ReadVarint reads a value written with WriteVarint
+func (s *Serializer) ReadVarint() (int64, error) {
+	zigzag, err := s.ReadUvarint()
+	if err != nil {
+		return 0, err
+	}
+
+	value := int64(zigzag >> 1)
+	if zigzag&1 != 0 {
+		value = ^value
+	}
+
+	return value, nil
+}
+
+// WriteBytes writes the data prefixed with its length as uvarint
+func (s *Serializer) WriteBytes(data []byte) {
+	s.WriteUvarint(uint64(len(data)))
+	s.buffer.Write(data)
+}
+
+// ReadBytes reads data written with WriteBytes. The returned slice is a copy.
+func (s *Serializer) ReadBytes() ([]byte, error) {
+	length, err := s.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	s.buffer.Read(data)
+	return data, nil
+}
+
+// WriteString writes the string prefixed with its length as uvarint
+func (s *Serializer) WriteString(value string) {
+	s.WriteUvarint(uint64(len(value)))
+	s.buffer.WriteString(value)
+}
+
+// ReadString reads a string written with WriteString
+func (s *Serializer) ReadString() (string, error) {
+	length, err := s.readLength()
+	if err != nil {
+		return "", err
+	}
+
+	return string(s.buffer.Next(length)), nil
+}
+
+// readLength reads a length prefix. Lengths that exceed the remaining data are rejected before anything is
+// allocated.
+func (s *Serializer) readLength() (int, error) {
+	length, err := s.ReadUvarint()
+	if err != nil {
+		return 0, err
+	}
+
+	if length > uint64(s.buffer.Len()) {
+		return 0, ErrSerializerUnderflow
+	}
+
+	return int(length), nil
+}
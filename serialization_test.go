@@ -0,0 +1,177 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+type testVector struct {
+	X, Y float32
+}
+
+type testItem struct {
+	ID    uint16
+	Name  string
+	Count int `rmnp:"varint"`
+}
+
+type testMessage struct {
+	Flag     bool
+	Health   int32 `rmnp:"varint"`
+	Delta    int16
+	Position testVector
+	Target   *testVector `rmnp:"optional"`
+	Items    []testItem
+	Payload  []byte
+	Tags     [2]string
+	Cache    string `rmnp:"-"`
+	hidden   int
+}
+
+func TestSerializerVarints(t *testing.T) {
+	s := NewSerializer()
+	s.WriteUvarint(300)
+	s.WriteVarint(-3)
+
+	if len(s.Bytes()) != 3 {
+		t.Errorf("Expected 3 bytes not %v", len(s.Bytes()))
+	}
+
+	if v, err := s.ReadUvarint(); v != 300 || err != nil {
+		t.Errorf("Expected 300 not %v (%v)", v, err)
+	}
+
+	if v, err := s.ReadVarint(); v != -3 || err != nil {
+		t.Errorf("Expected -3 not %v (%v)", v, err)
+	}
+
+	if _, err := s.ReadVarint(); err != ErrSerializerUnderflow {
+		t.Errorf("Expected underflow not %v", err)
+	}
+
+	max := NewSerializer()
+	max.WriteUvarint(^uint64(0))
+	if v, err := max.ReadUvarint(); v != ^uint64(0) || err != nil {
+		t.Errorf("Expected max uint64 not %v (%v)", v, err)
+	}
+
+	// 10th byte exceeds 64 bits
+	overflow := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}
+	if _, err := NewSerializerFor(overflow).ReadUvarint(); err != ErrVarintOverflow {
+		t.Errorf("Expected overflow not %v", err)
+	}
+
+	// more than 10 bytes
+	overflow[9] = 0x80
+	if _, err := NewSerializerFor(append(overflow, 0)).ReadVarint(); err != ErrVarintOverflow {
+		t.Errorf("Expected overflow not %v", err)
+	}
+}
+
+func TestSerializerStrings(t *testing.T) {
+	s := NewSerializer()
+	s.WriteString("hello")
+	s.WriteBytes([]byte{1, 2, 3})
+
+	if v, err := s.ReadString(); v != "hello" || err != nil {
+		t.Errorf("Expected hello not %v (%v)", v, err)
+	}
+
+	if v, err := s.ReadBytes(); !reflect.DeepEqual(v, []byte{1, 2, 3}) || err != nil {
+		t.Errorf("Expected [1 2 3] not %v (%v)", v, err)
+	}
+
+	// length prefix larger than the remaining data
+	s = NewSerializerFor([]byte{200, 1, 'a'})
+	if _, err := s.ReadString(); err != ErrSerializerUnderflow {
+		t.Errorf("Expected underflow not %v", err)
+	}
+}
+
+func TestSerializerEncodeDecode(t *testing.T) {
+	in := testMessage{
+		Flag:     true,
+		Health:   -100,
+		Delta:    -2,
+		Position: testVector{1.5, -2},
+		Items:    []testItem{{1, "sword", 1}, {2, "arrow", 64}},
+		Payload:  []byte{9, 8},
+		Tags:     [2]string{"a", "b"},
+		Cache:    "ignored",
+		hidden:   5,
+	}
+
+	data, err := Encode(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out testMessage
+	if err := Decode(data, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	in.Cache, in.hidden = "", 0
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Expected %+v not %+v", in, out)
+	}
+
+	in.Target = &testVector{3, 4}
+	if data, err = Encode(in); err != nil {
+		t.Fatal(err)
+	}
+
+	out = testMessage{}
+	if err := Decode(data, &out); err != nil || !reflect.DeepEqual(in, out) {
+		t.Errorf("Expected %+v not %+v (%v)", in, out, err)
+	}
+
+	for i := 0; i < len(data); i++ {
+		if err := Decode(data[:i], &out); err != ErrSerializerUnderflow {
+			t.Errorf("Expected underflow for %v bytes not %v", i, err)
+		}
+	}
+}
+
+func TestSerializerErrors(t *testing.T) {
+	if _, err := Encode(map[string]int{}); err == nil {
+		t.Error("Expected unsupported type error")
+	} else if _, ok := err.(*UnsupportedTypeError); !ok {
+		t.Errorf("Expected unsupported type error not %v", err)
+	}
+
+	if _, err := Encode(struct{ P *int }{}); err != ErrNilPointer {
+		t.Errorf("Expected nil pointer error not %v", err)
+	}
+
+	var v testVector
+	if err := Decode([]byte{}, v); err != ErrInvalidDecodeTarget {
+		t.Errorf("Expected invalid target error not %v", err)
+	}
+
+	var small struct {
+		V int8 `rmnp:"varint"`
+	}
+	if err := Decode([]byte{0xfe, 0x03}, &small); err != ErrVarintOverflow {
+		t.Errorf("Expected overflow not %v", err)
+	}
+
+	var y uint16
+	if err := NewSerializerFor(nil).Read(&y); err != io.EOF {
+		t.Errorf("Expected io.EOF not %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r != io.ErrUnexpectedEOF {
+			t.Errorf("Expected panic with io.ErrUnexpectedEOF not %v", r)
+		}
+	}()
+
+	var x uint32
+	NewSerializerFor([]byte{1}).ReadPanic(&x)
+}
@@ -4,7 +4,13 @@
 
 package rmnp
 
-import "net"
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Server listens for incoming rmnp packets and manages client connections
 type Server struct {
@@ -13,17 +19,70 @@ type Server struct {
 	// ClientConnect is invoked when a new client connects.
 	ClientConnect ConnectionCallback
 
-	// ClientDisconnect is invoked when a client disconnects.
-	ClientDisconnect ConnectionCallback
+	// ClientDisconnect is invoked when a client disconnects. The reason tells why the connection was closed.
+	// If CfgSessionGraceWindow is set it is invoked for timed out clients only after the window passed
+	// without the client reconnecting.
+	ClientDisconnect DisconnectCallback
 
 	// ClientTimeout is called when a client timed out. After that ClientDisconnect will be called.
 	ClientTimeout ConnectionCallback
 
+	// ClientReconnect is invoked when a timed out client resumed its session. The Connection is the same
+	// as before so its values and pending reliable packets are kept.
+	ClientReconnect ConnectionCallback
+
 	// ClientValidation is called when a new client connects to either accept or deny the connection attempt.
 	ClientValidation ValidationCallback
 
 	// PacketHandler is called when packets arrive to handle the received data.
 	PacketHandler PacketCallback
+
+	// SnapshotHandler is called with every snapshot sent by a client using Connection.SendSnapshot that is newer
+	// than the previous one.
+	SnapshotHandler ConnectionCallback
+
+	// ClientOverflow is called when a packet is pushed into one of the client's full queues.
+	ClientOverflow OverflowCallback
+
+	// ClientRateLimited is called (at most once per second per client) when a client exceeded
+	// CfgMaxPacketsPerSecond or CfgMaxBytesPerSecond while CfgRateLimitAction is RateLimitWarn.
+	ClientRateLimited ConnectionCallback
+
+	// SendInterceptors see every message sent with one of the send methods of a connection before it is
+	// queued. ReceiveInterceptors see every received message before PacketHandler is called. Both have to be
+	// set before Start.
+	SendInterceptors    []InterceptorFunc
+	ReceiveInterceptors []InterceptorFunc
+
+	// QueryHandler answers queries sent with Query without a connection being established. The payload is only
+	// valid during the call. The returned response is dropped if it exceeds CfgMaxQueryResponseSize or
+	// CfgQueryAmplificationFactor times the request size. Returning nil sends no response.
+	QueryHandler QueryCallback
+
+	// DiscoveryHandler returns the advertisement sent to clients that look for servers with Discover. If it is
+	// set before Start the server also listens for discovery probes on CfgDiscoveryPort.
+	DiscoveryHandler QueryCallback
+
+	// Introducer enables the introducer mode: hosts behind NAT can register with Server.RegisterHost and
+	// clients can connect to them with Client.ConnectThroughIntroducer. It has to be set before Start.
+	Introducer bool
+
+	// AllowList restricts the server to clients from these networks if it is not empty. Packets from other
+	// addresses are dropped. It has to be set before Start.
+	AllowList []*net.IPNet
+
+	// DenyList drops all packets from these networks. It has to be set before Start.
+	DenyList []*net.IPNet
+
+	// BanStore persists the bans. It defaults to an in-memory store and has to be set before Start.
+	BanStore BanStore
+
+	bans      *banList
+	discovery *net.UDPConn
+
+	hosts             *hostRegistry
+	registrationMutex sync.Mutex
+	registrations     []*hostRegistration
 }
 
 // NewServer creates and returns a new Server instance that will listen on the
@@ -32,6 +91,10 @@ func NewServer(address string) *Server {
 	s := new(Server)
 
 	s.readFunc = func(conn *net.UDPConn, buffer []byte) (int, *net.UDPAddr, bool) {
+		if b := s.batch(conn); b != nil {
+			return b.read(buffer)
+		}
+
 		length, addr, err := conn.ReadFromUDP(buffer)
 
 		if err != nil {
@@ -42,6 +105,11 @@ func NewServer(address string) *Server {
 	}
 
 	s.writeFunc = func(conn *net.UDPConn, addr *net.UDPAddr, buffer []byte) {
+		if b := s.batch(conn); b != nil {
+			b.write(addr, buffer)
+			return
+		}
+
 		conn.WriteToUDP(buffer, addr)
 	}
 
@@ -51,9 +119,9 @@ func NewServer(address string) *Server {
 		}
 	}
 
-	s.onDisconnect = func(connection *Connection, packet []byte) {
+	s.onDisconnect = func(connection *Connection, reason DisconnectReason, packet []byte) {
 		if s.ClientDisconnect != nil {
-			s.ClientDisconnect(connection, packet)
+			s.ClientDisconnect(connection, reason, packet)
 		}
 	}
 
@@ -63,6 +131,20 @@ func NewServer(address string) *Server {
 		}
 	}
 
+	s.onReconnect = func(connection *Connection, packet []byte) {
+		if s.ClientReconnect != nil {
+			s.ClientReconnect(connection, packet)
+		}
+	}
+
+	s.onDetach = func(connection *Connection, reason DisconnectReason) (bool, int64) {
+		if !connection.hasSession() || CfgSessionGraceWindow <= 0 {
+			return false, 0
+		}
+
+		return true, s.currentTime() + CfgSessionGraceWindow
+	}
+
 	s.onValidation = func(addr *net.UDPAddr, packet []byte) bool {
 		if s.ClientValidation != nil {
 			return s.ClientValidation(addr, packet)
@@ -77,19 +159,252 @@ func NewServer(address string) *Server {
 		}
 	}
 
+	s.onSnapshot = func(connection *Connection, snapshot []byte) {
+		if s.SnapshotHandler != nil {
+			s.SnapshotHandler(connection, snapshot)
+		}
+	}
+
+	s.onOverflow = func(connection *Connection, queue Queue) {
+		if s.ClientOverflow != nil {
+			s.ClientOverflow(connection, queue)
+		}
+	}
+
+	s.onRateLimit = func(connection *Connection, packet []byte) {
+		if s.ClientRateLimited != nil {
+			s.ClientRateLimited(connection, packet)
+		}
+	}
+
+	s.onFilter = s.filter
+
+	s.onDiscovery = func(addr *net.UDPAddr, payload []byte) []byte {
+		return invokeQueryCallback(s.DiscoveryHandler, addr, payload)
+	}
+
+	s.onQuery = func(addr *net.UDPAddr, payload []byte) []byte {
+		return invokeQueryCallback(s.QueryHandler, addr, payload)
+	}
+
+	s.onIntroduction = s.handleIntroduction
+
+	s.onTick = func(currentTime int64) {
+		if s.bans.prune(s.getClock().Now()) {
+			s.BanStore.Save(s.bans.list())
+		}
+
+		s.hosts.prune(currentTime)
+		s.renewRegistrations(currentTime)
+	}
+
+	s.sendInterceptors = func() []InterceptorFunc {
+		return s.SendInterceptors
+	}
+
+	s.receiveInterceptors = func() []InterceptorFunc {
+		return s.ReceiveInterceptors
+	}
+
 	s.init(address)
+	s.acceptSessions = true
+	s.admission = newAdmissionControl()
+	s.bans = newBanList()
+	s.hosts = newHostRegistry()
+	s.BanStore = NewMemoryBanStore()
 	return s
 }
 
 // Start starts the server asynchronously. It invokes no callbacks but
 // the server is guaranteed to be running after this call.
+// If CfgSocketCount is greater than 1 and SO_REUSEPORT is supported, multiple sockets are
+// bound to the same port.
 func (s *Server) Start() {
-	s.setSocket(net.ListenUDP("udp", s.address))
+	s.loadBans()
+
+	if CfgSocketCount > 1 && reusePortSupported {
+		s.setSockets(listenReusePort(s.address, CfgSocketCount))
+	} else {
+		s.setSocket(net.ListenUDP("udp", s.address))
+	}
+
 	s.listen()
+
+	if s.DiscoveryHandler != nil {
+		socket, err := listenDiscovery()
+		checkError("Error creating discovery socket", err)
+		s.discovery = socket
+		s.waitGroup.Add(1)
+		go s.discoveryWorker(socket)
+	}
 }
 
-// Stop stops the server and disconnects all clients. It invokes no callbacks.
-// This call could take some time because it waits for goroutines to exit.
+func listenReusePort(address *net.UDPAddr, count int) ([]*net.UDPConn, error) {
+	config := net.ListenConfig{Control: reusePortControl}
+	addr := *address
+	sockets := make([]*net.UDPConn, 0, count)
+
+	for i := 0; i < count; i++ {
+		conn, err := config.ListenPacket(context.Background(), "udp", addr.String())
+
+		if err != nil {
+			for _, socket := range sockets {
+				socket.Close()
+			}
+
+			return nil, err
+		}
+
+		// if port 0 was used all other sockets have to bind to the port chosen for the first one
+		addr.Port = conn.LocalAddr().(*net.UDPAddr).Port
+		sockets = append(sockets, conn.(*net.UDPConn))
+	}
+
+	return sockets, nil
+}
+
+// Ban disconnects all clients whose address matches the ip address or CIDR (e.g. "10.0.0.0/8") and rejects
+// them for the given duration (0 = forever). The reason is sent to the clients together with
+// DisconnectReasonBanned. Banning the same network again replaces the previous ban. The bans are
+// saved in BanStore and the store's error is returned.
+func (s *Server) Ban(target string, duration time.Duration, reason string) error {
+	network, err := parseBanTarget(target)
+	if err != nil {
+		return err
+	}
+
+	ban := Ban{CIDR: network.String(), Reason: reason}
+	if duration > 0 {
+		ban.Expires = s.getClock().Now().Add(duration)
+	}
+
+	s.bans.add(network, ban)
+
+	// disconnecting blocks, therefore it is done asynchronously in case Ban is called from a callback
+	s.connections.each(func(c *Connection) {
+		if network.Contains(c.Addr.IP) {
+			s.async(func() {
+				s.disconnectClient(c, DisconnectReasonBanned, []byte(reason))
+			})
+		}
+	})
+
+	for _, c := range s.sessions.all() {
+		if network.Contains(c.Addr.IP) {
+			s.releaseDetached(c, DisconnectReasonBanned, true)
+		}
+	}
+
+	return s.BanStore.Save(s.bans.list())
+}
+
+// Unban removes the ban of the ip address or CIDR. The target has to match the banned one exactly.
+func (s *Server) Unban(target string) error {
+	network, err := parseBanTarget(target)
+	if err != nil {
+		return err
+	}
+
+	if !s.bans.delete(network) {
+		return nil
+	}
+
+	return s.BanStore.Save(s.bans.list())
+}
+
+// Bans returns all active bans.
+func (s *Server) Bans() []Ban {
+	return s.bans.list()
+}
+
+func (s *Server) loadBans() {
+	bans, err := s.BanStore.Load()
+	checkError("Failed to load bans", err)
+
+	for _, ban := range bans {
+		if network, err := parseBanTarget(ban.CIDR); err == nil {
+			s.bans.add(network, ban)
+		}
+	}
+}
+
+// filter drops packets of clients that are not allowed to connect. Banned clients are told so if they
+// try to connect.
+func (s *Server) filter(socket *net.UDPConn, addr *net.UDPAddr, packet []byte) bool {
+	if (len(s.AllowList) > 0 && !containsIP(s.AllowList, addr.IP)) || containsIP(s.DenyList, addr.IP) {
+		atomic.AddUint64(&StatBlockedPackets, 1)
+		return false
+	}
+
+	if ban, banned := s.bans.lookup(addr.IP, s.getClock().Now()); banned {
+		atomic.AddUint64(&StatBlockedPackets, 1)
+
+		if descriptor(packet[5])&descConnect != 0 {
+			s.sendRejection(socket, addr, DisconnectReasonBanned, []byte(ban.Reason))
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// Stop stops the server and disconnects all clients with DisconnectReasonServerShutdown. It invokes
+// no callbacks. This call could take some time because it waits for goroutines to exit.
 func (s *Server) Stop() {
-	s.destroy()
+	s.destroy(DisconnectReasonServerShutdown)
+	s.stopDiscovery()
+}
+
+// stopDiscovery has to be called after destroy so that the discovery worker already exited.
+func (s *Server) stopDiscovery() {
+	if s.discovery != nil {
+		s.discovery.Close()
+		s.discovery = nil
+	}
+}
+
+// Shutdown gracefully stops the server. New connection attempts are rejected immediately. Then it waits
+// until all reliable packets were acknowledged by the clients or the context is done, disconnects
+// every client with DisconnectReasonServerShutdown and the reason as payload (invoking ClientDisconnect)
+// and finally stops the server.
+// All clients are handled in parallel. If the context is done before all packets were delivered its
+// error is returned but the server is stopped nonetheless.
+func (s *Server) Shutdown(ctx context.Context, reason []byte) error {
+	atomic.StoreInt32(&s.closing, 1)
+	defer atomic.StoreInt32(&s.closing, 0)
+
+	var waitGroup sync.WaitGroup
+	var incomplete int32
+
+	s.connections.each(func(c *Connection) {
+		waitGroup.Add(1)
+
+		go func() {
+			defer waitGroup.Done()
+			defer antiPanic(nil)
+
+			if !c.drain(ctx) {
+				atomic.StoreInt32(&incomplete, 1)
+			}
+
+			s.disconnectClient(c, DisconnectReasonServerShutdown, reason)
+		}()
+	})
+
+	waitGroup.Wait()
+
+	// sessions of timed out clients end as well
+	for _, c := range s.sessions.all() {
+		s.releaseDetached(c, DisconnectReasonServerShutdown, true)
+	}
+
+	s.destroy(DisconnectReasonServerShutdown)
+	s.stopDiscovery()
+
+	if incomplete != 0 {
+		return ctx.Err()
+	}
+
+	return nil
 }
@@ -0,0 +1,85 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	server := NewServer("127.0.0.1:0")
+
+	var mutex sync.Mutex
+	var received []byte
+	var clientDisconnects, serverDisconnects int
+	var reason string
+	var disconnectReason DisconnectReason
+
+	connected := make(chan *Connection, 1)
+	server.ClientConnect = func(c *Connection, data []byte) {
+		connected <- c
+	}
+	server.ClientDisconnect = func(c *Connection, r DisconnectReason, data []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		serverDisconnects++
+	}
+	server.Start()
+
+	client := NewClient(server.socket.LocalAddr().(*net.UDPAddr).String())
+	client.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, data[0])
+	}
+	client.ServerDisconnect = func(c *Connection, r DisconnectReason, data []byte) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		clientDisconnects++
+		disconnectReason = r
+		reason = string(data)
+	}
+	client.Connect()
+
+	var conn *Connection
+	select {
+	case conn = <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("Expected client to connect")
+	}
+
+	for i := 0; i < 20; i++ {
+		conn.SendReliable([]byte{byte(i)})
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx, []byte("maintenance")); err != nil {
+		t.Errorf("Expected all packets to be delivered before the deadline: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(received) != 20 {
+		t.Errorf("Expected client to receive 20 packets not %v", len(received))
+	}
+
+	if serverDisconnects != 1 {
+		t.Errorf("Expected ClientDisconnect to be called once not %v times", serverDisconnects)
+	}
+
+	if clientDisconnects != 1 || reason != "maintenance" || disconnectReason != DisconnectReasonServerShutdown {
+		t.Errorf("Expected client to be disconnected with reason (disconnects: %v, reason: %q, %v)", clientDisconnects, reason, disconnectReason)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"crypto/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const sessionTicketSize = 16
+
+// sessionTicket is issued by the server on connect and identifies the connection when a client resumes it.
+type sessionTicket [sessionTicketSize]byte
+
+// sessionStore keeps track of the issued tickets and of detached connections. A detached connection is no
+// longer processed and not part of the connection map but is kept alive so that it can be attached again.
+type sessionStore struct {
+	mutex    sync.Mutex
+	tickets  map[sessionTicket]*Connection
+	detached map[*Connection]struct{}
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		tickets:  make(map[sessionTicket]*Connection),
+		detached: make(map[*Connection]struct{}),
+	}
+}
+
+// register issues a new ticket for the connection.
+func (s *sessionStore) register(c *Connection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		_, err := rand.Read(c.ticket[:])
+		checkError("Failed to create session ticket", err)
+
+		if _, f := s.tickets[c.ticket]; !f {
+			s.tickets[c.ticket] = c
+			return
+		}
+	}
+}
+
+func (s *sessionStore) lookup(ticket sessionTicket) (*Connection, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, f := s.tickets[ticket]
+	if !f {
+		return nil, false
+	}
+
+	_, detached := s.detached[c]
+	return c, detached
+}
+
+// forget removes the connection's ticket so that it cannot be resumed anymore.
+func (s *sessionStore) forget(c *Connection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.tickets[c.ticket] == c {
+		delete(s.tickets, c.ticket)
+	}
+}
+
+func (s *sessionStore) detach(c *Connection, reason DisconnectReason, deadline int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c.detachReason = reason
+	c.detachDeadline = deadline
+	s.detached[c] = struct{}{}
+}
+
+// attach returns false if the connection was not detached (e.g. because it was attached concurrently).
+func (s *sessionStore) attach(c *Connection) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, f := s.detached[c]; !f {
+		return false
+	}
+
+	delete(s.detached, c)
+	return true
+}
+
+// release removes a detached connection from the store. It returns false if the connection was not detached.
+func (s *sessionStore) release(c *Connection) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, f := s.detached[c]; !f {
+		return false
+	}
+
+	delete(s.detached, c)
+
+	if s.tickets[c.ticket] == c {
+		delete(s.tickets, c.ticket)
+	}
+
+	return true
+}
+
+// expired returns all detached connections whose deadline passed. A deadline of 0 never expires.
+func (s *sessionStore) expired(currentTime int64) []*Connection {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var connections []*Connection
+
+	for c := range s.detached {
+		if c.detachDeadline != 0 && currentTime >= c.detachDeadline {
+			connections = append(connections, c)
+		}
+	}
+
+	return connections
+}
+
+func (s *sessionStore) all() []*Connection {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	connections := make([]*Connection, 0, len(s.detached))
+
+	for c := range s.detached {
+		connections = append(connections, c)
+	}
+
+	return connections
+}
+
+// loseConnection is called when the connection was lost without the other side asking for it. If the
+// detach callback allows it the connection is detached instead of disconnected so that it can be resumed.
+func (impl *protocolImpl) loseConnection(connection *Connection, reason DisconnectReason) {
+	if !connection.updateState(stateDisconnected) {
+		return
+	}
+
+	if reason == DisconnectReasonTimeout || reason == DisconnectReasonPingTooHigh {
+		atomic.AddUint64(&StatTimeouts, 1)
+		invokeConnectionCallback(impl.onTimeout, connection, nil)
+	}
+
+	if impl.onDetach != nil {
+		if detach, deadline := impl.onDetach(connection, reason); detach {
+			impl.suspend(connection, reason, deadline)
+			return
+		}
+	}
+
+	impl.release(connection, reason, nil, true)
+}
+
+// detach stops processing the connection without releasing it.
+func (impl *protocolImpl) detach(connection *Connection, reason DisconnectReason, deadline int64) bool {
+	if !connection.updateState(stateDisconnected) {
+		return false
+	}
+
+	impl.suspend(connection, reason, deadline)
+	return true
+}
+
+func (impl *protocolImpl) suspend(connection *Connection, reason DisconnectReason, deadline int64) {
+	impl.connections.remove(connection)
+	connection.stopRoutines()
+	impl.sessions.detach(connection, reason, deadline)
+}
+
+// attach continues processing of a detached connection using the given socket and address.
+func (impl *protocolImpl) attach(connection *Connection, socket *net.UDPConn, addr *net.UDPAddr) bool {
+	if !impl.sessions.attach(connection) {
+		return false
+	}
+
+	if impl.admission != nil && connection.admissionKey != "" {
+		connection.admissionKey = impl.admission.move(connection.admissionKey, addr)
+	}
+
+	connection.resume(socket, addr)
+	impl.connections.set(socket, addrHash(addr), connection)
+	connection.startRoutines()
+
+	return true
+}
+
+// releaseDetached finally disconnects a detached connection. Nothing is sent to the other side.
+func (impl *protocolImpl) releaseDetached(connection *Connection, reason DisconnectReason, notify bool) {
+	if !impl.sessions.release(connection) {
+		return
+	}
+
+	atomic.AddUint64(&StatDisconnects, 1)
+
+	if notify {
+		invokeDisconnectCallback(impl.onDisconnect, connection, reason, nil)
+	}
+
+	impl.retire(connection)
+}
+
+// resumeSession handles a connect packet that carries a session ticket. The session's connection is moved to
+// the packet's address. If the ticket is unknown the attempt is rejected with DisconnectReasonSessionExpired.
+func (impl *protocolImpl) resumeSession(socket *net.UDPConn, addr *net.UDPAddr, packet []byte) {
+	payload := packet[headerSize(packet):]
+	if len(payload) < sessionTicketSize {
+		return
+	}
+
+	if atomic.LoadInt32(&impl.closing) != 0 {
+		impl.sendRejection(socket, addr, DisconnectReasonServerShutdown, nil)
+		return
+	}
+
+	var ticket sessionTicket
+	copy(ticket[:], payload)
+
+	hash := addrHash(addr)
+	if !impl.connectGuard.tryExecute(hash, impl.currentTime()) {
+		return
+	}
+
+	defer impl.connectGuard.finish(hash)
+
+	connection, detached := impl.sessions.lookup(ticket)
+
+	if connection == nil {
+		impl.sendRejection(socket, addr, DisconnectReasonSessionExpired, nil)
+		return
+	}
+
+	if !detached {
+		// the request was resent or the client noticed the timeout first; only confirm it again
+		if connection.Addr.String() == addr.String() {
+			connection.sendHighLevelPacket(descConnect|descSession, ticket[:])
+			return
+		}
+
+		// the client's address changed (e.g. NAT rebinding) but the old address has to be silent first
+		if impl.currentTime()-atomic.LoadInt64(&connection.lastReceivedTime) <= CfgSessionMigrationTimeout {
+			return
+		}
+
+		if !impl.detach(connection, DisconnectReasonTimeout, 0) {
+			return
+		}
+	}
+
+	if !impl.attach(connection, socket, addr) {
+		return
+	}
+
+	connection.sendHighLevelPacket(descReliable|descConnect|descSession, ticket[:])
+	connection.setState(stateConnected)
+
+	invokeConnectionCallback(impl.onReconnect, connection, append([]byte(nil), payload[sessionTicketSize:]...))
+}
+
+// housekeeping releases expired sessions and runs periodic work of the server or client.
+func (impl *protocolImpl) housekeeping(currentTime int64) {
+	for _, c := range impl.sessions.expired(currentTime) {
+		impl.releaseDetached(c, c.detachReason, true)
+	}
+
+	if impl.onTick != nil {
+		impl.onTick(currentTime)
+	}
+}
+
+func (impl *protocolImpl) housekeepingWorker() {
+	defer antiPanic(func() {
+		impl.waitGroup.Add(1)
+		impl.housekeepingWorker()
+	})
+	defer impl.waitGroup.Done()
+
+	atomic.AddUint64(&StatRunningGoRoutines, 1)
+	defer atomic.AddUint64(&StatRunningGoRoutines, ^uint64(0))
+
+	for {
+		select {
+		case <-impl.ctx.Done():
+			return
+		case <-impl.getClock().After(CfgUpdateLoopTimeout * time.Millisecond):
+		}
+
+		impl.housekeeping(impl.currentTime())
+	}
+}
+
+func isConnectPacket(p *packet) bool {
+	return p.flag(descConnect)
+}
+
+func isQueuedConnectPacket(i interface{}) bool {
+	return i.(*packet).flag(descConnect)
+}
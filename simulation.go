@@ -0,0 +1,392 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Simulation drives servers and clients over a virtual network step by step. No sockets
+// and no goroutines are used and time only moves forward when the simulation is stepped,
+// so that the same seed always leads to the same result. All endpoints of the simulation use
+// its own clock instead of CfgClock.
+type Simulation struct {
+	// Clock is the clock of the simulation. It is advanced by CfgUpdateLoopTimeout on every step.
+	Clock *ManualClock
+
+	// PacketLoss is the probability (0 to 1) that a datagram gets lost.
+	PacketLoss float64
+
+	// Latency is the time it takes for a datagram to arrive.
+	Latency time.Duration
+
+	// Jitter is the max random time that is added to Latency for every datagram.
+	Jitter time.Duration
+
+	mutex       sync.Mutex
+	random      *rand.Rand
+	endpoints   []*simulationEndpoint
+	addresses   map[string]*simulationEndpoint
+	datagrams   []simulationDatagram
+	sequence    uint64
+	tasks       []func()
+	clientCount int
+	nats        map[string]*SimulatedNAT
+}
+
+type simulationEndpoint struct {
+	addr     *net.UDPAddr
+	protocol *protocolImpl
+	reason   DisconnectReason
+	nat      *SimulatedNAT
+}
+
+type simulationDatagram struct {
+	from      *net.UDPAddr
+	to        *net.UDPAddr
+	data      []byte
+	deliverAt time.Time
+	sequence  uint64
+}
+
+// NewSimulation creates a new simulation whose random network behaviour is derived from the seed.
+func NewSimulation(seed int64) *Simulation {
+	s := &Simulation{
+		Clock:     NewManualClock(time.Unix(0, 0)),
+		random:    rand.New(rand.NewSource(seed)),
+		addresses: make(map[string]*simulationEndpoint),
+		nats:      make(map[string]*SimulatedNAT),
+	}
+
+	return s
+}
+
+// Close destroys all servers and clients of the simulation.
+func (s *Simulation) Close() {
+	for _, e := range s.endpoints {
+		e.protocol.destroy(e.reason)
+	}
+
+	s.runTasks()
+}
+
+// AddServer starts the server inside of the simulation instead of binding a socket. If the
+// server's address has no ip 127.0.0.1 is used.
+func (s *Simulation) AddServer(server *Server) {
+	addr := *server.address
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+
+	server.loadBans()
+	s.start(&server.protocolImpl, &addr, DisconnectReasonServerShutdown, nil)
+}
+
+// AddPeer starts the peer inside of the simulation instead of binding a socket. If the peer's
+// address has no ip 127.0.0.1 is used.
+func (s *Simulation) AddPeer(peer *Peer) {
+	addr := *peer.address
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+
+	s.start(&peer.protocolImpl, &addr, DisconnectReasonLocalRequest, nil)
+}
+
+// AddServerBehindNAT starts the server inside of the simulation behind the NAT. The server gets a
+// private address with the port of its address assigned.
+func (s *Simulation) AddServerBehindNAT(server *Server, nat *SimulatedNAT) {
+	server.loadBans()
+	s.start(&server.protocolImpl, nat.privateAddr(server.address.Port), DisconnectReasonServerShutdown, nat)
+}
+
+// Connect connects the client to its server inside of the simulation. The client gets a
+// virtual address assigned.
+func (s *Simulation) Connect(client *Client, data []byte) {
+	s.start(&client.protocolImpl, s.clientAddr(), DisconnectReasonLocalRequest, nil)
+	client.connect(client.address, data)
+}
+
+// ConnectThroughIntroducer does the same as Client.ConnectThroughIntroducer inside of the simulation.
+// If nat is not nil the client is placed behind it.
+func (s *Simulation) ConnectThroughIntroducer(client *Client, nat *SimulatedNAT, introducer string, hostID string, data []byte) error {
+	if !validHostID(hostID) {
+		return ErrInvalidHostID
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", introducer)
+	if err != nil {
+		return err
+	}
+
+	if nat != nil {
+		s.start(&client.protocolImpl, nat.privateAddr(50000), DisconnectReasonLocalRequest, nat)
+	} else {
+		s.start(&client.protocolImpl, s.clientAddr(), DisconnectReasonLocalRequest, nil)
+	}
+
+	return client.introduce(addr, hostID, data)
+}
+
+func (s *Simulation) clientAddr() *net.UDPAddr {
+	s.clientCount++
+	return &net.UDPAddr{IP: net.IPv4(10, 0, byte(s.clientCount>>8), byte(s.clientCount)), Port: 50000}
+}
+
+func (s *Simulation) start(impl *protocolImpl, addr *net.UDPAddr, reason DisconnectReason, nat *SimulatedNAT) {
+	e := &simulationEndpoint{addr: addr, protocol: impl, reason: reason, nat: nat}
+	s.endpoints = append(s.endpoints, e)
+	s.addresses[addr.String()] = e
+
+	impl.simulation = s
+	impl.clock = s.Clock
+	impl.scheduler = newManualScheduler(1, s.Clock)
+	impl.writeFunc = func(conn *net.UDPConn, to *net.UDPAddr, buffer []byte) {
+		s.send(e, to, buffer)
+	}
+
+	impl.listen()
+}
+
+// Step advances the clock by CfgUpdateLoopTimeout, delivers all datagrams that arrived in the
+// meantime and processes all connections once.
+func (s *Simulation) Step() {
+	s.Clock.Advance(CfgUpdateLoopTimeout * time.Millisecond)
+	s.deliver()
+
+	for _, e := range s.endpoints {
+		if e.protocol.scheduler != nil {
+			e.protocol.scheduler.tick()
+		}
+	}
+
+	for _, e := range s.endpoints {
+		if e.protocol.sessions != nil {
+			e.protocol.housekeeping(clockTime(s.Clock))
+		}
+	}
+
+	s.runTasks()
+}
+
+// Run steps the simulation until the duration elapsed.
+func (s *Simulation) Run(d time.Duration) {
+	end := s.Clock.Now().Add(d)
+
+	for s.Clock.Now().Before(end) {
+		s.Step()
+	}
+}
+
+// RunUntil steps the simulation until the condition is true or the max duration elapsed.
+// It returns whether the condition was met.
+func (s *Simulation) RunUntil(condition func() bool, max time.Duration) bool {
+	end := s.Clock.Now().Add(max)
+
+	for !condition() {
+		if !s.Clock.Now().Before(end) {
+			return false
+		}
+
+		s.Step()
+	}
+
+	return true
+}
+
+func (s *Simulation) send(e *simulationEndpoint, to *net.UDPAddr, buffer []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// private addresses are only reachable from behind the same NAT
+	if target, f := s.addresses[to.String()]; f && target.nat != nil && target.nat != e.nat {
+		return
+	}
+
+	from := e.addr
+	if e.nat != nil && !s.isPrivate(e.nat, to) {
+		from = e.nat.outbound(e.addr, to)
+	}
+
+	if s.PacketLoss > 0 && s.random.Float64() < s.PacketLoss {
+		return
+	}
+
+	delay := s.Latency
+	if s.Jitter > 0 {
+		delay += time.Duration(s.random.Int63n(int64(s.Jitter)))
+	}
+
+	data := make([]byte, len(buffer))
+	copy(data, buffer)
+
+	s.sequence++
+	s.datagrams = append(s.datagrams, simulationDatagram{
+		from:      from,
+		to:        to,
+		data:      data,
+		deliverAt: s.Clock.Now().Add(delay),
+		sequence:  s.sequence,
+	})
+}
+
+func (s *Simulation) deliver() {
+	s.mutex.Lock()
+
+	sort.Slice(s.datagrams, func(i, j int) bool {
+		a, b := s.datagrams[i], s.datagrams[j]
+
+		if a.deliverAt.Equal(b.deliverAt) {
+			return a.sequence < b.sequence
+		}
+
+		return a.deliverAt.Before(b.deliverAt)
+	})
+
+	now := s.Clock.Now()
+	n := 0
+
+	for n < len(s.datagrams) && !s.datagrams[n].deliverAt.After(now) {
+		n++
+	}
+
+	due := make([]simulationDatagram, n)
+	copy(due, s.datagrams)
+	s.datagrams = s.datagrams[n:]
+
+	s.mutex.Unlock()
+
+	for _, d := range due {
+		to := d.to
+
+		if nat, f := s.nats[to.IP.String()]; f {
+			s.mutex.Lock()
+			private, ok := nat.inbound(to, d.from)
+			s.mutex.Unlock()
+
+			if !ok {
+				continue
+			}
+
+			to = private
+		}
+
+		e, f := s.addresses[to.String()]
+
+		// destroyed endpoints do not receive anything anymore
+		if !f || e.protocol.address == nil {
+			continue
+		}
+
+		e.protocol.handlePacket(nil, d.from, d.data)
+	}
+}
+
+func (s *Simulation) schedule(f func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tasks = append(s.tasks, f)
+}
+
+func (s *Simulation) runTasks() {
+	for {
+		s.mutex.Lock()
+		tasks := s.tasks
+		s.tasks = nil
+		s.mutex.Unlock()
+
+		if len(tasks) == 0 {
+			return
+		}
+
+		for _, f := range tasks {
+			func() {
+				defer antiPanic(nil)
+				f()
+			}()
+		}
+	}
+}
+
+// SimulatedNAT is a port restricted cone NAT inside of a simulation. Every private address is mapped to one
+// public port for all destinations but datagrams are only forwarded to it from addresses the private endpoint
+// sent something to before.
+type SimulatedNAT struct {
+	ip           net.IP
+	privateCount int
+	nextPort     int
+	mappings     map[string]*natMapping
+	ports        map[int]*natMapping
+}
+
+type natMapping struct {
+	private     *net.UDPAddr
+	public      *net.UDPAddr
+	permissions map[string]bool
+}
+
+// AddNAT creates a new NAT with its own public ip. Servers and clients are placed behind it with
+// AddServerBehindNAT and ConnectThroughIntroducer.
+func (s *Simulation) AddNAT() *SimulatedNAT {
+	n := len(s.nats) + 1
+	nat := &SimulatedNAT{
+		ip:       net.IPv4(203, 0, byte(n>>8), byte(n)),
+		nextPort: 40000,
+		mappings: make(map[string]*natMapping),
+		ports:    make(map[int]*natMapping),
+	}
+
+	s.nats[nat.ip.String()] = nat
+	return nat
+}
+
+// PublicIP returns the public ip of the NAT.
+func (n *SimulatedNAT) PublicIP() net.IP {
+	return n.ip
+}
+
+func (n *SimulatedNAT) privateAddr(port int) *net.UDPAddr {
+	n.privateCount++
+	ip := n.ip.To4()
+	return &net.UDPAddr{IP: net.IPv4(192, 168, ip[3], byte(n.privateCount)), Port: port}
+}
+
+func (s *Simulation) isPrivate(nat *SimulatedNAT, addr *net.UDPAddr) bool {
+	e, f := s.addresses[addr.String()]
+	return f && e.nat == nat
+}
+
+// outbound translates the private source address and allows datagrams from the destination.
+func (n *SimulatedNAT) outbound(private, to *net.UDPAddr) *net.UDPAddr {
+	m, f := n.mappings[private.String()]
+	if !f {
+		m = &natMapping{
+			private:     private,
+			public:      &net.UDPAddr{IP: n.ip, Port: n.nextPort},
+			permissions: make(map[string]bool),
+		}
+
+		n.nextPort++
+		n.mappings[private.String()] = m
+		n.ports[m.public.Port] = m
+	}
+
+	m.permissions[to.String()] = true
+	return m.public
+}
+
+// inbound returns the private destination if the datagram is allowed to pass.
+func (n *SimulatedNAT) inbound(public, from *net.UDPAddr) (*net.UDPAddr, bool) {
+	m, f := n.ports[public.Port]
+	if !f || !m.permissions[from.String()] {
+		return nil, false
+	}
+
+	return m.private, true
+}
@@ -0,0 +1,1022 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type simulationTest struct {
+	sim     *Simulation
+	server  *Server
+	clients []*Client
+	events  []string
+}
+
+func newSimulationTest(seed int64, clientCount int) *simulationTest {
+	t := &simulationTest{sim: NewSimulation(seed)}
+
+	t.server = NewServer("127.0.0.1:10001")
+	t.server.ClientConnect = func(c *Connection, data []byte) {
+		t.log("server: connect %v", c.Addr)
+	}
+	t.server.ClientTimeout = func(c *Connection, data []byte) {
+		t.log("server: timeout %v", c.Addr)
+	}
+	t.server.ClientDisconnect = func(c *Connection, reason DisconnectReason, data []byte) {
+		t.log("server: disconnect %v (%v)", c.Addr, reason)
+	}
+	t.server.ClientReconnect = func(c *Connection, data []byte) {
+		t.log("server: reconnect %v", c.Addr)
+	}
+	t.server.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		t.log("server: packet %v %v", c.Addr, data)
+	}
+	t.sim.AddServer(t.server)
+
+	for i := 0; i < clientCount; i++ {
+		client := NewClient("127.0.0.1:10001")
+		client.ServerConnect = func(c *Connection, data []byte) {
+			t.log("client: connect")
+		}
+		client.ServerTimeout = func(c *Connection, data []byte) {
+			t.log("client: timeout")
+		}
+		client.ServerDisconnect = func(c *Connection, reason DisconnectReason, data []byte) {
+			t.log("client: disconnect (%v) %q", reason, data)
+		}
+		client.ServerReconnect = func(c *Connection, data []byte) {
+			t.log("client: reconnect")
+		}
+
+		t.clients = append(t.clients, client)
+		t.sim.Connect(client, nil)
+	}
+
+	return t
+}
+
+func (t *simulationTest) log(format string, args ...interface{}) {
+	t.events = append(t.events, fmt.Sprintf("%v ", t.sim.Clock.Now().UnixNano()/int64(time.Millisecond))+fmt.Sprintf(format, args...))
+}
+
+func (t *simulationTest) count(prefix string) int {
+	n := 0
+	for _, e := range t.events {
+		if strings.Contains(e, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSimulationConnect(t *testing.T) {
+	test := newSimulationTest(1, 3)
+	defer test.sim.Close()
+
+	connected := test.sim.RunUntil(func() bool {
+		return test.count("client: connect") == 3 && test.count("server: connect") == 3
+	}, time.Second)
+
+	if !connected {
+		t.Errorf("Expected all clients to connect: %v", test.events)
+	}
+
+	if n := test.server.connections.len(); n != 3 {
+		t.Errorf("Expected server to have 3 connections not %v", n)
+	}
+}
+
+func TestSimulationReliableOrderedUnderLoss(t *testing.T) {
+	test := newSimulationTest(2, 1)
+	defer test.sim.Close()
+
+	test.sim.PacketLoss = 0.1
+	test.sim.Latency = 30 * time.Millisecond
+	test.sim.Jitter = 20 * time.Millisecond
+
+	var received []byte
+	test.server.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		received = append(received, data[0])
+	}
+
+	if !test.sim.RunUntil(func() bool { return test.clients[0].Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	for i := 0; i < 50; i++ {
+		test.clients[0].Server.SendReliableOrdered([]byte{byte(i)})
+		test.sim.Step()
+	}
+
+	test.sim.RunUntil(func() bool { return len(received) == 50 }, 10*time.Second)
+
+	if len(received) != 50 {
+		t.Fatalf("Expected 50 packets not %v", len(received))
+	}
+
+	for i, b := range received {
+		if b != byte(i) {
+			t.Fatalf("Expected packets in order but got %v", received)
+		}
+	}
+}
+
+func TestSimulationTimeout(t *testing.T) {
+	test := newSimulationTest(3, 1)
+	defer test.sim.Close()
+
+	test.sim.Run(time.Second)
+	test.sim.PacketLoss = 1
+	test.sim.Run(time.Duration(CfgTimeoutThreshold)*time.Millisecond + time.Second*3)
+
+	if test.count("server: timeout") != 1 || test.count("client: timeout") != 1 {
+		t.Errorf("Expected server and client to time out: %v", test.events)
+	}
+
+	if test.count("(timeout)") != 2 {
+		t.Errorf("Expected disconnects with timeout reason: %v", test.events)
+	}
+
+	if n := test.server.connections.len(); n != 0 {
+		t.Errorf("Expected server to have no connections not %v", n)
+	}
+}
+
+func TestSimulationDisconnectReasons(t *testing.T) {
+	test := newSimulationTest(5, 1)
+	defer test.sim.Close()
+
+	var conn *Connection
+	test.server.ClientConnect = func(c *Connection, data []byte) {
+		conn = c
+	}
+
+	if !test.sim.RunUntil(func() bool { return conn != nil }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	conn.Disconnect([]byte("bye"))
+	test.sim.Run(time.Second)
+
+	if test.count(`client: disconnect (remote request) "bye"`) != 1 {
+		t.Errorf("Expected client to see a remote request: %v", test.events)
+	}
+
+	if test.count("server: disconnect 10.0.0.1:50000 (local request)") != 1 {
+		t.Errorf("Expected server to see a local request: %v", test.events)
+	}
+}
+
+func TestSimulationRejected(t *testing.T) {
+	test := newSimulationTest(6, 0)
+	defer test.sim.Close()
+
+	test.server.ClientValidation = func(addr *net.UDPAddr, data []byte) bool {
+		return false
+	}
+
+	client := NewClient("127.0.0.1:10001")
+	var reason DisconnectReason = 255
+	client.ServerDisconnect = func(c *Connection, r DisconnectReason, data []byte) {
+		reason = r
+	}
+	test.sim.Connect(client, nil)
+	test.sim.Run(time.Second)
+
+	if reason != DisconnectReasonRejected {
+		t.Errorf("Expected client to be rejected but got %v", reason)
+	}
+
+	if n := test.server.connections.len(); n != 0 {
+		t.Errorf("Expected server to have no connections not %v", n)
+	}
+}
+
+func TestSimulationDeterministic(t *testing.T) {
+	run := func() []string {
+		test := newSimulationTest(4, 4)
+		defer test.sim.Close()
+
+		test.sim.PacketLoss = 0.2
+		test.sim.Latency = 20 * time.Millisecond
+		test.sim.Jitter = 40 * time.Millisecond
+		test.sim.Run(time.Second)
+
+		for i, c := range test.clients {
+			for j := 0; j < 10; j++ {
+				c.Server.SendReliable([]byte{byte(i), byte(j)})
+				c.Server.SendUnreliable([]byte{byte(i), byte(j), 0})
+			}
+		}
+
+		test.sim.Run(3 * time.Second)
+		return test.events
+	}
+
+	first, second := run(), run()
+
+	if len(first) == 0 {
+		t.Fatal("Expected events to be recorded")
+	}
+
+	if len(first) != len(second) {
+		t.Fatalf("Expected same amount of events (%v != %v)", len(first), len(second))
+	}
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected event %v to be equal: %v != %v", i, first[i], second[i])
+		}
+	}
+}
+
+func TestSimulationSessionResume(t *testing.T) {
+	defer func(grace int64) { CfgSessionGraceWindow = grace }(CfgSessionGraceWindow)
+	CfgSessionGraceWindow = 30000
+
+	test := newSimulationTest(7, 1)
+	defer test.sim.Close()
+
+	client := test.clients[0]
+	client.ReconnectPolicy = &ReconnectPolicy{InitialBackoff: 100 * time.Millisecond}
+
+	var conn *Connection
+	test.server.ClientConnect = func(c *Connection, data []byte) {
+		conn = c
+		c.Set(0, "player")
+	}
+
+	var serverReceived, clientReceived []byte
+	test.server.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		serverReceived = append(serverReceived, data...)
+	}
+	client.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		clientReceived = append(clientReceived, data...)
+	}
+
+	if !test.sim.RunUntil(func() bool { return conn != nil && client.Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	test.sim.PacketLoss = 1
+	lost := test.sim.RunUntil(func() bool {
+		return test.count("server: timeout") == 1 && test.count("client: timeout") == 1
+	}, 10*time.Second)
+
+	if !lost {
+		t.Fatalf("Expected both sides to time out: %v", test.events)
+	}
+
+	// both sides send while the connection is detached
+	conn.SendReliableOrdered([]byte{1})
+	client.Server.SendReliableOrdered([]byte{2})
+
+	test.sim.PacketLoss = 0
+	resumed := test.sim.RunUntil(func() bool {
+		return len(serverReceived) == 1 && len(clientReceived) == 1
+	}, 10*time.Second)
+
+	if !resumed {
+		t.Fatalf("Expected pending packets to be delivered after reconnect: %v", test.events)
+	}
+
+	if test.count("server: reconnect") != 1 || test.count("client: reconnect") != 1 {
+		t.Errorf("Expected one reconnect on both sides: %v", test.events)
+	}
+
+	if test.count("disconnect") != 0 || test.count("client: connect") != 1 {
+		t.Errorf("Expected the session to be resumed instead of a new connection: %v", test.events)
+	}
+
+	if v, _ := conn.Get(0); v != "player" {
+		t.Errorf("Expected connection values to be kept but got %v", v)
+	}
+}
+
+func TestSimulationSessionHijack(t *testing.T) {
+	defer func(grace int64) { CfgSessionGraceWindow = grace }(CfgSessionGraceWindow)
+	CfgSessionGraceWindow = 30000
+
+	test := newSimulationTest(11, 1)
+	defer test.sim.Close()
+
+	var conn *Connection
+	test.server.ClientConnect = func(c *Connection, data []byte) {
+		conn = c
+	}
+
+	if !test.sim.RunUntil(func() bool { return conn != nil && test.clients[0].Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	// somebody who sniffed the ticket tries to resume the active session from another address
+	p := &packet{protocolID: CfgProtocolID, descriptor: descReliable | descConnect | descSession, data: conn.ticket[:]}
+	p.calculateHash()
+	attacker := &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 50000}
+	test.server.handlePacket(test.server.socket, attacker, p.serialize())
+	test.sim.Run(time.Second)
+
+	if conn.Addr.String() == attacker.String() || test.count("server: reconnect") != 0 {
+		t.Errorf("Expected active session to stay with its address: %v", test.events)
+	}
+}
+
+func TestSimulationSessionExpired(t *testing.T) {
+	defer func(grace int64) { CfgSessionGraceWindow = grace }(CfgSessionGraceWindow)
+	CfgSessionGraceWindow = 1000
+
+	test := newSimulationTest(8, 1)
+	defer test.sim.Close()
+
+	test.clients[0].ReconnectPolicy = &ReconnectPolicy{InitialBackoff: 3 * time.Second}
+
+	test.sim.Run(time.Second)
+	test.sim.PacketLoss = 1
+	test.sim.RunUntil(func() bool { return test.count("server: disconnect") == 1 }, 10*time.Second)
+	test.sim.PacketLoss = 0
+
+	reconnected := test.sim.RunUntil(func() bool {
+		return test.count("client: connect") == 2 && test.count("server: connect") == 2
+	}, 20*time.Second)
+
+	if !reconnected {
+		t.Fatalf("Expected client to establish a new connection: %v", test.events)
+	}
+
+	if test.count("server: disconnect 10.0.0.1:50000 (timeout)") != 1 {
+		t.Errorf("Expected server to end the session after the grace window: %v", test.events)
+	}
+
+	if test.count("reconnect") != 0 || test.count("client: disconnect") != 0 {
+		t.Errorf("Expected no resumption and no disconnect on the client: %v", test.events)
+	}
+}
+
+func TestSimulationReconnectGivesUp(t *testing.T) {
+	test := newSimulationTest(9, 1)
+	defer test.sim.Close()
+
+	test.clients[0].ReconnectPolicy = &ReconnectPolicy{InitialBackoff: 100 * time.Millisecond, Multiplier: 2, MaxAttempts: 2}
+
+	test.sim.Run(time.Second)
+	test.sim.PacketLoss = 1
+
+	gaveUp := test.sim.RunUntil(func() bool { return test.count("client: disconnect") == 1 }, 30*time.Second)
+
+	if !gaveUp || test.count("client: disconnect (timeout)") != 1 {
+		t.Fatalf("Expected client to give up with a timeout: %v", test.events)
+	}
+
+	if test.count("client: timeout") != 1 {
+		t.Errorf("Expected ServerTimeout only for the first timeout: %v", test.events)
+	}
+}
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	p := &ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+
+	for i, e := range expected {
+		if b := p.backoff(i); b != e {
+			t.Errorf("Expected backoff %v for attempt %v but got %v", e, i, b)
+		}
+	}
+}
+
+func TestSimulationServerFull(t *testing.T) {
+	defer func(max int) { CfgMaxConnections = max }(CfgMaxConnections)
+	CfgMaxConnections = 2
+
+	test := newSimulationTest(10, 3)
+	defer test.sim.Close()
+
+	test.sim.Run(time.Second)
+
+	if test.count("client: connect") != 2 || test.count("client: disconnect (server full)") != 1 {
+		t.Errorf("Expected one client to be rejected: %v", test.events)
+	}
+
+	if n := test.server.connections.len(); n != 2 {
+		t.Errorf("Expected server to have 2 connections not %v", n)
+	}
+}
+
+func TestSimulationBan(t *testing.T) {
+	test := newSimulationTest(11, 1)
+	defer test.sim.Close()
+
+	test.sim.Run(time.Second)
+
+	if err := test.server.Ban("10.0.0.0/24", time.Minute, "cheating"); err != nil {
+		t.Fatal(err)
+	}
+
+	test.sim.Run(time.Second)
+
+	if test.count(`client: disconnect (banned) "cheating"`) != 1 {
+		t.Errorf("Expected client to be banned: %v", test.events)
+	}
+
+	// a new client of the same network is rejected as well
+	client := NewClient("127.0.0.1:10001")
+	var reason DisconnectReason
+	client.ServerDisconnect = func(c *Connection, r DisconnectReason, data []byte) {
+		reason = r
+	}
+	test.sim.Connect(client, nil)
+	test.sim.Run(time.Second)
+
+	if reason != DisconnectReasonBanned || test.server.connections.len() != 0 {
+		t.Errorf("Expected new client to be rejected but got %v", reason)
+	}
+
+	if bans := test.server.Bans(); len(bans) != 1 || bans[0].CIDR != "10.0.0.0/24" {
+		t.Errorf("Expected ban to be listed: %v", bans)
+	}
+
+	test.server.Unban("10.0.0.0/24")
+
+	if len(test.server.Bans()) != 0 {
+		t.Error("Expected ban to be removed")
+	}
+}
+
+func TestSimulationDenyList(t *testing.T) {
+	test := newSimulationTest(12, 0)
+	defer test.sim.Close()
+
+	_, denied, _ := net.ParseCIDR("10.0.0.0/8")
+	test.server.DenyList = []*net.IPNet{denied}
+
+	client := NewClient("127.0.0.1:10001")
+	test.sim.Connect(client, nil)
+	test.sim.Run(time.Second)
+
+	if client.Server.getState() == stateConnected || test.server.connections.len() != 0 {
+		t.Error("Expected denied client not to connect")
+	}
+}
+
+func TestSimulationRateLimit(t *testing.T) {
+	defer func(rate float64, action RateLimitAction) {
+		CfgMaxPacketsPerSecond, CfgRateLimitAction = rate, action
+	}(CfgMaxPacketsPerSecond, CfgRateLimitAction)
+	CfgMaxPacketsPerSecond = 50
+
+	test := newSimulationTest(13, 1)
+	defer test.sim.Close()
+
+	received := 0
+	test.server.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		received++
+	}
+
+	test.sim.Run(time.Second)
+
+	for i := 0; i < 90; i++ {
+		test.clients[0].Server.SendUnreliable([]byte{byte(i)})
+	}
+
+	test.sim.Run(100 * time.Millisecond)
+
+	if received == 0 || received > 50 {
+		t.Errorf("Expected at most 50 packets to pass the limit not %v", received)
+	}
+
+	CfgRateLimitAction = RateLimitDisconnect
+
+	for i := 0; i < 90; i++ {
+		test.clients[0].Server.SendUnreliable([]byte{byte(i)})
+	}
+
+	test.sim.Run(time.Second)
+
+	if test.count("server: disconnect 10.0.0.1:50000 (rate limited)") != 1 || test.count("client: disconnect (rate limited)") != 1 {
+		t.Errorf("Expected client to be disconnected: %v", test.events)
+	}
+}
+
+func TestSimulationRateLimitIgnoresInvalidPackets(t *testing.T) {
+	defer func(rate float64, action RateLimitAction) {
+		CfgMaxPacketsPerSecond, CfgRateLimitAction = rate, action
+	}(CfgMaxPacketsPerSecond, CfgRateLimitAction)
+	CfgMaxPacketsPerSecond = 50
+	CfgRateLimitAction = RateLimitDisconnect
+
+	test := newSimulationTest(14, 1)
+	defer test.sim.Close()
+
+	test.sim.Run(time.Second)
+
+	// spoofed packets with the client's address but without valid hash
+	p := &packet{protocolID: CfgProtocolID, data: []byte{1}}
+	p.calculateHash()
+	spoofed := p.serialize()
+	spoofed[1] ^= 0xff
+
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	for i := 0; i < 200; i++ {
+		test.server.handlePacket(test.server.socket, client, spoofed)
+	}
+
+	test.sim.Run(time.Second)
+
+	if test.count("disconnect") != 0 {
+		t.Errorf("Expected invalid packets to not count towards the limit: %v", test.events)
+	}
+}
+
+func TestSimulationPunchThrough(t *testing.T) {
+	test := newSimulationTest(13, 0)
+	defer test.sim.Close()
+
+	test.server.Introducer = true
+
+	hostNAT := test.sim.AddNAT()
+	host := NewServer("0.0.0.0:7000")
+	host.ClientConnect = func(c *Connection, data []byte) {
+		test.log("host: connect %v %q", c.Addr, data)
+	}
+	test.sim.AddServerBehindNAT(host, hostNAT)
+
+	if err := host.RegisterHost("127.0.0.1:10001", "lobby"); err != nil {
+		t.Fatal(err)
+	}
+
+	test.sim.Run(100 * time.Millisecond)
+
+	clientNAT := test.sim.AddNAT()
+	client := NewClient("127.0.0.1:10001")
+	client.ServerConnect = func(c *Connection, data []byte) {
+		test.log("client: connect %v", c.Addr)
+	}
+	client.IntroductionFailed = func(err error) {
+		test.log("client: introduction failed %v", err)
+	}
+
+	if err := test.sim.ConnectThroughIntroducer(client, clientNAT, "127.0.0.1:10001", "lobby", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	connected := test.sim.RunUntil(func() bool {
+		return test.count("client: connect") == 1 && test.count("host: connect") == 1
+	}, 2*time.Second)
+
+	if !connected {
+		t.Fatalf("Expected client to connect to the host: %v", test.events)
+	}
+
+	if !client.Server.Addr.IP.Equal(hostNAT.PublicIP()) {
+		t.Errorf("Expected client to be connected to the public address of the host not %v", client.Server.Addr)
+	}
+
+	if test.count(fmt.Sprintf("host: connect %v", clientNAT.PublicIP())) != 1 {
+		t.Errorf("Expected host to see the public address of the client: %v", test.events)
+	}
+
+	if n := test.server.connections.len(); n != 0 {
+		t.Errorf("Expected introducer to have no connections not %v", n)
+	}
+}
+
+func TestSimulationPunchThroughUnknownHost(t *testing.T) {
+	test := newSimulationTest(14, 0)
+	defer test.sim.Close()
+
+	test.server.Introducer = true
+
+	var failure error
+	client := NewClient("127.0.0.1:10001")
+	client.IntroductionFailed = func(err error) {
+		failure = err
+	}
+
+	if err := test.sim.ConnectThroughIntroducer(client, test.sim.AddNAT(), "127.0.0.1:10001", "missing", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	test.sim.RunUntil(func() bool { return failure != nil }, time.Second)
+
+	if failure != ErrHostNotFound {
+		t.Errorf("Expected ErrHostNotFound not %v", failure)
+	}
+}
+
+func TestSimulationNATBlocksUnsolicited(t *testing.T) {
+	test := newSimulationTest(15, 0)
+	defer test.sim.Close()
+
+	nat := test.sim.AddNAT()
+	test.sim.AddServerBehindNAT(test.server, nat)
+
+	client := NewClient(fmt.Sprintf("%v:40000", nat.PublicIP()))
+	client.ServerConnect = func(c *Connection, data []byte) {
+		test.log("client: connect")
+	}
+	test.sim.Connect(client, nil)
+
+	test.sim.Run(time.Second)
+
+	if test.count("client: connect") != 0 {
+		t.Errorf("Expected NAT to drop unsolicited connect packets: %v", test.events)
+	}
+}
+
+func TestSimulationPeers(t *testing.T) {
+	sim := NewSimulation(16)
+	defer sim.Close()
+
+	var events []string
+	peers := make([]*Peer, 3)
+
+	for i := range peers {
+		name := fmt.Sprintf("peer%v", i)
+		peers[i] = NewPeer(fmt.Sprintf("127.0.0.1:%v", 20000+i))
+		peers[i].PeerConnect = func(c *Connection, data []byte) {
+			events = append(events, fmt.Sprintf("%v: connect %v", name, c.Addr.Port))
+		}
+		peers[i].PacketHandler = func(c *Connection, data []byte, channel Channel) {
+			events = append(events, fmt.Sprintf("%v: packet %v %s", name, c.Addr.Port, data))
+		}
+		sim.AddPeer(peers[i])
+	}
+
+	// peer0 connects to both others, peer1 and peer2 connect to each other at the same time
+	var outbound []*Connection
+	for _, target := range []string{"127.0.0.1:20001", "127.0.0.1:20002"} {
+		c, err := peers[0].Connect(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outbound = append(outbound, c)
+	}
+
+	peers[1].Connect("127.0.0.1:20002")
+	peers[2].Connect("127.0.0.1:20001")
+
+	connected := sim.RunUntil(func() bool {
+		return peers[0].connections.len() == 2 && peers[1].connections.len() == 2 && peers[2].connections.len() == 2 &&
+			len(events) >= 6
+	}, time.Second)
+
+	if !connected {
+		t.Fatalf("Expected all peers to be connected to each other: %v", events)
+	}
+
+	for _, c := range outbound {
+		c.SendReliableOrdered([]byte("hello"))
+	}
+
+	sim.Run(200 * time.Millisecond)
+
+	for _, expected := range []string{"peer1: packet 20000 hello", "peer2: packet 20000 hello"} {
+		found := false
+		for _, e := range events {
+			found = found || e == expected
+		}
+
+		if !found {
+			t.Errorf("Expected event %q: %v", expected, events)
+		}
+	}
+
+	if _, err := NewPeer("127.0.0.1:20003").Connect("127.0.0.1:20000"); err != ErrPeerNotStarted {
+		t.Errorf("Expected ErrPeerNotStarted not %v", err)
+	}
+}
+
+// call runs Call in a goroutine while the simulation is stepped.
+func (t *simulationTest) call(c *Connection, ctx context.Context, method uint16, payload []byte) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		data, err := c.Call(ctx, method, payload)
+		done <- result{data, err}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		select {
+		case r := <-done:
+			return r.data, r.err
+		default:
+		}
+
+		t.sim.Step()
+		time.Sleep(time.Millisecond)
+	}
+
+	return nil, fmt.Errorf("call did not return")
+}
+
+func TestSimulationRPC(t *testing.T) {
+	test := newSimulationTest(17, 1)
+	defer test.sim.Close()
+
+	test.server.HandleRPC(1, func(c *Connection, payload []byte) ([]byte, error) {
+		return append([]byte("echo:"), payload...), nil
+	})
+	test.server.HandleRPC(2, func(c *Connection, payload []byte) ([]byte, error) {
+		return nil, fmt.Errorf("out of stock")
+	})
+
+	if !test.sim.RunUntil(func() bool { return test.clients[0].Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	conn := test.clients[0].Server
+
+	if data, err := test.call(conn, context.Background(), 1, []byte("hi")); err != nil || string(data) != "echo:hi" {
+		t.Errorf("Expected echo:hi not %q (%v)", data, err)
+	}
+
+	_, err := test.call(conn, context.Background(), 2, nil)
+	if e, ok := err.(*RPCError); !ok || e.Method != 2 || e.Message != "out of stock" {
+		t.Errorf("Expected remote error out of stock not %v", err)
+	}
+
+	_, err = test.call(conn, context.Background(), 3, nil)
+	if e, ok := err.(*RPCError); !ok || e.Message != "unknown method" {
+		t.Errorf("Expected unknown method error not %v", err)
+	}
+
+	// nothing arrives anymore, the client gives up after the context's deadline
+	test.sim.PacketLoss = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := test.call(conn, ctx, 1, nil); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded not %v", err)
+	}
+}
+
+func TestSimulationRPCDisconnect(t *testing.T) {
+	test := newSimulationTest(18, 1)
+	defer test.sim.Close()
+
+	if !test.sim.RunUntil(func() bool { return test.clients[0].Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	// the request is lost and the connection times out before an answer arrives
+	test.sim.PacketLoss = 1
+
+	if _, err := test.call(test.clients[0].Server, context.Background(), 1, nil); err != ErrRPCDisconnected {
+		t.Errorf("Expected ErrRPCDisconnected not %v", err)
+	}
+}
+
+func TestSimulationRouter(t *testing.T) {
+	test := newSimulationTest(19, 1)
+	defer test.sim.Close()
+
+	router := NewRouter()
+	router.HandleOn(7, ChannelReliableOrdered, func(c *Connection, data []byte, channel Channel) {
+		test.log("server: message 7 %s", data)
+	})
+	test.server.PacketHandler = router.Dispatch
+
+	if !test.sim.RunUntil(func() bool { return test.clients[0].Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	test.clients[0].Server.SendMessage(ChannelReliableOrdered, 7, []byte("buy"))
+
+	if !test.sim.RunUntil(func() bool { return test.count("server: message 7 buy") == 1 }, time.Second) {
+		t.Errorf("Expected message to be routed: %v", test.events)
+	}
+}
+
+func TestSimulationInterceptors(t *testing.T) {
+	test := newSimulationTest(20, 1)
+	defer test.sim.Close()
+
+	client := test.clients[0]
+	client.SendInterceptors = []InterceptorFunc{
+		func(m *Message) bool {
+			return string(m.Data) != "secret"
+		},
+		func(m *Message) bool {
+			// send everything reliably and mark it
+			m.Channel = ChannelReliableOrdered
+			m.Data = append([]byte("x:"), m.Data...)
+			return true
+		},
+		func(m *Message) bool {
+			if string(m.Data) == "x:invalid" {
+				m.Channel = Channel(200)
+			}
+
+			return true
+		},
+	}
+
+	test.server.ReceiveInterceptors = []InterceptorFunc{
+		func(m *Message) bool {
+			test.log("server: observed %s %v", m.Data, m.Channel)
+			return string(m.Data) != "x:drop"
+		},
+	}
+
+	if !test.sim.RunUntil(func() bool { return client.Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	if err := client.Server.SendUnreliable([]byte("secret")); err != ErrMessageDropped {
+		t.Errorf("Expected ErrMessageDropped not %v", err)
+	}
+
+	if err := client.Server.SendUnreliable([]byte("invalid")); err != ErrUnknownChannel {
+		t.Errorf("Expected ErrUnknownChannel not %v", err)
+	}
+
+	client.Server.SendUnreliable([]byte("drop"))
+	client.Server.SendUnreliable([]byte("hello"))
+	test.sim.Run(200 * time.Millisecond)
+
+	if n := test.count("observed"); n != 2 {
+		t.Errorf("Expected server to observe 2 messages not %v: %v", n, test.events)
+	}
+
+	if test.count(fmt.Sprintf("server: observed x:hello %v", ChannelReliableOrdered)) != 1 {
+		t.Errorf("Expected modified message on the reliable ordered channel: %v", test.events)
+	}
+
+	if test.count("server: packet") != 1 || test.count("server: packet 10.0.0.1:50000 [120 58 104 101 108 108 111]") != 1 {
+		t.Errorf("Expected only the hello message to reach the packet handler: %v", test.events)
+	}
+}
+
+func TestSimulationSnapshots(t *testing.T) {
+	test := newSimulationTest(21, 1)
+	defer test.sim.Close()
+
+	world := func(tick int) []byte {
+		snapshot := make([]byte, 200)
+		for i := range snapshot {
+			snapshot[i] = byte(i)
+		}
+
+		snapshot[tick%200] = byte(tick)
+		snapshot[(tick*7)%200] = byte(tick)
+		snapshot[199] = byte(tick)
+		return snapshot
+	}
+
+	client := test.clients[0]
+	received, last := 0, -1
+	client.SnapshotHandler = func(c *Connection, snapshot []byte) {
+		tick := int(snapshot[199])
+		if tick <= last {
+			t.Errorf("Expected snapshot newer than %v not %v", last, tick)
+		}
+
+		if !bytes.Equal(snapshot, world(tick)) {
+			t.Errorf("Expected snapshot %v to be reconstructed correctly", tick)
+		}
+
+		received, last = received+1, tick
+	}
+
+	if !test.sim.RunUntil(func() bool { return client.Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	var conn *Connection
+	test.server.connections.each(func(c *Connection) {
+		conn = c
+	})
+
+	test.sim.PacketLoss = 0.2
+	for tick := 0; tick < 100; tick++ {
+		if err := conn.SendSnapshot(world(tick)); err != nil {
+			t.Fatal(err)
+		}
+
+		test.sim.Run(20 * time.Millisecond)
+	}
+
+	if received < 50 || last < 95 {
+		t.Errorf("Expected most snapshots to arrive not %v (last %v)", received, last)
+	}
+
+	conn.snapshotMutex.Lock()
+	baseline, hasBaseline := conn.snapshotSender.baseline, conn.snapshotSender.hasBaseline
+	conn.snapshotMutex.Unlock()
+
+	if !hasBaseline || baseline < 90 {
+		t.Errorf("Expected a recent acknowledged baseline not %v (%v)", baseline, hasBaseline)
+	}
+}
+
+func TestSimulationRedundantChannel(t *testing.T) {
+	test := newSimulationTest(22, 1)
+	defer test.sim.Close()
+
+	var inputs []int
+	test.server.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		if channel != ChannelUnreliableRedundant {
+			t.Errorf("Expected redundant channel not %v", channel)
+		}
+
+		inputs = append(inputs, int(binary.LittleEndian.Uint16(data)))
+	}
+
+	client := test.clients[0]
+	if !test.sim.RunUntil(func() bool { return client.Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	test.sim.PacketLoss = 0.3
+	for i := 0; i < 200; i++ {
+		input := make([]byte, 2)
+		binary.LittleEndian.PutUint16(input, uint16(i))
+
+		if err := client.Server.SendOnChannel(ChannelUnreliableRedundant, input); err != nil {
+			t.Fatal(err)
+		}
+
+		test.sim.Run(10 * time.Millisecond)
+	}
+
+	for i := 1; i < len(inputs); i++ {
+		if inputs[i] <= inputs[i-1] {
+			t.Fatalf("Expected inputs in order without duplicates: %v", inputs)
+		}
+	}
+
+	// a message is only lost if all 4 packets carrying it are lost
+	if len(inputs) < 195 {
+		t.Errorf("Expected nearly all inputs to arrive not %v", len(inputs))
+	}
+}
+
+func TestSimulationFEC(t *testing.T) {
+	test := newSimulationTest(23, 1)
+	defer test.sim.Close()
+
+	received := make(map[uint16]int)
+	client := test.clients[0]
+	client.PacketHandler = func(c *Connection, data []byte, channel Channel) {
+		received[binary.LittleEndian.Uint16(data)]++
+	}
+
+	if !test.sim.RunUntil(func() bool { return client.Server.getState() == stateConnected }, time.Second) {
+		t.Fatal("Expected client to connect")
+	}
+
+	var conn *Connection
+	test.server.connections.each(func(c *Connection) {
+		conn = c
+	})
+	conn.SetFEC(2)
+
+	recovered := atomic.LoadUint64(&StatFECRecoveredPackets)
+	test.sim.PacketLoss = 0.15
+
+	for i := 0; i < 400; i++ {
+		data := make([]byte, 2)
+		binary.LittleEndian.PutUint16(data, uint16(i))
+		conn.SendUnreliable(data)
+
+		if i%4 == 3 {
+			test.sim.Run(10 * time.Millisecond)
+		}
+	}
+
+	test.sim.Run(100 * time.Millisecond)
+
+	for i, n := range received {
+		if n != 1 {
+			t.Errorf("Expected message %v to be delivered once not %v times", i, n)
+		}
+	}
+
+	// without fec about 60 messages would be lost, with it only a few groups lose more packets than parities
+	if len(received) < 370 {
+		t.Errorf("Expected nearly all messages to arrive not %v", len(received))
+	}
+
+	if atomic.LoadUint64(&StatFECRecoveredPackets) == recovered {
+		t.Error("Expected lost packets to be restored")
+	}
+
+	if size := conn.FECGroupSize(); size >= CfgFECGroupSize {
+		t.Errorf("Expected smaller groups due to loss not %v", size)
+	}
+}
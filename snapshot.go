@@ -0,0 +1,254 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// snapshot: kind (1) + id (2) + baseline id (2) + full flag (1) + full snapshot or delta
+// snapshot ack: kind (1) + latest id (2) + ack bits (4)
+const (
+	snapshotHeaderSize = 6
+	snapshotAckSize    = 7
+)
+
+// snapshotHistory stores the last CfgSnapshotHistorySize snapshots by id so that they can be used as baselines.
+type snapshotHistory struct {
+	ids       []sequenceNumber
+	snapshots [][]byte
+}
+
+func (h *snapshotHistory) get(id sequenceNumber) ([]byte, bool) {
+	if h.ids == nil {
+		return nil, false
+	}
+
+	i := id % sequenceNumber(len(h.ids))
+	if h.snapshots[i] == nil || h.ids[i] != id {
+		return nil, false
+	}
+
+	return h.snapshots[i], true
+}
+
+func (h *snapshotHistory) has(id sequenceNumber) bool {
+	_, f := h.get(id)
+	return f
+}
+
+func (h *snapshotHistory) set(id sequenceNumber, snapshot []byte) {
+	if h.ids == nil {
+		size := snapshotHistorySize()
+		h.ids = make([]sequenceNumber, size)
+		h.snapshots = make([][]byte, size)
+	}
+
+	i := id % sequenceNumber(len(h.ids))
+	h.ids[i] = id
+	h.snapshots[i] = snapshot
+}
+
+// snapshotHistorySize returns CfgSnapshotHistorySize rounded up to a power of two (at least 1). Otherwise the
+// slots of the ids would shift when they wrap around and outdated snapshots could be used as baselines.
+func snapshotHistorySize() int {
+	size := 1
+	for size < CfgSnapshotHistorySize && size < 1<<16 {
+		size <<= 1
+	}
+
+	return size
+}
+
+// snapshotSender remembers sent snapshots and the latest one the other side acknowledged.
+type snapshotSender struct {
+	history     snapshotHistory
+	nextID      sequenceNumber
+	baseline    sequenceNumber
+	hasBaseline bool
+}
+
+// snapshotReceiver remembers received snapshots that the other side may use as baselines.
+type snapshotReceiver struct {
+	history   snapshotHistory
+	latest    sequenceNumber
+	hasLatest bool
+}
+
+// SendSnapshot sends the state to the other side which receives it in its SnapshotHandler. Snapshots are sent
+// unreliably. Every snapshot is delta encoded against the latest snapshot the other side acknowledged, if that is
+// one of the last CfgSnapshotHistorySize snapshots. Otherwise or if the delta would be larger it is sent in full.
+// Older snapshots that arrive after newer ones are not delivered.
+func (c *Connection) SendSnapshot(snapshot []byte) error {
+	snapshot = append([]byte(nil), snapshot...)
+
+	c.snapshotMutex.Lock()
+	defer c.snapshotMutex.Unlock()
+
+	s := &c.snapshotSender
+	id := s.nextID
+	s.nextID++
+
+	baseline, payload := id, snapshot
+	if s.hasBaseline && int(differenceSequence(id, s.baseline)) < snapshotHistorySize() {
+		if base, f := s.history.get(s.baseline); f {
+			if delta := encodeSnapshotDelta(base, snapshot); len(delta) < len(snapshot) {
+				baseline, payload = s.baseline, delta
+			}
+		}
+	}
+
+	s.history.set(id, snapshot)
+
+	data := make([]byte, snapshotHeaderSize+len(payload))
+	data[0] = byte(systemSnapshot)
+	binary.LittleEndian.PutUint16(data[1:3], uint16(id))
+	binary.LittleEndian.PutUint16(data[3:5], uint16(baseline))
+	if baseline == id {
+		data[5] = 1
+	}
+	copy(data[snapshotHeaderSize:], payload)
+
+	return c.sendHighLevelPacket(descSystem, data)
+}
+
+func (c *Connection) handleSnapshot(data []byte) {
+	id := sequenceNumber(binary.LittleEndian.Uint16(data[1:3]))
+	baseline := sequenceNumber(binary.LittleEndian.Uint16(data[3:5]))
+	full := data[5] == 1
+	payload := data[snapshotHeaderSize:]
+
+	c.snapshotMutex.Lock()
+	r := &c.snapshotReceiver
+
+	// snapshots outside of the history would overwrite newer baselines
+	if r.hasLatest && !greaterThanSequence(id, r.latest) && int(differenceSequence(r.latest, id)) >= snapshotHistorySize() {
+		c.snapshotMutex.Unlock()
+		atomic.AddUint64(&StatDroppedSnapshots, 1)
+		return
+	}
+
+	var snapshot []byte
+	if full {
+		snapshot = append([]byte(nil), payload...)
+	} else {
+		base, f := r.history.get(baseline)
+		if f {
+			snapshot, f = decodeSnapshotDelta(base, payload)
+		}
+
+		if !f {
+			c.snapshotMutex.Unlock()
+			atomic.AddUint64(&StatDroppedSnapshots, 1)
+			return
+		}
+	}
+
+	r.history.set(id, snapshot)
+
+	deliver := !r.hasLatest || greaterThanSequence(id, r.latest)
+	if deliver {
+		r.latest, r.hasLatest = id, true
+	}
+
+	ack := make([]byte, snapshotAckSize)
+	ack[0] = byte(systemSnapshotAck)
+	binary.LittleEndian.PutUint16(ack[1:3], uint16(r.latest))
+	binary.LittleEndian.PutUint32(ack[3:7], buildAckBits(r.latest, r.history.has))
+	c.snapshotMutex.Unlock()
+
+	c.sendControlPacket(&packet{descriptor: descSystem, data: ack})
+
+	if deliver {
+		c.dispatch(func() {
+			invokeConnectionCallback(c.protocol.onSnapshot, c, snapshot)
+		})
+	}
+}
+
+func (c *Connection) handleSnapshotAck(data []byte) {
+	c.snapshotMutex.Lock()
+	defer c.snapshotMutex.Unlock()
+
+	s := &c.snapshotSender
+	forEachAck(sequenceNumber(binary.LittleEndian.Uint16(data[1:3])), binary.LittleEndian.Uint32(data[3:7]), func(id sequenceNumber) {
+		// only snapshots that are still known can serve as baseline
+		if s.history.has(id) && (!s.hasBaseline || greaterThanSequence(id, s.baseline)) {
+			s.baseline, s.hasBaseline = id, true
+		}
+	})
+}
+
+// encodeSnapshotDelta XORs the snapshot with the baseline (padded with zeros) and stores only the changed runs:
+// snapshot length (uvarint) followed by pairs of unchanged byte count (uvarint) and changed bytes (length
+// prefixed).
+func encodeSnapshotDelta(baseline, snapshot []byte) []byte {
+	xor := func(i int) byte {
+		if i < len(baseline) {
+			return snapshot[i] ^ baseline[i]
+		}
+
+		return snapshot[i]
+	}
+
+	s := NewSerializer()
+	s.WriteUvarint(uint64(len(snapshot)))
+
+	var changed []byte
+	for i := 0; i < len(snapshot); {
+		start := i
+		for i < len(snapshot) && xor(i) == 0 {
+			i++
+		}
+
+		if i == len(snapshot) {
+			break
+		}
+
+		changed = changed[:0]
+		for ; i < len(snapshot) && xor(i) != 0; i++ {
+			changed = append(changed, xor(i))
+		}
+
+		s.WriteUvarint(uint64(i - start - len(changed)))
+		s.WriteBytes(changed)
+	}
+
+	return s.Bytes()
+}
+
+func decodeSnapshotDelta(baseline, delta []byte) ([]byte, bool) {
+	s := NewSerializerFor(delta)
+
+	// a snapshot has to fit into a single packet
+	length, err := s.ReadUvarint()
+	if err != nil || length > uint64(CfgMTU) {
+		return nil, false
+	}
+
+	snapshot := make([]byte, length)
+	copy(snapshot, baseline)
+
+	for position := uint64(0); s.RemainingSize() > 0; {
+		unchanged, err := s.ReadUvarint()
+		if err != nil || unchanged > length-position {
+			return nil, false
+		}
+		position += unchanged
+
+		changed, err := s.ReadBytes()
+		if err != nil || uint64(len(changed)) > length-position {
+			return nil, false
+		}
+
+		for _, b := range changed {
+			snapshot[position] ^= b
+			position++
+		}
+	}
+
+	return snapshot, true
+}
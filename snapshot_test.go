@@ -0,0 +1,102 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSnapshotDelta(t *testing.T) {
+	baseline := bytes.Repeat([]byte{1, 2, 3, 4}, 50)
+
+	tests := [][]byte{
+		baseline,
+		append(append([]byte{}, baseline[:100]...), 9),
+		append(append([]byte{}, baseline...), 0, 0, 7),
+		{},
+	}
+
+	changed := append([]byte{}, baseline...)
+	changed[10], changed[150] = 0, 99
+	tests = append(tests, changed)
+
+	for _, snapshot := range tests {
+		delta := encodeSnapshotDelta(baseline, snapshot)
+		decoded, ok := decodeSnapshotDelta(baseline, delta)
+
+		if !ok || !bytes.Equal(decoded, snapshot) {
+			t.Errorf("Expected %v not %v (%v)", snapshot, decoded, ok)
+		}
+	}
+
+	if delta := encodeSnapshotDelta(baseline, changed); len(delta) > 10 {
+		t.Errorf("Expected small delta for two changed bytes not %v bytes", len(delta))
+	}
+
+	malformed := [][]byte{
+		{},
+		{0xff, 0xff, 0x01},
+		{10, 11, 1, 5},
+		{10, 8, 5, 1, 2, 3, 4, 5},
+	}
+
+	for _, delta := range malformed {
+		if _, ok := decodeSnapshotDelta(baseline, delta); ok {
+			t.Errorf("Expected %v to be rejected", delta)
+		}
+	}
+}
+
+func TestSnapshotAckBits(t *testing.T) {
+	received := map[sequenceNumber]bool{65535: true, 2: true, 0: true}
+	bits := buildAckBits(3, func(s sequenceNumber) bool { return received[s] })
+
+	if bits != 1|4|8 {
+		t.Errorf("Expected %b not %b", 1|4|8, bits)
+	}
+
+	var acked []sequenceNumber
+	forEachAck(3, bits, func(s sequenceNumber) {
+		acked = append(acked, s)
+	})
+
+	if len(acked) != 4 || acked[0] != 3 || acked[1] != 2 || acked[2] != 0 || acked[3] != 65535 {
+		t.Errorf("Expected [3 2 0 65535] not %v", acked)
+	}
+}
+
+func TestSnapshotHistoryWrap(t *testing.T) {
+	defer func(size int) { CfgSnapshotHistorySize = size }(CfgSnapshotHistorySize)
+
+	for _, size := range []int{0, 3, 32} {
+		CfgSnapshotHistorySize = size
+		expected := snapshotHistorySize()
+
+		if expected < 1 || expected&(expected-1) != 0 || expected < size {
+			t.Errorf("Expected a power of two of at least %v not %v", size, expected)
+		}
+
+		var h snapshotHistory
+		start := sequenceNumber(65530)
+
+		for i := 0; i < 20; i++ {
+			id := start + sequenceNumber(i)
+			h.set(id, []byte{byte(id)})
+		}
+
+		// only the last ids are known and all of them map to their own snapshot
+		for i := 0; i < 20; i++ {
+			id := start + sequenceNumber(i)
+			snapshot, f := h.get(id)
+
+			if known := i >= 20-expected; f != known {
+				t.Errorf("Size %v: expected id %v to be known: %v", size, id, known)
+			} else if f && snapshot[0] != byte(id) {
+				t.Errorf("Size %v: expected snapshot of id %v not %v", size, id, snapshot[0])
+			}
+		}
+	}
+}
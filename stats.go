@@ -31,9 +31,41 @@ var (
 	// StatDeniedConnects (atomic) counts all denied connection attempts
 	StatDeniedConnects uint64
 
+	// StatFullRejections (atomic) counts all connection attempts rejected because of connection limits
+	StatFullRejections uint64
+
+	// StatDroppedHandshakes (atomic) counts all connection attempts dropped because of CfgMaxPendingHandshakes
+	StatDroppedHandshakes uint64
+
+	// StatBlockedPackets (atomic) counts all packets dropped because of allow/deny lists or bans
+	StatBlockedPackets uint64
+
+	// StatRateLimitedPackets (atomic) counts all packets that exceeded a rate limit
+	StatRateLimitedPackets uint64
+
+	// StatDroppedQueryResponses (atomic) counts all query and introduction responses dropped because of the
+	// anti-amplification limits
+	StatDroppedQueryResponses uint64
+
+	// StatDroppedRPCResponses (atomic) counts all rpc responses whose call was already cancelled or timed out
+	StatDroppedRPCResponses uint64
+
+	// StatRejectedRPCRequests (atomic) counts all rpc requests that were rejected because too many handlers of
+	// their connection were running
+	StatRejectedRPCRequests uint64
+
+	// StatDroppedSnapshots (atomic) counts all snapshots that were too old or whose baseline was unknown
+	StatDroppedSnapshots uint64
+
+	// StatFECRecoveredPackets (atomic) counts all lost packets that were restored by forward error correction
+	StatFECRecoveredPackets uint64
+
 	// StatDisconnects (atomic) counts all disconnects
 	StatDisconnects uint64
 
 	// StatTimeouts (atomic) counts all timeouts
 	StatTimeouts uint64
+
+	// StatQueueOverflows (atomic) counts how often packets were pushed into full send or receive queues
+	StatQueueOverflows uint64
 )
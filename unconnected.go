@@ -0,0 +1,256 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueryTimeout is returned by Query if no response arrived in time.
+var ErrQueryTimeout = errors.New("rmnp: query timed out")
+
+// QueryCallback is the function called to answer a query. Returning nil sends no response.
+type QueryCallback func(*net.UDPAddr, []byte) []byte
+
+// Unconnected packets are sent without connection. Their payload starts with the kind of the message.
+type unconnectedKind byte
+
+const (
+	unconnectedQuery unconnectedKind = iota
+	unconnectedQueryResponse
+	unconnectedDiscovery
+	unconnectedDiscoveryResponse
+	unconnectedIntroRegister
+	unconnectedIntroRequest
+	unconnectedIntroResponse
+	unconnectedIntroduce
+	unconnectedPunch
+)
+
+// query/discovery request: kind (1) + nonce (4) + length (2) + payload + padding
+// query/discovery response: kind (1) + nonce (4) + payload
+const (
+	queryRequestHeaderSize  = 7
+	queryResponseHeaderSize = 5
+)
+
+func invokeQueryCallback(callback QueryCallback, addr *net.UDPAddr, payload []byte) []byte {
+	if callback != nil {
+		return callback(addr, payload)
+	}
+
+	return nil
+}
+
+// sendRaw sends a packet without sequence or ack information to an address that might not have a connection.
+func (impl *protocolImpl) sendRaw(socket *net.UDPConn, addr *net.UDPAddr, descriptor descriptor, data []byte) {
+	p := &packet{protocolID: CfgProtocolID, descriptor: descriptor, data: data}
+	buffer := p.serialize()
+	writeHash(buffer)
+	impl.writeFunc(socket, addr, buffer)
+}
+
+func (impl *protocolImpl) sendUnconnected(socket *net.UDPConn, addr *net.UDPAddr, kind unconnectedKind, payload []byte) {
+	data := make([]byte, 1+len(payload))
+	data[0] = byte(kind)
+	copy(data[1:], payload)
+	impl.sendRaw(socket, addr, descUnconnected, data)
+}
+
+// handleUnconnected is called for valid unconnected packets. The packet is only valid during the call.
+func (impl *protocolImpl) handleUnconnected(socket *net.UDPConn, addr *net.UDPAddr, packet []byte) {
+	header := headerSize(packet)
+	if len(packet) <= header {
+		return
+	}
+
+	kind := unconnectedKind(packet[header])
+	payload := packet[header+1:]
+
+	switch kind {
+	case unconnectedQuery:
+		impl.answerQuery(socket, addr, payload, len(packet), unconnectedQueryResponse, impl.onQuery)
+	case unconnectedDiscovery:
+		impl.answerQuery(socket, addr, payload, len(packet), unconnectedDiscoveryResponse, impl.onDiscovery)
+	case unconnectedIntroRegister, unconnectedIntroRequest, unconnectedIntroResponse, unconnectedIntroduce:
+		if impl.onIntroduction != nil {
+			impl.onIntroduction(socket, addr, kind, payload, len(packet))
+		}
+	}
+}
+
+// amplificationFactor returns CfgQueryAmplificationFactor. Values less than 1 are treated as 1.
+func amplificationFactor() int {
+	if CfgQueryAmplificationFactor < 1 {
+		return 1
+	}
+
+	return CfgQueryAmplificationFactor
+}
+
+// allowResponse reports whether a response datagram of the size may be sent to the unverified sender of a
+// request datagram of requestSize bytes.
+func allowResponse(size, requestSize int) bool {
+	return size <= requestSize*amplificationFactor()
+}
+
+// minRequestSize returns the size a request datagram has to be padded to so that a response datagram of
+// responseSize bytes is allowed.
+func minRequestSize(responseSize int) int {
+	factor := amplificationFactor()
+	return (responseSize + factor - 1) / factor
+}
+
+// unconnectedSize returns the size of an unconnected datagram with the payload size.
+func unconnectedSize(payloadSize int) int {
+	return (&packet{descriptor: descUnconnected}).headerSize() + 1 + payloadSize
+}
+
+// padRequest appends zero bytes to the payload of an unconnected request so that a response datagram of
+// responseSize bytes is allowed.
+func padRequest(payload []byte, responseSize int) []byte {
+	if missing := minRequestSize(responseSize) - unconnectedSize(len(payload)); missing > 0 {
+		payload = append(payload, make([]byte, missing)...)
+	}
+
+	return payload
+}
+
+// answerQuery invokes the callback and sends its response. The response is dropped if it is bigger than
+// CfgMaxQueryResponseSize or CfgQueryAmplificationFactor times the request.
+func (impl *protocolImpl) answerQuery(socket *net.UDPConn, addr *net.UDPAddr, payload []byte, requestSize int,
+	responseKind unconnectedKind, callback QueryCallback) {
+	if callback == nil || len(payload) < queryRequestHeaderSize-1 {
+		return
+	}
+
+	length := int(binary.LittleEndian.Uint16(payload[4:6]))
+	if len(payload) < 6+length {
+		return
+	}
+
+	response := invokeQueryCallback(callback, addr, append([]byte(nil), payload[6:6+length]...))
+	if response == nil {
+		return
+	}
+
+	size := 6 + queryResponseHeaderSize + len(response)
+	if size > CfgMaxQueryResponseSize || !allowResponse(size, requestSize) {
+		atomic.AddUint64(&StatDroppedQueryResponses, 1)
+		return
+	}
+
+	data := make([]byte, 4+len(response))
+	copy(data, payload[:4])
+	copy(data[4:], response)
+	impl.sendUnconnected(socket, addr, responseKind, data)
+}
+
+// Query sends the payload to the server without connecting and waits for the answer of its QueryHandler.
+// It returns the response and the round trip time. The request is resent up to two times if no response
+// arrives and it is padded so that the server is allowed to send a response of CfgMaxQueryResponseSize bytes.
+func Query(address string, payload []byte, timeout time.Duration) ([]byte, time.Duration, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	socket, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer socket.Close()
+
+	const attempts = 3
+	sent := make(map[uint32]time.Time, attempts)
+	deadline := time.Now().Add(timeout)
+	buffer := make([]byte, CfgMTU)
+
+	for i := 0; i < attempts; i++ {
+		request, nonce, err := newQueryRequest(unconnectedQuery, payload)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if _, err = socket.Write(request); err != nil {
+			return nil, 0, err
+		}
+
+		sent[nonce] = time.Now()
+
+		attemptDeadline := time.Now().Add(timeout / attempts)
+		if i == attempts-1 || attemptDeadline.After(deadline) {
+			attemptDeadline = deadline
+		}
+
+		socket.SetReadDeadline(attemptDeadline)
+
+		for {
+			length, err := socket.Read(buffer)
+			if err != nil {
+				// read deadline of this attempt reached
+				break
+			}
+
+			response, nonce, ok := parseQueryResponse(buffer[:length], unconnectedQueryResponse)
+			if !ok {
+				continue
+			}
+
+			if sendTime, f := sent[nonce]; f {
+				return response, time.Since(sendTime), nil
+			}
+		}
+	}
+
+	return nil, 0, ErrQueryTimeout
+}
+
+// newQueryRequest serializes a request with a random nonce. It is padded so that the server is allowed to
+// send a response of CfgMaxQueryResponseSize bytes.
+func newQueryRequest(kind unconnectedKind, payload []byte) ([]byte, uint32, error) {
+	var nonce [4]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, 0, err
+	}
+
+	size := queryRequestHeaderSize + len(payload)
+	if padded := minRequestSize(CfgMaxQueryResponseSize) - 6; size < padded {
+		size = padded
+	}
+
+	data := make([]byte, size)
+	data[0] = byte(kind)
+	copy(data[1:5], nonce[:])
+	binary.LittleEndian.PutUint16(data[5:7], uint16(len(payload)))
+	copy(data[7:], payload)
+
+	p := &packet{protocolID: CfgProtocolID, descriptor: descUnconnected, data: data}
+	buffer := p.serialize()
+	writeHash(buffer)
+
+	return buffer, binary.LittleEndian.Uint32(nonce[:]), nil
+}
+
+func parseQueryResponse(packet []byte, kind unconnectedKind) ([]byte, uint32, bool) {
+	if !validateHeader(packet) || descriptor(packet[5])&descUnconnected == 0 {
+		return nil, 0, false
+	}
+
+	data := packet[headerSize(packet):]
+	if len(data) < queryResponseHeaderSize || unconnectedKind(data[0]) != kind {
+		return nil, 0, false
+	}
+
+	response := make([]byte, len(data)-queryResponseHeaderSize)
+	copy(response, data[queryResponseHeaderSize:])
+	return response, binary.LittleEndian.Uint32(data[1:5]), true
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Tim Oster. All rights reserved.
+// Use of this source code is governed by the MIT license.
+// More information can be found in the LICENSE file.
+
+package rmnp
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	server := NewServer("127.0.0.1:0")
+	server.QueryHandler = func(addr *net.UDPAddr, payload []byte) []byte {
+		return append([]byte("info:"), payload...)
+	}
+	server.Start()
+	defer server.Stop()
+
+	response, rtt, err := Query(server.socket.LocalAddr().String(), []byte("players"), time.Second)
+	if err != nil {
+		t.Fatalf("Expected query to succeed: %v", err)
+	}
+
+	if !bytes.Equal(response, []byte("info:players")) {
+		t.Errorf("Expected response info:players not %q", response)
+	}
+
+	if rtt <= 0 || rtt >= time.Second {
+		t.Errorf("Expected a round trip time between 0 and 1s not %v", rtt)
+	}
+
+	if n := server.connections.len(); n != 0 {
+		t.Errorf("Expected query to create no connection but found %v", n)
+	}
+}
+
+func TestQueryAmplificationLimit(t *testing.T) {
+	server := NewServer("127.0.0.1:0")
+	server.QueryHandler = func(addr *net.UDPAddr, payload []byte) []byte {
+		return make([]byte, CfgMaxQueryResponseSize)
+	}
+	server.Start()
+	defer server.Stop()
+
+	dropped := atomic.LoadUint64(&StatDroppedQueryResponses)
+
+	_, _, err := Query(server.socket.LocalAddr().String(), nil, 300*time.Millisecond)
+	if err != ErrQueryTimeout {
+		t.Errorf("Expected oversized response to be dropped but got %v", err)
+	}
+
+	if d := atomic.LoadUint64(&StatDroppedQueryResponses) - dropped; d != 3 {
+		t.Errorf("Expected 3 dropped responses (one per attempt) not %v", d)
+	}
+}
+
+func TestQueryAmplificationFactorClamp(t *testing.T) {
+	defer func(factor int) { CfgQueryAmplificationFactor = factor }(CfgQueryAmplificationFactor)
+
+	for _, factor := range []int{0, -1} {
+		CfgQueryAmplificationFactor = factor
+
+		request, _, err := newQueryRequest(unconnectedQuery, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// treated as 1, the request has to be as big as the largest response
+		if len(request) != CfgMaxQueryResponseSize {
+			t.Errorf("Factor %v: expected request of %v bytes not %v", factor, CfgMaxQueryResponseSize, len(request))
+		}
+
+		if allowResponse(101, 100) || !allowResponse(100, 100) {
+			t.Errorf("Factor %v: expected responses to be limited to the request size", factor)
+		}
+	}
+}
@@ -5,7 +5,6 @@
 package rmnp
 
 import (
-	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"net"
@@ -35,24 +34,53 @@ func antiPanic(callback func()) {
 }
 
 func addrHash(addr *net.UDPAddr) uint32 {
-	port := cnvUint32(uint32(addr.Port))
-	return crc32.ChecksumIEEE(append(addr.IP, port...))
-}
+	// same as hashing ip + little endian port but without allocating a temporary buffer.
+	// ipv4 addresses are hashed in their 4 byte form so that ipv4-mapped ipv6 addresses match.
+	ip := addr.IP
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
 
-func cnvUint32(i uint32) []byte {
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, i)
-	return b
+	hash := ^crc32.ChecksumIEEE(ip)
+	port := uint32(addr.Port)
+
+	for i := uint(0); i < 32; i += 8 {
+		hash = crc32.IEEETable[byte(hash)^byte(port>>i)] ^ (hash >> 8)
+	}
+
+	return ^hash
 }
 
-func currentTime() int64 {
-	return time.Now().UnixNano() / int64(time.Millisecond)
+// clockTime returns the time of the clock in milliseconds.
+func clockTime(clock Clock) int64 {
+	return clock.Now().UnixNano() / int64(time.Millisecond)
 }
 
 func greaterThanSequence(s1, s2 sequenceNumber) bool {
 	return (s1 > s2 && s1-s2 <= 32768) || (s1 < s2 && s2-s1 > 32768)
 }
 
+// buildAckBits returns the bitfield of the 32 sequences before latest that were received.
+func buildAckBits(latest sequenceNumber, received func(sequenceNumber) bool) uint32 {
+	var bits uint32
+	for i := sequenceNumber(1); i <= 32; i++ {
+		if received(latest - i) {
+			bits |= 1 << (i - 1)
+		}
+	}
+
+	return bits
+}
+
+// forEachAck calls the function for the acked sequence and every earlier sequence set in the bitfield.
+func forEachAck(ack sequenceNumber, ackBits uint32, f func(sequenceNumber)) {
+	for i := sequenceNumber(0); i <= 32; i++ {
+		if i == 0 || ackBits&(1<<(i-1)) != 0 {
+			f(ack - i)
+		}
+	}
+}
+
 func greaterThanOrder(s1, s2 orderNumber) bool {
 	return (s1 > s2 && s1-s2 <= 127) || (s1 < s2 && s2-s1 > 127)
 }
@@ -4,7 +4,11 @@
 
 package rmnp
 
-import "testing"
+import (
+	"hash/crc32"
+	"net"
+	"testing"
+)
 
 func TestUtilGreaterThanSequence(t *testing.T) {
 	if greaterThanSequence(35000, 30000) != true {
@@ -47,3 +51,42 @@ func TestUtilDifferenceSequence(t *testing.T) {
 		t.Error("Expected diff(65535 - 10, 20) = 30")
 	}
 }
+
+func TestUtilAddrHash(t *testing.T) {
+	ip := make(net.IP, 4, 16)
+	copy(ip, net.IPv4(127, 0, 0, 1).To4())
+
+	addr := &net.UDPAddr{IP: ip, Port: 10001}
+	hash := addrHash(addr)
+
+	if addrHash(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 10001}) != hash {
+		t.Error("Expected equal addresses to have the same hash")
+	}
+
+	if addrHash(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}) != hash {
+		t.Error("Expected ipv4-mapped ipv6 addresses to have the same hash")
+	}
+
+	if crc32.ChecksumIEEE([]byte{127, 0, 0, 1, 0x11, 0x27, 0, 0}) != hash {
+		t.Error("Expected hash to be the crc32 of ip and little endian port")
+	}
+
+	if addrHash(&net.UDPAddr{IP: ip, Port: 10002}) == hash {
+		t.Error("Expected different ports to result in different hashes")
+	}
+
+	if len(addr.IP) != 4 || ip[:5][4] != 0 {
+		t.Error("Expected address to be unchanged after hashing")
+	}
+}
+
+func BenchmarkUtilAddrHash(b *testing.B) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		addrHash(addr)
+	}
+}